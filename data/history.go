@@ -0,0 +1,196 @@
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryFile is the file the changes to the preferences are appended to
+const HistoryFile = "preferences_history.jsonl"
+
+// ErrVersionNotFound is returned when a version of the preferences is not part of the history
+var ErrVersionNotFound = errors.New("version does not exist")
+
+// FieldChange describes the change of a single field of the preferences. Path is the json path of the field, Old and
+// New are its values before and after the change, nil when the field was added or removed
+type FieldChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Change is an entry of the preferences history. Version is the version of the preferences created by the change and
+// Snapshot holds the preferences of that version. RevertedTo is set when the change reverted the preferences to a
+// previous version
+type Change struct {
+	Version    int             `json:"version"`
+	User       string          `json:"user"`
+	Time       time.Time       `json:"time"`
+	Diff       []FieldChange   `json:"diff"`
+	RevertedTo *int            `json:"reverted_to,omitempty"`
+	Snapshot   json.RawMessage `json:"snapshot,omitempty"`
+}
+
+// History is the append-only log of the changes to the preferences
+type History interface {
+	// Append adds the change to the end of the history
+	Append(change Change) error
+	// List returns all the changes, oldest first
+	List() ([]Change, error)
+	// Get returns the change which created the version, or ErrVersionNotFound
+	Get(version int) (Change, error)
+}
+
+// MemoryHistory implements the History interface by keeping the changes in memory
+type MemoryHistory struct {
+	mutex   sync.RWMutex
+	changes []Change
+}
+
+// NewMemoryHistory returns an empty history which is kept in memory
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{changes: []Change{}}
+}
+
+func (history *MemoryHistory) Append(change Change) error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	history.changes = append(history.changes, change)
+	return nil
+}
+
+func (history *MemoryHistory) List() ([]Change, error) {
+	history.mutex.RLock()
+	defer history.mutex.RUnlock()
+	return append([]Change{}, history.changes...), nil
+}
+
+func (history *MemoryHistory) Get(version int) (Change, error) {
+	history.mutex.RLock()
+	defer history.mutex.RUnlock()
+	for idx := len(history.changes) - 1; idx >= 0; idx-- {
+		if history.changes[idx].Version == version {
+			return history.changes[idx], nil
+		}
+	}
+	return Change{}, ErrVersionNotFound
+}
+
+// FileHistory implements the History interface by appending every change as a json line to a file. The changes are
+// also kept in memory
+type FileHistory struct {
+	MemoryHistory
+	path string
+}
+
+// LoadFileHistory returns the history stored in the file, the file is created when the first change is appended
+func LoadFileHistory(path string) (*FileHistory, error) {
+	history := &FileHistory{MemoryHistory: MemoryHistory{changes: []Change{}}, path: path}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var change Change
+		err = json.Unmarshal(scanner.Bytes(), &change)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		history.changes = append(history.changes, change)
+	}
+	return history, scanner.Err()
+}
+
+func (history *FileHistory) Append(change Change) error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	file, err := os.OpenFile(history.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = json.NewEncoder(file).Encode(change)
+	if err != nil {
+		return err
+	}
+	history.changes = append(history.changes, change)
+	return nil
+}
+
+// Diff returns the changes of the fields between two json documents of the preferences, ordered by path. The version
+// is not compared
+func Diff(previous []byte, updated []byte) ([]FieldChange, error) {
+	var before, after map[string]any
+	err := json.Unmarshal(previous, &before)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(updated, &after)
+	if err != nil {
+		return nil, err
+	}
+	delete(before, "version")
+	delete(after, "version")
+	changes := diffValues("", before, after, make([]FieldChange, 0))
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// diffValues appends the changes between the two json values found at path to changes
+func diffValues(path string, before any, after any, changes []FieldChange) []FieldChange {
+	beforeObject, beforeIsObject := before.(map[string]any)
+	afterObject, afterIsObject := after.(map[string]any)
+	if beforeIsObject && afterIsObject {
+		for key, value := range beforeObject {
+			changes = diffValues(joinPath(path, key), value, afterObject[key], changes)
+		}
+		for key, value := range afterObject {
+			if _, ok := beforeObject[key]; !ok {
+				changes = diffValues(joinPath(path, key), nil, value, changes)
+			}
+		}
+		return changes
+	}
+	beforeArray, beforeIsArray := before.([]any)
+	afterArray, afterIsArray := after.([]any)
+	if beforeIsArray && afterIsArray {
+		for idx := 0; idx < len(beforeArray) || idx < len(afterArray); idx++ {
+			var beforeItem, afterItem any
+			if idx < len(beforeArray) {
+				beforeItem = beforeArray[idx]
+			}
+			if idx < len(afterArray) {
+				afterItem = afterArray[idx]
+			}
+			changes = diffValues(fmt.Sprintf("%s[%d]", path, idx), beforeItem, afterItem, changes)
+		}
+		return changes
+	}
+	if !reflect.DeepEqual(before, after) {
+		changes = append(changes, FieldChange{Path: path, Old: before, New: after})
+	}
+	return changes
+}
+
+// joinPath returns the json path of the member key of the object at path
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -5,12 +5,15 @@ import (
 	"os"
 )
 
-// DevicePreferences Structure to store the device preferences
+// DevicePreferences Structure to store the device preferences. Groups are the names of the groups the device belongs to
+// and Tags free form labels of the device
 type DevicePreferences struct {
-	DeviceID    string `json:"device_id"`
-	DisplayName string `json:"display_name"`
-	Hidden      bool   `json:"hidden"`
-	Image       string `json:"image"`
+	DeviceID    string   `json:"device_id"`
+	DisplayName string   `json:"display_name"`
+	Hidden      bool     `json:"hidden"`
+	Image       string   `json:"image"`
+	Groups      []string `json:"groups,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
 // Preferences is the interface which has methods to load and save preferences and getter/setter methods to access data
@@ -18,18 +21,28 @@ type Preferences interface {
 	Load() error
 	Save() error
 	GetDevicePreferences() []DevicePreferences
-	SetDevicePreferences(devicePreferences []DevicePreferences) error
+	SetDevicePreferences(devicePreferences []DevicePreferences)
 	GetSortColumn() string
 	IsAscending() bool
 	GetNumberOfRows() int
+	GetVersion() int
+	SetVersion(version int)
+	GetViews() map[string][]View
+	SetViews(user string, views []View)
+	GetThresholds() map[string]Thresholds
 }
 
-// PreferencesImpl implements the preferences interface. Stores data related to the user preferences
+// PreferencesImpl implements the preferences interface. Stores data related to the user preferences.
+// Version is incremented by the PreferencesStore on every change. Views holds the saved views of every user and
+// GroupThresholds the thresholds of the stationary devices of every group
 type PreferencesImpl struct {
-	SortColumn        string              `json:"sort_column"`
-	Ascending         bool                `json:"ascending"`
-	NumberOfRows      int                 `json:"number_of_rows"`
-	DevicePreferences []DevicePreferences `json:"device_preferences"`
+	Version           int                   `json:"version"`
+	SortColumn        string                `json:"sort_column"`
+	Ascending         bool                  `json:"ascending"`
+	NumberOfRows      int                   `json:"number_of_rows"`
+	DevicePreferences []DevicePreferences   `json:"device_preferences"`
+	Views             map[string][]View     `json:"views,omitempty"`
+	GroupThresholds   map[string]Thresholds `json:"group_thresholds,omitempty"`
 }
 
 const PreferencesFile = "preferences.json"
@@ -80,7 +93,33 @@ func (preferences *PreferencesImpl) GetNumberOfRows() int {
 	return preferences.NumberOfRows
 }
 
-func (preferences *PreferencesImpl) SetDevicePreferences(devicePreferences []DevicePreferences) error {
+func (preferences *PreferencesImpl) GetVersion() int {
+	return preferences.Version
+}
+
+func (preferences *PreferencesImpl) SetVersion(version int) {
+	preferences.Version = version
+}
+
+func (preferences *PreferencesImpl) GetViews() map[string][]View {
+	return preferences.Views
+}
+
+func (preferences *PreferencesImpl) SetViews(user string, views []View) {
+	if preferences.Views == nil {
+		preferences.Views = make(map[string][]View)
+	}
+	if len(views) == 0 {
+		delete(preferences.Views, user)
+		return
+	}
+	preferences.Views[user] = views
+}
+
+func (preferences *PreferencesImpl) GetThresholds() map[string]Thresholds {
+	return preferences.GroupThresholds
+}
+
+func (preferences *PreferencesImpl) SetDevicePreferences(devicePreferences []DevicePreferences) {
 	preferences.DevicePreferences = devicePreferences
-	return preferences.Save()
 }
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrVersionMismatch is returned when preferences are updated based on a version which is no longer the current one
+var ErrVersionMismatch = errors.New("preferences have been modified")
+
+// SystemUser is the user recorded for changes which were not made by a user
+const SystemUser = "system"
+
+// AnyVersion is passed to PreferencesStore.Update to update the preferences regardless of the current version
+const AnyVersion = -1
+
+// PreferencesStore guards the preferences against concurrent access. Every change to the preferences increments
+// their version, which allows optimistic locking of updates, and is recorded in the history
+type PreferencesStore struct {
+	mutex       sync.RWMutex
+	preferences Preferences
+	history     History
+	// modified is the time of the last change to the preferences
+	modified time.Time
+}
+
+// NewPreferencesStore returns a store which guards the preferences and records their changes in the history. The
+// current preferences are recorded when their version is not part of the history yet, so that they can be restored
+func NewPreferencesStore(preferences Preferences, history History) *PreferencesStore {
+	store := &PreferencesStore{preferences: preferences, history: history, modified: time.Now()}
+	change, err := history.Get(preferences.GetVersion())
+	if err == nil {
+		store.modified = change.Time
+	} else if errors.Is(err, ErrVersionNotFound) {
+		snapshot, err := json.Marshal(preferences)
+		if err == nil {
+			history.Append(Change{Version: preferences.GetVersion(), User: SystemUser, Time: store.modified, Diff: []FieldChange{}, Snapshot: snapshot})
+		}
+	}
+	return store
+}
+
+// History returns the history of the changes to the preferences
+func (s *PreferencesStore) History() History {
+	return s.history
+}
+
+// Read calls read with the preferences while holding a read lock. The preferences must not be modified or retained
+// after read returns
+func (s *PreferencesStore) Read(read func(preferences Preferences)) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	read(s.preferences)
+}
+
+// Version returns the current version of the preferences
+func (s *PreferencesStore) Version() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.preferences.GetVersion()
+}
+
+// Modified returns the time of the last change to the preferences
+func (s *PreferencesStore) Modified() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.modified
+}
+
+// Update calls update with the preferences while holding the write lock. ErrVersionMismatch is returned without
+// calling update when version is not the current version, pass AnyVersion to skip the check. When update returns an
+// error the preferences are restored, otherwise if the preferences changed the version is incremented, they are saved
+// to the storage and the change is recorded in the history as made by user. A change which cannot be recorded in the
+// history is logged, since the preferences were saved
+func (s *PreferencesStore) Update(user string, version int, update func(preferences Preferences) error) error {
+	return s.update(user, version, nil, update)
+}
+
+// Revert restores the preferences of a previous version. The revert is recorded in the history as a new change made by
+// user, so it can be reverted as well. Returns ErrVersionNotFound when the history does not hold the version. When scope
+// is not nil the snapshot of the version is restored as returned by scope, which is called with the current preferences
+func (s *PreferencesStore) Revert(user string, version int, to int, scope func(preferences Preferences, snapshot []byte) ([]byte, error)) error {
+	change, err := s.history.Get(to)
+	if err != nil {
+		return err
+	}
+	return s.update(user, version, &to, func(preferences Preferences) error {
+		snapshot := change.Snapshot
+		if scope != nil {
+			snapshot, err = scope(preferences, snapshot)
+			if err != nil {
+				return err
+			}
+		}
+		return Replace(preferences, snapshot)
+	})
+}
+
+// update implements Update, revertedTo is recorded in the history when the update reverts to a previous version
+func (s *PreferencesStore) update(user string, version int, revertedTo *int, update func(preferences Preferences) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := s.preferences.GetVersion()
+	if version != AnyVersion && version != current {
+		return ErrVersionMismatch
+	}
+	previous, err := json.Marshal(s.preferences)
+	if err != nil {
+		return err
+	}
+	err = update(s.preferences)
+	// The version can not be changed by the update, e.g. by decoding a document holding a version
+	s.preferences.SetVersion(current)
+	if err != nil {
+		s.restore(previous, current)
+		return err
+	}
+	updated, err := json.Marshal(s.preferences)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(previous, updated) {
+		return nil
+	}
+	diff, err := Diff(previous, updated)
+	if err != nil {
+		s.restore(previous, current)
+		return err
+	}
+	s.preferences.SetVersion(current + 1)
+	err = s.preferences.Save()
+	if err != nil {
+		s.restore(previous, current)
+		return err
+	}
+	s.modified = time.Now()
+	// The preferences are saved, so the update succeeded even when the change cannot be recorded in the history
+	snapshot, err := json.Marshal(s.preferences)
+	if err == nil {
+		err = s.history.Append(Change{Version: current + 1, User: user, Time: s.modified, Diff: diff, RevertedTo: revertedTo, Snapshot: snapshot})
+	}
+	if err != nil {
+		log.Printf("Error occurred while recording version %d of the preferences in the history: %v", current+1, err)
+	}
+	return nil
+}
+
+// restore replaces the preferences with the previous json document and version
+func (s *PreferencesStore) restore(previous []byte, version int) {
+	Replace(s.preferences, previous)
+	s.preferences.SetVersion(version)
+}
+
+// replacedFields lists the fields of the preferences which are cleared before a document holding them is decoded.
+// json.Unmarshal decodes into the existing elements of a slice and merges into an existing map, so it would otherwise
+// keep the fields of the device previously stored at the same position or the views of users missing from the document
+var replacedFields = []string{"device_preferences", "views", "group_thresholds"}
+
+// Decode deserializes the json document into the preferences, fields missing from the document are kept
+func Decode(preferences Preferences, document []byte) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(document, &fields)
+	if err != nil {
+		return err
+	}
+	for _, field := range replacedFields {
+		if _, ok := fields[field]; ok {
+			json.Unmarshal([]byte(`{"`+field+`":null}`), preferences)
+		}
+	}
+	return json.Unmarshal(document, preferences)
+}
+
+// Replace deserializes the json document into the preferences like Decode, but the device preferences, views and group
+// thresholds are cleared even when they are missing from the document, e.g. since they were empty when the document
+// was encoded
+func Replace(preferences Preferences, document []byte) error {
+	for _, field := range replacedFields {
+		json.Unmarshal([]byte(`{"`+field+`":null}`), preferences)
+	}
+	return Decode(preferences, document)
+}
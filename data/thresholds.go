@@ -0,0 +1,99 @@
+package data
+
+import "time"
+
+// Default durations after which a stationary device is reported and a device which did not report a point is stale,
+// used when no threshold is set for the groups of the device
+const (
+	DefaultIdleThreshold  = 5 * time.Minute
+	DefaultStopThreshold  = 15 * time.Minute
+	DefaultStaleThreshold = 30 * time.Minute
+)
+
+// DefaultThresholdsGroup is the key of the thresholds of the devices whose groups have no thresholds
+const DefaultThresholdsGroup = "*"
+
+// Thresholds structure holding the number of seconds after which a stationary device is reported. IdleSeconds applies
+// to a device whose drive status is on and StopSeconds to a parked device. StaleSeconds is the number of seconds after
+// the last point of a device after which the device is stale. A threshold of 0 is not set
+type Thresholds struct {
+	IdleSeconds  int `json:"idle_seconds,omitempty"`
+	StopSeconds  int `json:"stop_seconds,omitempty"`
+	StaleSeconds int `json:"stale_seconds,omitempty"`
+}
+
+// Idle returns the idle threshold as a duration
+func (t Thresholds) Idle() time.Duration {
+	return time.Duration(t.IdleSeconds) * time.Second
+}
+
+// Stop returns the stop threshold as a duration
+func (t Thresholds) Stop() time.Duration {
+	return time.Duration(t.StopSeconds) * time.Second
+}
+
+// Stale returns the stale threshold as a duration
+func (t Thresholds) Stale() time.Duration {
+	return time.Duration(t.StaleSeconds) * time.Second
+}
+
+// DeviceThresholds returns the thresholds of a device belonging to the groups. A device in several groups uses the
+// smallest threshold set for its groups, otherwise the threshold of the DefaultThresholdsGroup or the default threshold
+func DeviceThresholds(preferences Preferences, groups []string) Thresholds {
+	thresholds := preferences.GetThresholds()
+	var result Thresholds
+	for _, group := range groups {
+		result.IdleSeconds = smallestSet(result.IdleSeconds, thresholds[group].IdleSeconds)
+		result.StopSeconds = smallestSet(result.StopSeconds, thresholds[group].StopSeconds)
+		result.StaleSeconds = smallestSet(result.StaleSeconds, thresholds[group].StaleSeconds)
+	}
+	fallback := thresholds[DefaultThresholdsGroup]
+	if result.IdleSeconds == 0 {
+		result.IdleSeconds = fallback.IdleSeconds
+	}
+	if result.IdleSeconds == 0 {
+		result.IdleSeconds = int(DefaultIdleThreshold / time.Second)
+	}
+	if result.StopSeconds == 0 {
+		result.StopSeconds = fallback.StopSeconds
+	}
+	if result.StopSeconds == 0 {
+		result.StopSeconds = int(DefaultStopThreshold / time.Second)
+	}
+	if result.StaleSeconds == 0 {
+		result.StaleSeconds = fallback.StaleSeconds
+	}
+	if result.StaleSeconds == 0 {
+		result.StaleSeconds = int(DefaultStaleThreshold / time.Second)
+	}
+	return result
+}
+
+// smallestSet returns the smallest of the thresholds which are set, or 0 when neither is set
+func smallestSet(a int, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// validateThresholds returns the errors of the thresholds of every group
+func validateThresholds(thresholds map[string]Thresholds) []FieldError {
+	var errors []FieldError
+	for _, group := range sortedKeys(thresholds) {
+		field := "group_thresholds." + group
+		if group == "" {
+			errors = append(errors, FieldError{Field: field, Message: "group is required"})
+		}
+		if thresholds[group].IdleSeconds < 0 {
+			errors = append(errors, FieldError{Field: field + ".idle_seconds", Message: "must not be negative"})
+		}
+		if thresholds[group].StopSeconds < 0 {
+			errors = append(errors, FieldError{Field: field + ".stop_seconds", Message: "must not be negative"})
+		}
+		if thresholds[group].StaleSeconds < 0 {
+			errors = append(errors, FieldError{Field: field + ".stale_seconds", Message: "must not be negative"})
+		}
+	}
+	return errors
+}
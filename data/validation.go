@@ -0,0 +1,94 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortColumns lists the columns the devices can be sorted by
+var SortColumns = []string{"device_id", "display_name", "active_state", "online", "lat", "lng", "altitude", "drive_status"}
+
+// DeviceFields lists the fields of a device which can be requested from the devices api
+var DeviceFields = []string{
+	"device_id", "display_name", "active_state", "online", "image", "lat", "lng", "altitude", "speed", "angle", "odometer",
+	"battery_voltage", "fuel_level", "dt_tracker", "dt_server", "drive_status", "account", "idle_s",
+	"stale", "last_seen_ago", "last_moved_ago", "distance", "address",
+}
+
+// MaxNumberOfRows is the largest number of rows which can be shown in a page. -1 shows all the rows in a single page
+const MaxNumberOfRows = 1000
+
+// FieldError describes why the value of a field is invalid. Field is the json path of the field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when the preferences are invalid. Holds an error for every invalid field
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldError := range e.Errors {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "invalid preferences: " + strings.Join(messages, ", ")
+}
+
+// Validate checks the preferences and returns a *ValidationError listing the invalid fields, or nil if the preferences
+// are valid. deviceIds are the ids of the existing devices, device preferences of other devices are invalid. The
+// check is skipped when deviceIds is nil
+func Validate(preferences Preferences, deviceIds []string) error {
+	var errors []FieldError
+	if !contains(SortColumns, preferences.GetSortColumn()) {
+		errors = append(errors, FieldError{
+			Field:   "sort_column",
+			Message: fmt.Sprintf("must be one of %s", strings.Join(SortColumns, ", ")),
+		})
+	}
+	if rows := preferences.GetNumberOfRows(); rows != -1 && (rows < 1 || rows > MaxNumberOfRows) {
+		errors = append(errors, FieldError{
+			Field:   "number_of_rows",
+			Message: fmt.Sprintf("must be -1 or between 1 and %d", MaxNumberOfRows),
+		})
+	}
+	var existing map[string]bool
+	if deviceIds != nil {
+		existing = make(map[string]bool, len(deviceIds))
+		for _, deviceId := range deviceIds {
+			existing[deviceId] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for idx, devicePreferences := range preferences.GetDevicePreferences() {
+		field := fmt.Sprintf("device_preferences[%d].device_id", idx)
+		switch {
+		case devicePreferences.DeviceID == "":
+			errors = append(errors, FieldError{Field: field, Message: "is required"})
+		case seen[devicePreferences.DeviceID]:
+			errors = append(errors, FieldError{Field: field, Message: fmt.Sprintf("device %s is listed more than once", devicePreferences.DeviceID)})
+		case existing != nil && !existing[devicePreferences.DeviceID]:
+			errors = append(errors, FieldError{Field: field, Message: fmt.Sprintf("device %s does not exist", devicePreferences.DeviceID)})
+		}
+		seen[devicePreferences.DeviceID] = true
+	}
+	errors = append(errors, validateViews(preferences.GetViews())...)
+	errors = append(errors, validateThresholds(preferences.GetThresholds())...)
+	if len(errors) > 0 {
+		return &ValidationError{Errors: errors}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the map in ascending order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FilterOperators lists the operators which can be used by a filter
+var FilterOperators = []string{"eq", "ne", "lt", "lte", "gt", "gte", "contains"}
+
+// ViewSortColumns lists the columns the devices of a view can be sorted by. The distance column is virtual, it only holds
+// a value when the devices are requested with a spatial query
+var ViewSortColumns = append(append([]string{}, SortColumns...), "distance")
+
+// FilterColumns lists the columns the devices can be filtered by. group matches the groups of the device preferences.
+// The distance column is not listed since the filters are applied before the distance of the devices is known, the
+// radius_m query param limits the distance instead
+var FilterColumns = append(append([]string{}, SortColumns...), "group")
+
+// ViewColumns lists the columns which can be shown by a view
+var ViewColumns = append(append([]string{}, DeviceFields...), "group")
+
+// numericColumns lists the columns holding numbers, the values of filters on these columns must be numbers
+var numericColumns = []string{"lat", "lng", "altitude"}
+
+// Filter structure representing a condition the devices of a view must match, e.g. drive_status eq on
+type Filter struct {
+	Column   string `json:"column"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// SortKey structure representing a column the devices are sorted by
+type SortKey struct {
+	Column    string `json:"column"`
+	Ascending bool   `json:"ascending"`
+}
+
+// View structure representing a named combination of filters, sorting, page size and visible columns. The default
+// view of a user is used when the devices are requested without a view
+type View struct {
+	Name         string    `json:"name"`
+	Filters      []Filter  `json:"filters"`
+	Sort         []SortKey `json:"sort"`
+	NumberOfRows int       `json:"number_of_rows"`
+	Columns      []string  `json:"columns"`
+	Default      bool      `json:"default"`
+}
+
+// FindView returns the view of the user with the given name, or nil if the user has no such view
+func FindView(preferences Preferences, user string, name string) *View {
+	views := preferences.GetViews()[user]
+	for idx := range views {
+		if views[idx].Name == name {
+			return &views[idx]
+		}
+	}
+	return nil
+}
+
+// DefaultView returns the default view of the user, or nil if the user has no default view
+func DefaultView(preferences Preferences, user string) *View {
+	views := preferences.GetViews()[user]
+	for idx := range views {
+		if views[idx].Default {
+			return &views[idx]
+		}
+	}
+	return nil
+}
+
+// ValidateView returns the errors of the fields of the view. field is the json path of the view
+func ValidateView(view View, field string) []FieldError {
+	var errors []FieldError
+	if strings.TrimSpace(view.Name) == "" {
+		errors = append(errors, FieldError{Field: field + ".name", Message: "is required"})
+	}
+	for idx, filter := range view.Filters {
+		filterField := fmt.Sprintf("%s.filters[%d]", field, idx)
+		if !contains(FilterColumns, filter.Column) {
+			errors = append(errors, FieldError{Field: filterField + ".column", Message: fmt.Sprintf("must be one of %s", strings.Join(FilterColumns, ", "))})
+		}
+		if !contains(FilterOperators, filter.Operator) {
+			errors = append(errors, FieldError{Field: filterField + ".operator", Message: fmt.Sprintf("must be one of %s", strings.Join(FilterOperators, ", "))})
+		}
+		if filter.Column == "group" && !contains([]string{"eq", "ne", "contains"}, filter.Operator) {
+			errors = append(errors, FieldError{Field: filterField + ".operator", Message: "must be one of eq, ne, contains"})
+		}
+		if filter.Column == "online" && !contains([]string{"eq", "ne"}, filter.Operator) {
+			errors = append(errors, FieldError{Field: filterField + ".operator", Message: "must be one of eq, ne"})
+		}
+		if contains(numericColumns, filter.Column) && filter.Operator == "contains" {
+			errors = append(errors, FieldError{Field: filterField + ".operator", Message: "must be one of eq, ne, lt, lte, gt, gte"})
+		}
+		if contains(numericColumns, filter.Column) {
+			if _, err := strconv.ParseFloat(filter.Value, 64); err != nil {
+				errors = append(errors, FieldError{Field: filterField + ".value", Message: "must be a number"})
+			}
+		}
+		if filter.Column == "online" {
+			if _, err := strconv.ParseBool(filter.Value); err != nil {
+				errors = append(errors, FieldError{Field: filterField + ".value", Message: "must be true or false"})
+			}
+		}
+	}
+	for idx, key := range view.Sort {
+		if !contains(ViewSortColumns, key.Column) {
+			errors = append(errors, FieldError{Field: fmt.Sprintf("%s.sort[%d].column", field, idx), Message: fmt.Sprintf("must be one of %s", strings.Join(ViewSortColumns, ", "))})
+		}
+	}
+	if rows := view.NumberOfRows; rows != -1 && (rows < 1 || rows > MaxNumberOfRows) {
+		errors = append(errors, FieldError{Field: field + ".number_of_rows", Message: fmt.Sprintf("must be -1 or between 1 and %d", MaxNumberOfRows)})
+	}
+	for idx, column := range view.Columns {
+		if !contains(ViewColumns, column) {
+			errors = append(errors, FieldError{Field: fmt.Sprintf("%s.columns[%d]", field, idx), Message: fmt.Sprintf("must be one of %s", strings.Join(ViewColumns, ", "))})
+		}
+	}
+	return errors
+}
+
+// validateViews returns the errors of the views of every user. View names must be unique for a user and a user can
+// have a single default view
+func validateViews(views map[string][]View) []FieldError {
+	var errors []FieldError
+	for _, user := range sortedKeys(views) {
+		names := make(map[string]bool)
+		defaults := 0
+		for idx, view := range views[user] {
+			field := fmt.Sprintf("views.%s[%d]", user, idx)
+			errors = append(errors, ValidateView(view, field)...)
+			if names[view.Name] {
+				errors = append(errors, FieldError{Field: field + ".name", Message: fmt.Sprintf("view %s is listed more than once", view.Name)})
+			}
+			names[view.Name] = true
+			if view.Default {
+				defaults++
+				if defaults > 1 {
+					errors = append(errors, FieldError{Field: field + ".default", Message: "only one view can be the default view"})
+				}
+			}
+		}
+	}
+	return errors
+}
+
+// contains returns true if the value is one of the values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,6 @@
 module main
 
-go 1.20
+go 1.22
 
 require github.com/stretchr/testify v1.8.2
 
@@ -0,0 +1,465 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/data"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AllUsers is the key of the accounts seen by the users which are not listed in the accounts configuration
+const AllUsers = "*"
+
+// Account is a one step account the devices are fetched from
+type Account struct {
+	Name   string `json:"name"`
+	APIKey string `json:"api_key"`
+}
+
+// AccountsConfig is the configuration of the one step accounts of the server. Users maps a user to the names of the
+// accounts whose devices the user can see, the AllUsers key holds the accounts of the users which are not listed.
+// Every user sees all the accounts when Users is empty
+type AccountsConfig struct {
+	Accounts []Account           `json:"accounts"`
+	Users    map[string][]string `json:"users"`
+}
+
+// LoadAccounts reads the accounts configuration from the json file and validates it
+func LoadAccounts(path string) (*AccountsConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var config AccountsConfig
+	err = json.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, config.validate()
+}
+
+// validate checks that the accounts have a unique name and an api key, and that the users only list known accounts
+func (c *AccountsConfig) validate() error {
+	if len(c.Accounts) == 0 {
+		return errors.New("no accounts are configured")
+	}
+	names := make([]string, 0, len(c.Accounts))
+	for idx, account := range c.Accounts {
+		if account.Name == "" || account.APIKey == "" {
+			return fmt.Errorf("accounts[%d] must have a name and an api_key", idx)
+		}
+		if slices.Contains(names, account.Name) {
+			return fmt.Errorf("account %s is configured more than once", account.Name)
+		}
+		names = append(names, account.Name)
+	}
+	for user, accounts := range c.Users {
+		for _, account := range accounts {
+			if !slices.Contains(names, account) {
+				return fmt.Errorf("account %s of user %s is not configured", account, user)
+			}
+		}
+	}
+	return nil
+}
+
+// SetAccounts replaces the one step account of the API_KEY environment variable by the configured accounts. Every
+// account gets its own upstream client, so that an account which is down does not open the circuit breaker of the
+// others
+func (h *Handler) SetAccounts(config *AccountsConfig, client *http.Client) {
+	upstreams := make([]*UpstreamClient, 0, len(config.Accounts))
+	for _, account := range config.Accounts {
+		upstream := NewUpstreamClient(client)
+		upstream.Account = account.Name
+		upstream.URL = fmt.Sprintf(OneStepDeviceApiUrl, url.QueryEscape(account.APIKey))
+		upstreams = append(upstreams, upstream)
+	}
+	h.Upstreams = upstreams
+	h.AccountUsers = config.Users
+}
+
+// fetchAccounts fetches the devices of every account concurrently. The devices are tagged with the name of their
+// account and listed in the order of the accounts. The devices of the accounts which responded are returned along with
+// the names of the accounts which failed, and the fetch only fails when every account failed
+func (h *Handler) fetchAccounts(ctx context.Context) ([]Device, []string, error) {
+	results := make([][]Device, len(h.Upstreams))
+	errs := make([]error, len(h.Upstreams))
+	var wg sync.WaitGroup
+	for idx, upstream := range h.Upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[idx], errs[idx] = upstream.FetchDevices(ctx)
+		}()
+	}
+	wg.Wait()
+	var failed []string
+	for idx, err := range errs {
+		if err != nil {
+			failed = append(failed, h.Upstreams[idx].Account)
+		}
+	}
+	if len(failed) == len(h.Upstreams) {
+		return nil, nil, errs[0]
+	}
+	return mergeAccounts(h.Upstreams, results), failed, nil
+}
+
+// mergeAccounts tags the devices with their account and merges them. A device shared by several accounts is listed
+// once for every account, holding the data returned by that account
+func mergeAccounts(upstreams []*UpstreamClient, results [][]Device) []Device {
+	var merged []Device
+	for idx, devices := range results {
+		for _, device := range devices {
+			device.Account = upstreams[idx].Account
+			merged = append(merged, device)
+		}
+	}
+	return merged
+}
+
+// userAccounts returns the names of the accounts the user making the request can see. all is true when every user sees
+// every account
+func (h *Handler) userAccounts(r *http.Request) (accounts []string, all bool) {
+	if len(h.AccountUsers) == 0 {
+		return nil, true
+	}
+	accounts, ok := h.AccountUsers[requestUser(r)]
+	if !ok {
+		accounts = h.AccountUsers[AllUsers]
+	}
+	return accounts, false
+}
+
+// canSeeAccount returns true when the user making the request can see the account
+func (h *Handler) canSeeAccount(r *http.Request, account string) bool {
+	accounts, all := h.userAccounts(r)
+	return all || slices.Contains(accounts, account)
+}
+
+// accountDevices returns the devices of the accounts the user making the request can see. A device shared by several
+// accounts is only returned for the first of them the user can see, so that the data of an account is never returned
+// to a user who cannot see it
+func (h *Handler) accountDevices(r *http.Request, devices []Device) []Device {
+	visible := make([]Device, 0, len(devices))
+	// listed holds the account of the returned device of every id
+	listed := make(map[string]string)
+	for _, device := range devices {
+		if !h.canSeeAccount(r, device.Account) {
+			continue
+		}
+		if account, ok := listed[device.DeviceID]; ok && account != device.Account {
+			continue
+		}
+		listed[device.DeviceID] = device.Account
+		visible = append(visible, device)
+	}
+	return visible
+}
+
+// accountDevice returns the device with the id among the devices the user making the request can see
+func (h *Handler) accountDevice(r *http.Request, devices []Device, deviceId string) (Device, bool) {
+	for _, device := range h.accountDevices(r, devices) {
+		if device.DeviceID == deviceId {
+			return device, true
+		}
+	}
+	return Device{}, false
+}
+
+// FailedAccountsHeader is the header listing the accounts whose devices could not be fetched from one step
+const FailedAccountsHeader = "X-Failed-Accounts"
+
+// writeFailedAccounts lists the accounts of the snapshot which failed and the user making the request can see in the
+// FailedAccountsHeader
+func (h *Handler) writeFailedAccounts(w http.ResponseWriter, r *http.Request, snapshot deviceSnapshot) {
+	var failed []string
+	for _, account := range snapshot.failed {
+		if h.canSeeAccount(r, account) {
+			failed = append(failed, account)
+		}
+	}
+	if len(failed) > 0 {
+		w.Header().Set(FailedAccountsHeader, strings.Join(failed, ","))
+	}
+}
+
+// accountDeviceIds returns the ids of the devices of the accounts the user making the request can see, or nil when the
+// user sees every account
+func (h *Handler) accountDeviceIds(r *http.Request) (map[string]bool, error) {
+	if _, all := h.userAccounts(r); all {
+		return nil, nil
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	deviceIds := make(map[string]bool)
+	for _, device := range h.accountDevices(r, devices) {
+		deviceIds[device.DeviceID] = true
+	}
+	return deviceIds, nil
+}
+
+// accountDevicePreferences returns the device preferences of the devices in deviceIds, or all of them when deviceIds
+// is nil
+func accountDevicePreferences(devicePreferences []data.DevicePreferences, deviceIds map[string]bool) []data.DevicePreferences {
+	if deviceIds == nil {
+		return devicePreferences
+	}
+	visible := make([]data.DevicePreferences, 0, len(devicePreferences))
+	for _, devicePreference := range devicePreferences {
+		if deviceIds[devicePreference.DeviceID] {
+			visible = append(visible, devicePreference)
+		}
+	}
+	return visible
+}
+
+// accountPreferences removes the preferences of the devices which are not in deviceIds and the views of the other users
+// from the json document of the preferences. The group thresholds are kept, since the groups are shared by the devices
+// of every account. The document is returned as is when deviceIds is nil
+func accountPreferences(document []byte, user string, deviceIds map[string]bool) ([]byte, error) {
+	if deviceIds == nil || len(document) == 0 {
+		return document, nil
+	}
+	var preferences data.PreferencesImpl
+	err := json.Unmarshal(document, &preferences)
+	if err != nil {
+		return nil, err
+	}
+	preferences.DevicePreferences = accountDevicePreferences(preferences.DevicePreferences, deviceIds)
+	preferences.Views = userViews(preferences.Views, user)
+	return json.Marshal(preferences)
+}
+
+// userViews returns the views of the user alone, or nil when the user has no views
+func userViews(views map[string][]data.View, user string) map[string][]data.View {
+	if userViews, ok := views[user]; ok {
+		return map[string][]data.View{user: userViews}
+	}
+	return nil
+}
+
+// isUserViewsPath returns true when the json path of a change of the preferences is part of the views of the user.
+// The path of the views as a whole is not part of them
+func isUserViewsPath(path string, user string) bool {
+	rest, ok := strings.CutPrefix(path, "views."+user)
+	return ok && (rest == "" || strings.HasPrefix(rest, "[") || strings.HasPrefix(rest, "."))
+}
+
+// accountViewsValue removes the views of the other users from a decoded json object of the views
+func accountViewsValue(value any, user string) any {
+	views, ok := value.(map[string]any)
+	if !ok {
+		return value
+	}
+	if userViews, ok := views[user]; ok {
+		return map[string]any{user: userViews}
+	}
+	return map[string]any{}
+}
+
+// snapshotDeviceIds returns the ids of the device preferences of a snapshot of the history by their index, or nil when
+// the snapshot is missing
+func snapshotDeviceIds(snapshot []byte) []string {
+	var preferences data.PreferencesImpl
+	if len(snapshot) == 0 || json.Unmarshal(snapshot, &preferences) != nil {
+		return nil
+	}
+	deviceIds := make([]string, 0, len(preferences.DevicePreferences))
+	for _, devicePreference := range preferences.DevicePreferences {
+		deviceIds = append(deviceIds, devicePreference.DeviceID)
+	}
+	return deviceIds
+}
+
+// accountChanges removes the preferences of the devices which are not in deviceIds and the views of the other users
+// from the snapshots and the diffs of the changes, which are ordered oldest first. The diff of the device preferences
+// at an index is only kept when the devices at that index before and after the change are in deviceIds. The changes
+// are returned as they are when deviceIds is nil
+func accountChanges(changes []data.Change, user string, deviceIds map[string]bool) ([]data.Change, error) {
+	if deviceIds == nil {
+		return changes, nil
+	}
+	var before []string
+	for idx, change := range changes {
+		after := snapshotDeviceIds(change.Snapshot)
+		diff := make([]data.FieldChange, 0, len(change.Diff))
+		for _, fieldChange := range change.Diff {
+			if fieldChange.Path == "views" {
+				// The views were added or removed as a whole
+				fieldChange.Old = accountViewsValue(fieldChange.Old, user)
+				fieldChange.New = accountViewsValue(fieldChange.New, user)
+				diff = append(diff, fieldChange)
+				continue
+			}
+			if strings.HasPrefix(fieldChange.Path, "views.") {
+				if isUserViewsPath(fieldChange.Path, user) {
+					diff = append(diff, fieldChange)
+				}
+				continue
+			}
+			rest, ok := strings.CutPrefix(fieldChange.Path, "device_preferences")
+			if !ok {
+				diff = append(diff, fieldChange)
+				continue
+			}
+			if rest == "" {
+				// The device preferences were added or removed as a whole, e.g. by a document without them
+				fieldChange.Old = accountDevicePreferencesValue(fieldChange.Old, deviceIds)
+				fieldChange.New = accountDevicePreferencesValue(fieldChange.New, deviceIds)
+				diff = append(diff, fieldChange)
+				continue
+			}
+			index, _, _ := strings.Cut(strings.TrimPrefix(rest, "["), "]")
+			position, err := strconv.Atoi(index)
+			if err == nil && visibleAt(before, position, deviceIds) && visibleAt(after, position, deviceIds) {
+				diff = append(diff, fieldChange)
+			}
+		}
+		changes[idx].Diff = diff
+		snapshot, err := accountPreferences(change.Snapshot, user, deviceIds)
+		if err != nil {
+			return nil, err
+		}
+		changes[idx].Snapshot = snapshot
+		before = after
+	}
+	return changes, nil
+}
+
+// visibleAt returns true when there is no device at the position, or the device at the position is in deviceIds. The
+// devices of unknown ids are never visible
+func visibleAt(ids []string, position int, deviceIds map[string]bool) bool {
+	if ids == nil {
+		return false
+	}
+	return position < 0 || position >= len(ids) || deviceIds[ids[position]]
+}
+
+// accountDevicePreferencesValue removes the devices which are not in deviceIds from a decoded json array of device
+// preferences
+func accountDevicePreferencesValue(value any, deviceIds map[string]bool) any {
+	items, ok := value.([]any)
+	if !ok {
+		return value
+	}
+	visible := make([]any, 0, len(items))
+	for _, item := range items {
+		if object, ok := item.(map[string]any); ok && deviceIds[fmt.Sprint(object["device_id"])] {
+			visible = append(visible, item)
+		}
+	}
+	return visible
+}
+
+// canSeeDevice returns true when the device with the id belongs to an account the user making the request can see
+func (h *Handler) canSeeDevice(r *http.Request, deviceId string) (bool, error) {
+	deviceIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		return false, err
+	}
+	return deviceIds == nil || deviceIds[deviceId], nil
+}
+
+// validateAccountDocument returns a *data.ValidationError when the json document of the preferences written by the user
+// holds the preferences of devices which are not in deviceIds or the views of other users. A document which cannot be
+// decoded is left to the decode of the preferences. Every document is valid when deviceIds is nil
+func validateAccountDocument(document []byte, user string, deviceIds map[string]bool) error {
+	if deviceIds == nil {
+		return nil
+	}
+	var preferences data.PreferencesImpl
+	if json.Unmarshal(document, &preferences) != nil {
+		return nil
+	}
+	var fieldErrors []data.FieldError
+	for idx, devicePreference := range preferences.DevicePreferences {
+		if !deviceIds[devicePreference.DeviceID] {
+			// Devices of the other accounts are reported like devices which do not exist, so that they are not disclosed
+			fieldErrors = append(fieldErrors, data.FieldError{
+				Field:   fmt.Sprintf("device_preferences[%d].device_id", idx),
+				Message: fmt.Sprintf("device %s does not exist", devicePreference.DeviceID),
+			})
+		}
+	}
+	var otherUsers []string
+	for viewsUser := range preferences.Views {
+		if viewsUser != user {
+			otherUsers = append(otherUsers, viewsUser)
+		}
+	}
+	sort.Strings(otherUsers)
+	for _, otherUser := range otherUsers {
+		fieldErrors = append(fieldErrors, data.FieldError{Field: "views." + otherUser, Message: "views of other users can not be written"})
+	}
+	if len(fieldErrors) > 0 {
+		return &data.ValidationError{Errors: fieldErrors}
+	}
+	return nil
+}
+
+// mergeAccountDocument adds the stored preferences of the devices which are not in deviceIds and the stored views of the
+// other users to the json document of the preferences written by the user, so that a user who does not see every
+// account does not remove them. The preferences of those devices and the views of the other users held by the document
+// are replaced by the stored ones. The device preferences and views missing from the document are kept by data.Decode,
+// so they are only added when replace is true, for documents written with data.Replace. The document is returned as is
+// when deviceIds is nil or it cannot be decoded, so that the decode reports it
+func mergeAccountDocument(preferences data.Preferences, document []byte, user string, deviceIds map[string]bool, replace bool) ([]byte, error) {
+	if deviceIds == nil {
+		return document, nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(document, &fields) != nil || fields == nil {
+		return document, nil
+	}
+	if value, ok := fields["device_preferences"]; ok || replace {
+		var written []data.DevicePreferences
+		if ok && json.Unmarshal(value, &written) != nil {
+			return document, nil
+		}
+		devicePreferences := accountDevicePreferences(written, deviceIds)
+		for _, devicePreference := range preferences.GetDevicePreferences() {
+			if !deviceIds[devicePreference.DeviceID] {
+				devicePreferences = append(devicePreferences, devicePreference)
+			}
+		}
+		encoded, err := json.Marshal(devicePreferences)
+		if err != nil {
+			return nil, err
+		}
+		fields["device_preferences"] = encoded
+	}
+	if value, ok := fields["views"]; ok || replace {
+		var written map[string]json.RawMessage
+		if ok && json.Unmarshal(value, &written) != nil {
+			return document, nil
+		}
+		views := make(map[string]any)
+		for viewsUser, userViews := range preferences.GetViews() {
+			if viewsUser != user {
+				views[viewsUser] = userViews
+			}
+		}
+		if userViews, ok := written[user]; ok {
+			views[user] = userViews
+		}
+		encoded, err := json.Marshal(views)
+		if err != nil {
+			return nil, err
+		}
+		fields["views"] = encoded
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"errors"
+	"main/data"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deviceActivity is the time a device was last seen and last moved, along with the location it last moved to
+type deviceActivity struct {
+	lastSeen  time.Time
+	lastMoved time.Time
+	lat       float64
+	lng       float64
+}
+
+// activityTracker tracks when the devices fetched from the one step api were last seen and last moved. A device is
+// seen at the time of its latest point, and moves when its latest point is more than StationaryRadius away from the
+// location it last moved to. The online status reported by one step is not used, since devices whose latest point is
+// hours old are often reported online
+type activityTracker struct {
+	mutex   sync.RWMutex
+	devices map[string]*deviceActivity
+}
+
+// newActivityTracker creates an activity tracker without devices
+func newActivityTracker() *activityTracker {
+	return &activityTracker{devices: make(map[string]*deviceActivity)}
+}
+
+// pointTime returns the time the latest point of the device was recorded by the device, or received by one step when
+// the device did not record it. Returns a zero time when one step returned neither
+func pointTime(device Device) time.Time {
+	switch {
+	case device.LatestDevicePoint.DtTracker != nil:
+		return *device.LatestDevicePoint.DtTracker
+	case device.LatestDevicePoint.DtServer != nil:
+		return *device.LatestDevicePoint.DtServer
+	}
+	return time.Time{}
+}
+
+// record updates the activity of the devices from their latest points. The devices whose latest point has no time are
+// not tracked
+func (a *activityTracker) record(devices []Device) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, device := range devices {
+		seen := pointTime(device)
+		if seen.IsZero() {
+			continue
+		}
+		lat, lng := device.LatestDevicePoint.Lat, device.LatestDevicePoint.Lng
+		activity := a.devices[device.DeviceID]
+		if activity == nil {
+			a.devices[device.DeviceID] = &deviceActivity{lastSeen: seen, lat: lat, lng: lng}
+			continue
+		}
+		if !seen.After(activity.lastSeen) {
+			continue
+		}
+		activity.lastSeen = seen
+		if haversine(activity.lat, activity.lng, lat, lng) > StationaryRadius {
+			activity.lastMoved = seen
+			activity.lat, activity.lng = lat, lng
+		}
+	}
+}
+
+// get returns the activity of the device, ok is false when the device is not tracked
+func (a *activityTracker) get(deviceId string) (activity deviceActivity, ok bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if tracked := a.devices[deviceId]; tracked != nil {
+		return *tracked, true
+	}
+	return deviceActivity{}, false
+}
+
+// secondsSince returns the number of seconds from the time to now, or nil for a zero time
+func secondsSince(t time.Time, now time.Time) *int64 {
+	if t.IsZero() {
+		return nil
+	}
+	seconds := int64(max(now.Sub(t), 0).Seconds())
+	return &seconds
+}
+
+// annotateActivity sets the number of seconds since the devices were last seen and last moved, and marks the devices
+// last seen before the stale threshold of their groups as stale
+func (h *Handler) annotateActivity(devices []Device, preferences data.Preferences, groups map[string][]string, now time.Time) {
+	for idx := range devices {
+		activity, ok := h.activity.get(devices[idx].DeviceID)
+		if !ok {
+			continue
+		}
+		thresholds := data.DeviceThresholds(preferences, groups[devices[idx].DeviceID])
+		devices[idx].LastSeenAgo = secondsSince(activity.lastSeen, now)
+		devices[idx].LastMovedAgo = secondsSince(activity.lastMoved, now)
+		devices[idx].Stale = now.Sub(activity.lastSeen) > thresholds.Stale()
+	}
+}
+
+// filterStale returns the devices which are stale, or which are not stale when stale is false
+func filterStale(devices []Device, stale bool) []Device {
+	filtered := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		if device.Stale == stale {
+			filtered = append(filtered, device)
+		}
+	}
+	return filtered
+}
+
+// parseStale parses the stale query param. Returns nil when the request has no stale query param
+func parseStale(query url.Values) (*bool, error) {
+	if !query.Has("stale") {
+		return nil, nil
+	}
+	stale, err := strconv.ParseBool(query.Get("stale"))
+	if err != nil {
+		return nil, errors.New("Stale must be true or false")
+	}
+	return &stale, nil
+}
@@ -0,0 +1,502 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/data"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxAlerts is the number of alerts kept in memory, the oldest resolved alerts are dropped first
+const MaxAlerts = 1000
+
+// Kinds of an AlertRule
+const (
+	AlertRuleOffline  = "offline"
+	AlertRuleAltitude = "altitude_above"
+	AlertRuleGeofence = "geofence_entered"
+)
+
+// States of an Alert
+const (
+	AlertFiring       = "firing"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// errAlertNotFound is returned when there is no alert with the requested id
+var errAlertNotFound = errors.New("alert does not exist")
+
+// errAlertResolved is returned when a resolved alert is acknowledged
+var errAlertResolved = errors.New("alert is resolved")
+
+// weekdays lists the names of the days of BusinessHours, in the order of time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Geofence is the area of a geofence rule, either the circle of RadiusM meters around Lat and Lng or the polygon of
+// [lng, lat] points in the order of GeoJSON
+type Geofence struct {
+	Name    string       `json:"name"`
+	Lat     float64      `json:"lat,omitempty"`
+	Lng     float64      `json:"lng,omitempty"`
+	RadiusM float64      `json:"radius_m,omitempty"`
+	Polygon [][2]float64 `json:"polygon,omitempty"`
+}
+
+// BusinessHours are the hours from Start to End, HH:MM times in the time zone, of the days of the week. Days are the
+// first three letters of their english name and default to monday to friday. An End of 24:00 is the end of the day
+type BusinessHours struct {
+	Days     []string `json:"days,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	TimeZone string   `json:"time_zone,omitempty"`
+}
+
+// AlertRule is a condition evaluated against the devices of every new snapshot. An offline rule fires when a device
+// has been offline for more than OfflineSeconds, an altitude rule when the altitude of a device is above Altitude and
+// a geofence rule when a device enters the Geofence. When OutsideBusinessHours is set the rule only fires outside of
+// them. Groups limits the rule to the devices of the groups, and the alerts of the rule are sent to the Channels
+type AlertRule struct {
+	Name                 string         `json:"name"`
+	Kind                 string         `json:"kind"`
+	OfflineSeconds       int            `json:"offline_seconds,omitempty"`
+	Altitude             float64        `json:"altitude,omitempty"`
+	Geofence             *Geofence      `json:"geofence,omitempty"`
+	OutsideBusinessHours *BusinessHours `json:"outside_business_hours,omitempty"`
+	Groups               []string       `json:"groups,omitempty"`
+	Channels             []string       `json:"channels,omitempty"`
+}
+
+// AlertsConfig is the configuration of the alert rules of the server and of the channels their alerts are sent to
+type AlertsConfig struct {
+	Rules    []AlertRule    `json:"rules"`
+	Channels []AlertChannel `json:"channels"`
+}
+
+// Alert is raised when the condition of a rule starts to hold for a device. It fires until it is acknowledged by a
+// user, and is resolved once the condition no longer holds
+type Alert struct {
+	ID             string     `json:"id"`
+	Rule           string     `json:"rule"`
+	DeviceID       string     `json:"device_id"`
+	DisplayName    string     `json:"display_name"`
+	State          string     `json:"state"`
+	Message        string     `json:"message"`
+	FiredAt        time.Time  `json:"fired_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+}
+
+// GetAlertsResponse structure representing the data for the get api of the alerts
+type GetAlertsResponse struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+// alertKey identifies the alert of a rule for a device
+type alertKey struct {
+	rule     string
+	deviceId string
+}
+
+// alertEngine evaluates the alert rules against the fetched devices and keeps the raised alerts
+type alertEngine struct {
+	mutex    sync.Mutex
+	rules    []AlertRule
+	channels map[string]AlertChannel
+	alerts   []*Alert
+	nextId   int
+	// active holds the alerts which are not resolved, offlineSince the time of the latest point of every offline
+	// device and inside whether a device was inside the geofence of a rule in the previous snapshot
+	active       map[alertKey]*Alert
+	offlineSince map[string]time.Time
+	inside       map[alertKey]bool
+	// queue holds the notifications waiting for the workers, which are started with the first notification
+	queue   chan notification
+	workers sync.Once
+}
+
+// newAlertEngine creates an alert engine without rules
+func newAlertEngine() *alertEngine {
+	return &alertEngine{
+		channels:     make(map[string]AlertChannel),
+		active:       make(map[alertKey]*Alert),
+		offlineSince: make(map[string]time.Time),
+		inside:       make(map[alertKey]bool),
+		queue:        make(chan notification, AlertQueueSize),
+	}
+}
+
+// LoadAlerts reads the alerts configuration from the json file and validates it
+func LoadAlerts(path string) (*AlertsConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var config AlertsConfig
+	err = json.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, config.validate()
+}
+
+// validate checks that the rules have a unique name, a known kind with its settings and only use configured channels,
+// and that the channels are complete
+func (c *AlertsConfig) validate() error {
+	channels := make([]string, 0, len(c.Channels))
+	for idx, channel := range c.Channels {
+		if err := channel.validate(); err != nil {
+			return fmt.Errorf("channels[%d] %w", idx, err)
+		}
+		if slices.Contains(channels, channel.Name) {
+			return fmt.Errorf("channel %s is configured more than once", channel.Name)
+		}
+		channels = append(channels, channel.Name)
+	}
+	rules := make([]string, 0, len(c.Rules))
+	for idx, rule := range c.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rules[%d] %w", idx, err)
+		}
+		if slices.Contains(rules, rule.Name) {
+			return fmt.Errorf("rule %s is configured more than once", rule.Name)
+		}
+		rules = append(rules, rule.Name)
+		for _, channel := range rule.Channels {
+			if !slices.Contains(channels, channel) {
+				return fmt.Errorf("channel %s of rule %s is not configured", channel, rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the settings of the kind of the rule
+func (r AlertRule) validate() error {
+	if r.Name == "" {
+		return errors.New("must have a name")
+	}
+	switch r.Kind {
+	case AlertRuleOffline:
+		if r.OfflineSeconds < 0 {
+			return errors.New("offline_seconds must not be negative")
+		}
+	case AlertRuleAltitude:
+	case AlertRuleGeofence:
+		if r.Geofence == nil || (r.Geofence.RadiusM <= 0 && len(r.Geofence.Polygon) < 3) {
+			return errors.New("geofence must have a radius_m or a polygon of at least 3 points")
+		}
+	default:
+		return fmt.Errorf("kind must be one of %s, %s, %s", AlertRuleOffline, AlertRuleAltitude, AlertRuleGeofence)
+	}
+	if hours := r.OutsideBusinessHours; hours != nil {
+		if _, err := hours.location(); err != nil {
+			return fmt.Errorf("outside_business_hours time_zone %w", err)
+		}
+		start, startErr := parseClock(hours.Start)
+		end, endErr := parseClock(hours.End)
+		if startErr != nil || endErr != nil || end <= start {
+			return errors.New("outside_business_hours must have a start before the end, as HH:MM times")
+		}
+		for _, day := range hours.Days {
+			if !slices.Contains(weekdays, day) {
+				return fmt.Errorf("outside_business_hours days must be one of %s", strings.Join(weekdays, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// SetAlerts replaces the alert rules and the channels their alerts are sent to. The alerts of the previous rules are
+// kept
+func (h *Handler) SetAlerts(config *AlertsConfig) {
+	h.alerts.mutex.Lock()
+	defer h.alerts.mutex.Unlock()
+	h.alerts.rules = config.Rules
+	h.alerts.channels = make(map[string]AlertChannel, len(config.Channels))
+	for _, channel := range config.Channels {
+		h.alerts.channels[channel.Name] = channel
+	}
+}
+
+// parseClock parses a HH:MM time into the duration since midnight
+func parseClock(value string) (time.Duration, error) {
+	hours, minutes, found := strings.Cut(value, ":")
+	h, err := strconv.Atoi(hours)
+	if err != nil || !found {
+		return 0, fmt.Errorf("invalid time %s", value)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %s", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// location returns the time zone of the business hours, UTC when not set
+func (b *BusinessHours) location() (*time.Location, error) {
+	if b.TimeZone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(b.TimeZone)
+}
+
+// contains returns true when the time is within the business hours
+func (b *BusinessHours) contains(t time.Time) bool {
+	location, err := b.location()
+	if err != nil {
+		return false
+	}
+	t = t.In(location)
+	days := b.Days
+	if len(days) == 0 {
+		days = weekdays[1:6]
+	}
+	if !slices.Contains(days, weekdays[t.Weekday()]) {
+		return false
+	}
+	start, _ := parseClock(b.Start)
+	end, _ := parseClock(b.End)
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return clock >= start && clock < end
+}
+
+// contains returns true when the point is inside the geofence
+func (g *Geofence) contains(lat float64, lng float64) bool {
+	if len(g.Polygon) < 3 {
+		return haversine(g.Lat, g.Lng, lat, lng) <= g.RadiusM
+	}
+	// Casting a ray from the point along its latitude and counting the edges of the polygon it crosses
+	inside := false
+	for i, j := 0, len(g.Polygon)-1; i < len(g.Polygon); j, i = i, i+1 {
+		a, b := g.Polygon[i], g.Polygon[j]
+		if (a[1] > lat) != (b[1] > lat) && lng < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// holds returns true when the condition of the rule holds for the device
+func (r AlertRule) holds(device Device, offlineSince time.Time, now time.Time) bool {
+	switch r.Kind {
+	case AlertRuleOffline:
+		return !device.Online && !offlineSince.IsZero() && now.Sub(offlineSince) >= time.Duration(r.OfflineSeconds)*time.Second
+	case AlertRuleAltitude:
+		return device.LatestDevicePoint.Altitude > r.Altitude
+	case AlertRuleGeofence:
+		return r.Geofence.contains(device.LatestDevicePoint.Lat, device.LatestDevicePoint.Lng)
+	}
+	return false
+}
+
+// message describes why the rule fired for the device
+func (r AlertRule) message(device Device) string {
+	switch r.Kind {
+	case AlertRuleOffline:
+		return fmt.Sprintf("%s has been offline for more than %s", device.DisplayName, time.Duration(r.OfflineSeconds)*time.Second)
+	case AlertRuleAltitude:
+		return fmt.Sprintf("%s is at an altitude of %s, above %s", device.DisplayName,
+			strconv.FormatFloat(device.LatestDevicePoint.Altitude, 'f', -1, 64), strconv.FormatFloat(r.Altitude, 'f', -1, 64))
+	case AlertRuleGeofence:
+		return fmt.Sprintf("%s entered %s", device.DisplayName, r.Geofence.Name)
+	}
+	return r.Name
+}
+
+// inGroups returns true when the rule applies to a device of the groups
+func (r AlertRule) inGroups(groups []string) bool {
+	if len(r.Groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(r.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate evaluates the rules against the devices fetched at now. An alert fires when the condition of a rule starts
+// to hold for a device, for geofence rules when the device was outside of the geofence in the previous snapshot, and
+// is resolved when the condition no longer holds. The notifications of the alerts which fired or were resolved are
+// sent in the background
+func (e *alertEngine) evaluate(devices []Device, groups map[string][]string, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var changed []Alert
+	for _, device := range uniqueDevices(devices) {
+		if device.Online {
+			delete(e.offlineSince, device.DeviceID)
+		} else if _, ok := e.offlineSince[device.DeviceID]; !ok {
+			// The device went offline after its latest point, which is only unknown when the point has no time
+			offlineSince := pointTime(device)
+			if offlineSince.IsZero() {
+				offlineSince = now
+			}
+			e.offlineSince[device.DeviceID] = offlineSince
+		}
+		for _, rule := range e.rules {
+			key := alertKey{rule: rule.Name, deviceId: device.DeviceID}
+			holds := rule.inGroups(groups[device.DeviceID]) && rule.holds(device, e.offlineSince[device.DeviceID], now)
+			triggered := holds
+			if rule.Kind == AlertRuleGeofence {
+				wasInside, known := e.inside[key]
+				e.inside[key] = holds
+				triggered = holds && known && !wasInside
+			}
+			alert := e.active[key]
+			switch {
+			case alert != nil && !holds:
+				resolvedAt := now
+				alert.State = AlertResolved
+				alert.ResolvedAt = &resolvedAt
+				delete(e.active, key)
+				changed = append(changed, *alert)
+			case alert == nil && triggered && (rule.OutsideBusinessHours == nil || !rule.OutsideBusinessHours.contains(now)):
+				e.nextId++
+				alert = &Alert{ID: strconv.Itoa(e.nextId), Rule: rule.Name, DeviceID: device.DeviceID, DisplayName: device.DisplayName,
+					State: AlertFiring, Message: rule.message(device), FiredAt: now}
+				e.active[key] = alert
+				e.alerts = append(e.alerts, alert)
+				changed = append(changed, *alert)
+			}
+		}
+	}
+	e.prune()
+	for _, alert := range changed {
+		e.notify(alert)
+	}
+}
+
+// prune drops the oldest resolved alerts when more than MaxAlerts are kept
+func (e *alertEngine) prune() {
+	excess := len(e.alerts) - MaxAlerts
+	if excess <= 0 {
+		return
+	}
+	e.alerts = slices.DeleteFunc(e.alerts, func(alert *Alert) bool {
+		if excess > 0 && alert.State == AlertResolved {
+			excess--
+			return true
+		}
+		return false
+	})
+}
+
+// list returns a copy of the alerts in the state, or of all the alerts when state is empty, newest first
+func (e *alertEngine) list(state string) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	alerts := make([]Alert, 0)
+	for idx := len(e.alerts) - 1; idx >= 0; idx-- {
+		if state == "" || e.alerts[idx].State == state {
+			alerts = append(alerts, *e.alerts[idx])
+		}
+	}
+	return alerts
+}
+
+// find returns a copy of the alert with the id
+func (e *alertEngine) find(id string) (Alert, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, alert := range e.alerts {
+		if alert.ID == id {
+			return *alert, nil
+		}
+	}
+	return Alert{}, errAlertNotFound
+}
+
+// acknowledge marks the firing alert with the id as acknowledged by the user. Acknowledging an acknowledged alert
+// keeps the first acknowledgement
+func (e *alertEngine) acknowledge(id string, user string, now time.Time) (Alert, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, alert := range e.alerts {
+		if alert.ID != id {
+			continue
+		}
+		switch alert.State {
+		case AlertResolved:
+			return *alert, errAlertResolved
+		case AlertFiring:
+			alert.State = AlertAcknowledged
+			alert.AcknowledgedAt = &now
+			alert.AcknowledgedBy = user
+		}
+		return *alert, nil
+	}
+	return Alert{}, errAlertNotFound
+}
+
+// alertDevices returns the ids of the devices which are not hidden and whose alerts the user making the request can see
+func (h *Handler) alertDevices(r *http.Request) (map[string]string, error) {
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	h.Preferences.Read(func(preferences data.Preferences) {
+		devices = visibleDevices(h.accountDevices(r, devices), preferences)
+	})
+	names := make(map[string]string, len(devices))
+	for _, device := range devices {
+		names[device.DeviceID] = device.DisplayName
+	}
+	return names, nil
+}
+
+// AlertsHandler is the handler function for the get request of the alerts. Lists the alerts of the devices which are
+// not hidden, newest first, limited to a state by the state query param
+func (h *Handler) AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	state := r.URL.Query().Get("state")
+	if state != "" && state != AlertFiring && state != AlertAcknowledged && state != AlertResolved {
+		http.Error(w, fmt.Sprintf("State must be one of %s, %s, %s", AlertFiring, AlertAcknowledged, AlertResolved), http.StatusBadRequest)
+		return
+	}
+	devices, err := h.alertDevices(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	alerts := slices.DeleteFunc(h.alerts.list(state), func(alert Alert) bool {
+		_, ok := devices[alert.DeviceID]
+		return !ok
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetAlertsResponse{Alerts: alerts})
+}
+
+// AcknowledgeAlertHandler is the handler function for the post request acknowledging an alert. The alert id is read
+// from the path and the user making the request is recorded as the user who acknowledged it
+func (h *Handler) AcknowledgeAlertHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	devices, err := h.alertDevices(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	alert, err := h.alerts.find(r.PathValue("id"))
+	if _, ok := devices[alert.DeviceID]; err != nil || !ok {
+		http.Error(w, "Alert does not exist", http.StatusNotFound)
+		return
+	}
+	alert, err = h.alerts.acknowledge(alert.ID, requestUser(r), time.Now())
+	if errors.Is(err, errAlertResolved) {
+		http.Error(w, "Alert is resolved", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alert)
+}
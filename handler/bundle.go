@@ -0,0 +1,292 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/data"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundlePreferencesFile is the name of the preferences file in a preferences bundle
+const BundlePreferencesFile = "preferences.json"
+
+// MaxBundleSize is the largest preferences bundle which can be imported
+const MaxBundleSize = 32 << 20
+
+// ImportReport structure representing the result of a preferences import. UnknownDevices lists the devices of the
+// bundle which do not exist in the fleet, their preferences are not imported. Images lists the imported icons and
+// MissingImages the uploaded icons which are referenced by the bundle but not part of it
+type ImportReport struct {
+	DryRun         bool     `json:"dry_run"`
+	UnknownDevices []string `json:"unknown_devices"`
+	Images         []string `json:"images"`
+	MissingImages  []string `json:"missing_images"`
+}
+
+// memoryFile is an in memory file which can be copied with the FileSystemInterface
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (f memoryFile) Close() error {
+	return nil
+}
+
+// ExportPreferencesHandler is the handler function for the get request which exports the preferences as a zip archive.
+// The archive holds the preferences and the uploaded icons they reference, and can be imported on another server. Only
+// the preferences of the devices of the accounts the user can see are exported, along with the views of the user when
+// the user does not see every account
+func (h *Handler) ExportPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	deviceIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	var document []byte
+	var images []string
+	h.Preferences.Read(func(preferences data.Preferences) {
+		document, err = json.Marshal(preferences)
+		for _, devicePreference := range accountDevicePreferences(preferences.GetDevicePreferences(), deviceIds) {
+			if strings.HasPrefix(devicePreference.Image, "/images/") {
+				images = append(images, strings.TrimPrefix(devicePreference.Image, "/"))
+			}
+		}
+	})
+	if err == nil {
+		document, err = accountPreferences(document, requestUser(r), deviceIds)
+	}
+	if err == nil {
+		var indented bytes.Buffer
+		err = json.Indent(&indented, document, "", "  ")
+		document = indented.Bytes()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buffer := new(bytes.Buffer)
+	archive := zip.NewWriter(buffer)
+	err = addToArchive(archive, BundlePreferencesFile, bytes.NewReader(document))
+	for _, image := range images {
+		if err != nil {
+			break
+		}
+		var file *os.File
+		file, err = h.FileSystem.Open(image)
+		if os.IsNotExist(err) {
+			// The image is reported as missing when the bundle is imported
+			log.Println("Exporting preferences without missing image " + image)
+			err = nil
+			continue
+		}
+		if err == nil {
+			err = addToArchive(archive, image, file)
+			file.Close()
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="preferences-%s.zip"`, time.Now().Format("20060102-150405")))
+	w.Write(buffer.Bytes())
+}
+
+// addToArchive adds a file with the given name and content to the zip archive
+func addToArchive(archive *zip.Writer, name string, content io.Reader) error {
+	writer, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// ImportPreferencesHandler is the handler function for the post request which imports a preferences bundle created by
+// the export api. The bundle is read from a multipart file field or from the request body. The preferences of devices
+// which do not exist in the fleet or belong to the accounts the user cannot see are skipped. With the dry_run query
+// param set to true only the report is returned. Honors the If-Match header like the post request of the preferences
+func (h *Handler) ImportPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	bundle, err := readBundle(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	archive, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+	preferencesFile, ok := files[BundlePreferencesFile]
+	if !ok {
+		http.Error(w, "The bundle does not contain "+BundlePreferencesFile, http.StatusBadRequest)
+		return
+	}
+	document, err := readArchiveFile(preferencesFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imported := data.GetNewPreferences()
+	err = data.Decode(imported, document)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deviceIds := h.deviceIds(r.Context())
+	accountIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	existing := make(map[string]bool)
+	for _, deviceId := range deviceIds {
+		existing[deviceId] = true
+	}
+
+	report := ImportReport{DryRun: r.URL.Query().Get("dry_run") == "true", UnknownDevices: []string{}, Images: []string{}, MissingImages: []string{}}
+	images := make(map[string][]byte)
+	devicePreferences := make([]data.DevicePreferences, 0)
+	for _, devicePreference := range imported.GetDevicePreferences() {
+		// Every device is imported when the devices of the fleet are not known. The devices of the accounts the user
+		// cannot see are reported like the devices which do not exist
+		if deviceIds != nil && !existing[devicePreference.DeviceID] || accountIds != nil && !accountIds[devicePreference.DeviceID] {
+			report.UnknownDevices = append(report.UnknownDevices, devicePreference.DeviceID)
+			continue
+		}
+		if strings.HasPrefix(devicePreference.Image, "/images/") {
+			image := strings.TrimPrefix(devicePreference.Image, "/")
+			file, ok := files[image]
+			if !ok || path.Clean(image) != image || strings.Count(image, "/") != 1 {
+				report.MissingImages = append(report.MissingImages, image)
+				devicePreference.Image = DefaultImagePath
+			} else if _, ok := images[image]; !ok {
+				content, err := readArchiveFile(file)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				images[image] = content
+				report.Images = append(report.Images, image)
+			}
+		}
+		devicePreferences = append(devicePreferences, devicePreference)
+	}
+	imported.DevicePreferences = devicePreferences
+	sort.Strings(report.Images)
+	err = data.Validate(imported, deviceIds)
+	if err != nil {
+		writePreferencesError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !report.DryRun {
+		err = h.importPreferences(r, imported, images, accountIds)
+		if err != nil {
+			writePreferencesError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// importPreferences replaces the preferences and writes the images of a bundle to the images directory. The images
+// are staged in a temporary directory and only moved to the images directory once the preferences were replaced, so a
+// failed import, e.g. with a stale If-Match header, does not overwrite the uploaded icons. The stored preferences of the
+// devices which are not in accountIds and the views of the other users are kept, see mergeAccountDocument
+func (h *Handler) importPreferences(r *http.Request, imported *data.PreferencesImpl, images map[string][]byte, accountIds map[string]bool) error {
+	document, err := json.Marshal(imported)
+	if err != nil {
+		return err
+	}
+	var staging string
+	if len(images) > 0 {
+		err = h.FileSystem.MkdirAll("images", os.ModePerm)
+		if err == nil {
+			// The staging directory is created in the images directory, so that the images are moved on the same
+			// file system
+			staging, err = h.FileSystem.MkdirTemp("images", ".import-")
+		}
+		if err != nil {
+			return err
+		}
+		defer h.FileSystem.RemoveAll(staging)
+	}
+	for image, content := range images {
+		serverFile, err := h.FileSystem.Create(path.Join(staging, path.Base(image)))
+		if err != nil {
+			return err
+		}
+		_, err = h.FileSystem.Copy(serverFile, memoryFile{bytes.NewReader(content)})
+		serverFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	user := requestUser(r)
+	err = h.Preferences.Update(user, ifMatchVersion(r), func(preferences data.Preferences) error {
+		document, err := mergeAccountDocument(preferences, document, user, accountIds, true)
+		if err != nil {
+			return err
+		}
+		return data.Replace(preferences, document)
+	})
+	if err != nil {
+		return err
+	}
+	for image := range images {
+		err = h.FileSystem.Rename(path.Join(staging, path.Base(image)), image)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBundle reads the bundle from the file field of a multipart request, or from the body of the request
+func readBundle(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBundleSize)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	bundle, err := io.ReadAll(r.Body)
+	if err == nil && len(bundle) == 0 {
+		err = errors.New("the request does not contain a bundle")
+	}
+	return bundle, err
+}
+
+// readArchiveFile returns the content of a file of a zip archive
+func readArchiveFile(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, MaxBundleSize))
+}
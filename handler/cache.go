@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DeviceCacheTTL is the duration for which a fetched list of devices is served from the cache
+const DeviceCacheTTL = 30 * time.Second
+
+// deviceSnapshot is a list of devices fetched from the one step api
+type deviceSnapshot struct {
+	devices   []Device
+	fetchedAt time.Time
+	// hash identifies the content of the devices and changedAt is the time the content last changed, the devices
+	// fetched since then were the same
+	hash      string
+	changedAt time.Time
+	// index is the spatial index of the locations of the devices
+	index *spatialIndex
+	// failed lists the accounts whose devices could not be fetched
+	failed []string
+}
+
+// deviceCache stores the last list of devices fetched from the one step api along with the time it was fetched
+type deviceCache struct {
+	mutex     sync.Mutex
+	snapshot  deviceSnapshot
+	hash      string
+	changedAt time.Time
+}
+
+// last returns the cached snapshot. ok is false when the cache is empty or expired
+func (c *deviceCache) last() (snapshot deviceSnapshot, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.snapshot.devices == nil || time.Since(c.snapshot.fetchedAt) > DeviceCacheTTL {
+		return deviceSnapshot{}, false
+	}
+	return c.snapshot, true
+}
+
+// lastKnown returns the cached snapshot even when it expired. ok is false when the cache is empty
+func (c *deviceCache) lastKnown() (snapshot deviceSnapshot, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot, c.snapshot.devices != nil
+}
+
+// set replaces the cached devices and the accounts which failed and returns them as a snapshot
+func (c *deviceCache) set(devices []Device, failed []string, fetchedAt time.Time) deviceSnapshot {
+	encoded, _ := json.Marshal(struct {
+		Devices []Device
+		Failed  []string
+	}{devices, failed})
+	sum := sha256.Sum256(encoded)
+	hash := hex.EncodeToString(sum[:16])
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if hash != c.hash {
+		c.hash = hash
+		c.changedAt = fetchedAt
+	}
+	c.snapshot = deviceSnapshot{devices: devices, fetchedAt: fetchedAt, hash: c.hash, changedAt: c.changedAt, index: newSpatialIndex(devices), failed: failed}
+	return c.snapshot
+}
+
+// cachedSnapshot returns the cached snapshot when available, otherwise the devices are fetched from the one step api
+func (h *Handler) cachedSnapshot(ctx context.Context) (deviceSnapshot, error) {
+	if snapshot, ok := h.cache.last(); ok {
+		return snapshot, nil
+	}
+	return h.fetchSnapshot(ctx)
+}
+
+// cachedDevices returns the cached devices when available, otherwise the devices are fetched from the one step api.
+// Also returns the time the devices were fetched
+func (h *Handler) cachedDevices(ctx context.Context) ([]Device, time.Time, error) {
+	snapshot, err := h.cachedSnapshot(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return snapshot.devices, snapshot.fetchedAt, nil
+}
+
+// uniqueDevices returns the devices without the devices whose id was already listed, since the one step api can list
+// a device more than once
+func uniqueDevices(devices []Device) []Device {
+	unique := make([]Device, 0, len(devices))
+	seen := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		if !seen[device.DeviceID] {
+			seen[device.DeviceID] = true
+			unique = append(unique, device)
+		}
+	}
+	return unique
+}
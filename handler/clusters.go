@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// MaxZoom is the largest zoom level of the clusters api
+const MaxZoom = 22
+
+// MaxClusterZoom is the largest zoom level at which the devices are clustered, above it every device is returned
+const MaxClusterZoom = 16
+
+// ClusterCellPixels is the size in pixels of the cells of the grid the devices are clustered by, on 256 pixel tiles
+const ClusterCellPixels = 60
+
+// maxMercatorLat is the latitude at which the web mercator projection is cut off
+const maxMercatorLat = 85.05112878
+
+// DeviceCluster structure representing a cluster of devices located in the same cell of the grid of the zoom level.
+// Lat and Lng are the mean of the locations of the devices and BoundingBox the [min lng, min lat, max lng, max lat]
+// box holding them. The devices are counted by online and drive status
+type DeviceCluster struct {
+	ID          string         `json:"id"`
+	Lat         float64        `json:"lat"`
+	Lng         float64        `json:"lng"`
+	Count       int            `json:"count"`
+	Online      int            `json:"online"`
+	Offline     int            `json:"offline"`
+	DriveStatus map[string]int `json:"drive_status"`
+	BoundingBox []float64      `json:"bbox"`
+}
+
+// GetClustersResponse structure representing the data for the get api of the clusters of the devices. Devices holds
+// the devices which are alone in their cell, or every device above MaxClusterZoom
+type GetClustersResponse struct {
+	Zoom     int             `json:"zoom"`
+	Clusters []DeviceCluster `json:"clusters"`
+	Devices  []Device        `json:"devices"`
+}
+
+// clusterCell returns the cell of the grid of the zoom level holding the location, in web mercator pixels
+func clusterCell(lat float64, lng float64, zoom int) gridCell {
+	size := 256 * math.Exp2(float64(zoom))
+	lat = max(-maxMercatorLat, min(maxMercatorLat, lat)) * math.Pi / 180
+	x := (lng + 180) / 360 * size
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * size
+	return gridCell{x: int(math.Floor(x / ClusterCellPixels)), y: int(math.Floor(y / ClusterCellPixels))}
+}
+
+// clusterDevices groups the devices by the cells of the grid of the zoom level. The devices which are alone in their
+// cell are returned as they are. A device listed more than once is counted once
+func clusterDevices(devices []Device, zoom int) GetClustersResponse {
+	response := GetClustersResponse{Zoom: zoom, Clusters: make([]DeviceCluster, 0), Devices: make([]Device, 0)}
+	var cells []gridCell
+	members := make(map[gridCell][]Device)
+	for _, device := range uniqueDevices(devices) {
+		if zoom > MaxClusterZoom {
+			response.Devices = append(response.Devices, device)
+			continue
+		}
+		cell := clusterCell(device.LatestDevicePoint.Lat, device.LatestDevicePoint.Lng, zoom)
+		if members[cell] == nil {
+			cells = append(cells, cell)
+		}
+		members[cell] = append(members[cell], device)
+	}
+	for _, cell := range cells {
+		if len(members[cell]) == 1 {
+			response.Devices = append(response.Devices, members[cell][0])
+			continue
+		}
+		cluster := DeviceCluster{ID: fmt.Sprintf("%d/%d/%d", zoom, cell.x, cell.y), DriveStatus: make(map[string]int)}
+		for _, device := range members[cell] {
+			point := device.LatestDevicePoint
+			cluster.Count++
+			if device.Online {
+				cluster.Online++
+			} else {
+				cluster.Offline++
+			}
+			cluster.DriveStatus[point.DeviceStatus.DriveStatus]++
+			if cluster.BoundingBox == nil {
+				cluster.BoundingBox = []float64{point.Lng, point.Lat, point.Lng, point.Lat}
+			}
+			cluster.BoundingBox[0] = min(cluster.BoundingBox[0], point.Lng)
+			cluster.BoundingBox[1] = min(cluster.BoundingBox[1], point.Lat)
+			cluster.BoundingBox[2] = max(cluster.BoundingBox[2], point.Lng)
+			cluster.BoundingBox[3] = max(cluster.BoundingBox[3], point.Lat)
+			cluster.Lat += point.Lat
+			cluster.Lng += point.Lng
+		}
+		cluster.Lat /= float64(cluster.Count)
+		cluster.Lng /= float64(cluster.Count)
+		response.Clusters = append(response.Clusters, cluster)
+	}
+	// The largest clusters first, so that clients drawing a limited number of markers draw the largest ones
+	slices.SortStableFunc(response.Clusters, func(a, b DeviceCluster) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	return response
+}
+
+// ClustersHandler is the handler function for the get request of the clusters of the devices at a zoom level. The
+// devices are selected and filtered like in the devices api, by the device preferences, the view, the stale query param
+// and the spatial query params, so that the clusters hold the devices of the list regardless of its pages
+func (h *Handler) ClustersHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	queryParams := r.URL.Query()
+	zoom, err := strconv.Atoi(queryParams.Get("zoom"))
+	if err != nil || zoom < 0 || zoom > MaxZoom {
+		http.Error(w, fmt.Sprintf("Zoom must be between 0 and %d", MaxZoom), http.StatusBadRequest)
+		return
+	}
+	stale, err := parseStale(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spatial, err := parseSpatialQuery(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, err := h.cachedSnapshot(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	h.writeFailedAccounts(w, r, snapshot)
+	selection, err := h.selectDevices(r, snapshot.devices)
+	if err != nil {
+		http.Error(w, "View does not exist", http.StatusNotFound)
+		return
+	}
+	if stale != nil {
+		selection.devices = filterStale(selection.devices, *stale)
+	}
+	if spatial != nil {
+		selection.devices, _ = spatial.apply(snapshot.index, selection.devices, selection.keys)
+	}
+	serveJSON(w, r, clusterDevices(selection.devices, zoom), latest(snapshot.fetchedAt, selection.modified))
+}
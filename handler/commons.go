@@ -1,11 +1,19 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"main/data"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 // OneStepDeviceApiUrl Constant to store the API url
@@ -14,7 +22,8 @@ const OneStepDeviceApiUrl = "https://track.onestepgps.com/v3/api/public/device?l
 // DefaultImagePath The url for the default image
 const DefaultImagePath = "https://cdn4.iconfinder.com/data/icons/BRILLIANT/transportation/png/400/muscle_car.png"
 
-// Device Structure that holds the required fields for a device
+// Device Structure that holds the required fields for a device. The fields of the latest point which are not returned
+// for every device are pointers, so that a missing value is not mistaken for 0
 type Device struct {
 	DeviceID          string `json:"device_id"`
 	DisplayName       string `json:"display_name"`
@@ -22,13 +31,40 @@ type Device struct {
 	Online            bool   `json:"online"`
 	Image             string `json:"image"`
 	LatestDevicePoint struct {
-		Lat          float64 `json:"lat"`
-		Lng          float64 `json:"lng"`
-		Altitude     float64 `json:"altitude"`
+		Lat      float64 `json:"lat"`
+		Lng      float64 `json:"lng"`
+		Altitude float64 `json:"altitude"`
+		// Speed is the speed of the device in km/h and Angle its heading in degrees clockwise from north
+		Speed *float64 `json:"speed,omitempty"`
+		Angle *float64 `json:"angle,omitempty"`
+		// Odometer is the distance travelled by the device in km
+		Odometer       *float64 `json:"odometer,omitempty"`
+		BatteryVoltage *float64 `json:"battery_voltage,omitempty"`
+		// FuelLevel is the fuel level of the device in percent
+		FuelLevel *float64 `json:"fuel_level,omitempty"`
+		// DtTracker is the time the point was recorded by the device and DtServer the time it was received by one step
+		DtTracker    *time.Time `json:"dt_tracker,omitempty"`
+		DtServer     *time.Time `json:"dt_server,omitempty"`
 		DeviceStatus struct {
 			DriveStatus string `json:"drive_status"`
 		} `json:"device_state"`
 	} `json:"latest_accurate_device_point"`
+	// Account is the name of the one step account the device was fetched from, empty for the account of the API_KEY
+	// environment variable
+	Account string `json:"account,omitempty"`
+	// IdleDuration is the number of seconds the device has been idling at its location, set once the idle threshold of
+	// its groups is exceeded
+	IdleDuration *int64 `json:"idle_s,omitempty"`
+	// LastSeenAgo is the number of seconds since the time of the latest point of the device and LastMovedAgo since the
+	// device last moved. Stale is set when the latest point is older than the stale threshold of the groups of the device
+	Stale        bool   `json:"stale,omitempty"`
+	LastSeenAgo  *int64 `json:"last_seen_ago,omitempty"`
+	LastMovedAgo *int64 `json:"last_moved_ago,omitempty"`
+	// Distance is the distance in meters from the device to the point of a spatial query of the devices api
+	Distance *float64 `json:"distance,omitempty"`
+	// Address is the place nearest to the latest point of the device, set when the handler has a geocoder and a place is
+	// within MaxAddressDistance of the point
+	Address *Address `json:"address,omitempty"`
 }
 
 // ApiResponse Structure to hold the deserialized one step api response. Stores a list of Devices
@@ -41,14 +77,47 @@ type Response struct {
 	Message string `json:"message"`
 }
 
+// UserHeader is the request header which identifies the user making the request
+const UserHeader = "X-User"
+
+// AnonymousUser is the user of requests without the UserHeader
+const AnonymousUser = "anonymous"
+
+// GetHistoryResponse structure representing the data for the get api of the preferences history
+type GetHistoryResponse struct {
+	Changes []data.Change `json:"changes"`
+}
+
+// ValidationErrorResponse Structure of the response returned when a request is invalid. Errors lists the invalid fields
+type ValidationErrorResponse struct {
+	Message string            `json:"message"`
+	Errors  []data.FieldError `json:"errors"`
+}
+
 // Handler Structure which stores information required for api handler.
-// Preferences is the preferences object
-// httpClient is the client for making http request
+// Preferences is the store guarding the preferences object
+// Upstreams are the clients fetching the devices of every one step account
+// AccountUsers maps a user to the accounts the user can see, every user sees all the accounts when empty
 // FileSystem is a wrapper for the os file system
+// cache stores the devices last fetched from the one step api
+// positions records the positions of the devices fetched from the one step api
+// trips segments the recorded positions into trips
+// recording is held while the positions of a snapshot are recorded and added to the trips, so that the trips receive
+// the positions of concurrent fetches in the order they were recorded
+// alerts evaluates the alert rules against the fetched devices
+// activity tracks when the fetched devices were last seen and last moved
 type Handler struct {
-	Preferences data.Preferences
-	httpClient  *http.Client
-	FileSystem  FileSystemInterface
+	Preferences  *data.PreferencesStore
+	Upstreams    []*UpstreamClient
+	AccountUsers map[string][]string
+	FileSystem   FileSystemInterface
+	cache        *deviceCache
+	positions    *positionHistory
+	trips        *tripRecorder
+	recording    sync.Mutex
+	alerts       *alertEngine
+	activity     *activityTracker
+	geocoder     *geocoder
 }
 
 // FileSystemInterface which has methods for file operations
@@ -59,6 +128,14 @@ type FileSystemInterface interface {
 	Create(name string) (*os.File, error)
 	// Copy copies the src file to the destination file
 	Copy(dst *os.File, src multipart.File) (written int64, err error)
+	// Open opens the file with the given name for reading
+	Open(name string) (*os.File, error)
+	// MkdirTemp creates a new directory with a unique name starting with pattern in dir
+	MkdirTemp(dir string, pattern string) (string, error)
+	// Rename moves the file to the new path
+	Rename(oldPath string, newPath string) error
+	// RemoveAll removes the path and everything it contains
+	RemoveAll(path string) error
 }
 
 // FileSystem Implements the FileSystemInterface
@@ -77,9 +154,133 @@ func (r *FileSystem) Copy(dst *os.File, src multipart.File) (written int64, err
 	return io.Copy(dst, src)
 }
 
+func (r *FileSystem) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (r *FileSystem) MkdirTemp(dir string, pattern string) (string, error) {
+	return os.MkdirTemp(dir, pattern)
+}
+
+func (r *FileSystem) Rename(oldPath string, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (r *FileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
 // NewHandler Function to create a new api handler. accepts a Preferences p, http.Client client and a FileSystemInterface
 func NewHandler(p data.Preferences, client *http.Client, fileSystem FileSystemInterface) *Handler {
-	return &Handler{Preferences: p, httpClient: client, FileSystem: fileSystem}
+	return &Handler{Preferences: data.NewPreferencesStore(p, data.NewMemoryHistory()), Upstreams: []*UpstreamClient{NewUpstreamClient(client)}, FileSystem: fileSystem, cache: &deviceCache{}, positions: newPositionHistory(), trips: newTripRecorder(), alerts: newAlertEngine(), activity: newActivityTracker()}
+}
+
+// fetchSnapshot fetches the list of devices of every account from the one step api, stores them in the cache, records
+// their positions, trips and activity and evaluates the alert rules against them. Returns the devices as a snapshot
+func (h *Handler) fetchSnapshot(ctx context.Context) (deviceSnapshot, error) {
+	devices, failed, err := h.fetchAccounts(ctx)
+	if err != nil {
+		return deviceSnapshot{}, err
+	}
+	fetchedAt := time.Now()
+	snapshot := h.cache.set(devices, failed, fetchedAt)
+	h.recording.Lock()
+	h.trips.record(h.positions.record(devices, fetchedAt))
+	h.recording.Unlock()
+	h.activity.record(devices)
+	var groups map[string][]string
+	h.Preferences.Read(func(preferences data.Preferences) {
+		groups = deviceGroups(preferences)
+	})
+	h.alerts.evaluate(devices, groups, fetchedAt)
+	return snapshot, nil
+}
+
+// findDevicePreferences returns the stored preferences of the device with the given id, or nil if there are none
+func findDevicePreferences(preferences data.Preferences, deviceId string) *data.DevicePreferences {
+	devicePreferences := preferences.GetDevicePreferences()
+	for idx := range devicePreferences {
+		if devicePreferences[idx].DeviceID == deviceId {
+			return &devicePreferences[idx]
+		}
+	}
+	return nil
+}
+
+// serveJSON encodes the value to json and writes it to the response. An ETag computed from the encoded value is set so
+// that conditional requests are answered with 304 when the value has not changed since lastModified
+func serveJSON(w http.ResponseWriter, r *http.Request, value any, lastModified time.Time) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(body))
+}
+
+// checkNotModified sets the ETag and Last-Modified headers of the response and answers conditional requests with 304
+// when the client already holds the current representation. If-Modified-Since is only checked when the request has no
+// If-None-Match header. Returns true when the 304 has been written
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches returns true when the If-None-Match header lists the etag. The etags are compared weakly
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// devicePreferences returns a copy of the stored preferences of the device, or the default preferences when there are
+// none
+func (h *Handler) devicePreferences(device Device) data.DevicePreferences {
+	devicePreferences := data.DevicePreferences{
+		DeviceID:    device.DeviceID,
+		DisplayName: device.DisplayName,
+		Image:       DefaultImagePath,
+	}
+	h.Preferences.Read(func(preferences data.Preferences) {
+		if devicePreference := findDevicePreferences(preferences, device.DeviceID); devicePreference != nil {
+			devicePreferences = *devicePreference
+			devicePreferences.Groups = append([]string(nil), devicePreference.Groups...)
+			devicePreferences.Tags = append([]string(nil), devicePreference.Tags...)
+		}
+	})
+	return devicePreferences
+}
+
+// requestUser returns the user making the request
+func requestUser(r *http.Request) string {
+	if user := strings.TrimSpace(r.Header.Get(UserHeader)); user != "" {
+		return user
+	}
+	return AnonymousUser
 }
 
 // enableCors Method to enable cors for a request
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// compressedContentTypes lists the media types of the responses which are compressed
+var compressedContentTypes = []string{"application/json", GeoJSONContentType}
+
+// contentEncoders lists the content codings the responses can be compressed with, in the order of preference of the
+// server. A coding such as br is negotiated by adding its encoder here
+var contentEncoders = []struct {
+	name    string
+	encoder func(w io.Writer) io.WriteCloser
+}{
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+// negotiateEncoding returns the content coding accepted by the Accept-Encoding header with the highest quality, or an
+// empty string when the response is not compressed. Codings with the same quality are chosen in the order of
+// contentEncoders
+func negotiateEncoding(header string) string {
+	qualities := make(map[string]float64)
+	for _, coding := range strings.Split(header, ",") {
+		name, parameters, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(parameters), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		qualities[name] = quality
+	}
+	best, bestQuality := "", 0.0
+	for _, contentEncoder := range contentEncoders {
+		quality, ok := qualities[contentEncoder.name]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = contentEncoder.name, quality
+		}
+	}
+	return best
+}
+
+// weakenETag makes the ETag of the response weak, since a compressed body is not byte for byte the same as the
+// uncompressed body sent with the same ETag
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressWriter compresses the body of successful responses with a compressed media type. The decision is taken
+// when the status is written, since the handler sets the media type before. A 304 response has no media type, so it
+// is treated like the response of the route the client holds
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	compressible bool
+	encoder      io.WriteCloser
+	decided      bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.decided {
+		c.decided = true
+		header := c.Header()
+		mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		switch {
+		case slices.Contains(compressedContentTypes, mediaType):
+			header.Add("Vary", "Accept-Encoding")
+			if status == http.StatusOK && c.encoding != "" && header.Get("Content-Encoding") == "" {
+				header.Set("Content-Encoding", c.encoding)
+				header.Del("Content-Length")
+				weakenETag(header)
+				for _, contentEncoder := range contentEncoders {
+					if contentEncoder.name == c.encoding {
+						c.encoder = contentEncoder.encoder(c.ResponseWriter)
+					}
+				}
+			}
+		case status == http.StatusNotModified && c.compressible:
+			header.Add("Vary", "Accept-Encoding")
+			if c.encoding != "" {
+				weakenETag(header)
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.encoder != nil {
+		return c.encoder.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush writes the compressed data buffered so far to the client
+func (c *compressWriter) Flush() {
+	if flusher, ok := c.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped response writer, which is used by http.ResponseController
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close writes the end of the compressed body
+func (c *compressWriter) close() error {
+	if c.encoder == nil {
+		return nil
+	}
+	return c.encoder.Close()
+}
+
+// compress wraps the handler so that json responses are compressed with the content coding negotiated from the
+// Accept-Encoding header of the request. compressible is true when the route responds with a compressed media type.
+// The ETag of a compressed response is weak, so that it differs from the ETag of the uncompressed response while
+// If-None-Match still matches both
+func compress(next http.HandlerFunc, compressible bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if r.Method == http.MethodHead {
+			encoding = ""
+		}
+		writer := &compressWriter{ResponseWriter: w, encoding: encoding, compressible: compressible}
+		defer writer.close()
+		next(writer, r)
+	}
+}
@@ -1,21 +1,24 @@
 package handler
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"main/data"
-	"math"
 	"net/http"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// SortDevice structure used for sorting devices
+// SortDevice structure used for sorting devices. The devices are sorted by the first key, devices which are equal are
+// sorted by the next key
 type SortDevice struct {
-	devices     []Device
-	preferences data.Preferences
+	devices []Device
+	keys    []data.SortKey
 }
 
 // GetDevicesResponse structure representing the data for the devices get api
@@ -24,6 +27,20 @@ type GetDevicesResponse struct {
 	PageNumber   int      `json:"page_number"`
 	NextPage     bool     `json:"next_page"`
 	PreviousPage bool     `json:"previous_page"`
+	// TotalCount is the number of devices in all the pages and TotalPages the number of pages
+	TotalCount int `json:"total_count"`
+	TotalPages int `json:"total_pages"`
+	// NextCursor and PreviousCursor are the opaque cursors of the next and the previous page
+	NextCursor     string   `json:"next_cursor,omitempty"`
+	PreviousCursor string   `json:"previous_cursor,omitempty"`
+	View           string   `json:"view,omitempty"`
+	Columns        []string `json:"columns,omitempty"`
+}
+
+// GetDeviceResponse structure representing the data for the get api of a single device
+type GetDeviceResponse struct {
+	Device      Device                 `json:"device"`
+	Preferences data.DevicePreferences `json:"preferences"`
 }
 
 // Len returns the size of the devices array in SortDevice
@@ -36,165 +53,498 @@ func (sortDevice SortDevice) Swap(i, j int) {
 	sortDevice.devices[i], sortDevice.devices[j] = sortDevice.devices[j], sortDevice.devices[i]
 }
 
-// Less returns true if device at position i is lesser than device at position j based on sort column. returns false otherwise
+// Less returns true if device at position i is lesser than device at position j based on the sort keys. returns false otherwise
 func (sortDevice SortDevice) Less(i, j int) bool {
-	preferences := sortDevice.preferences
-	devices := sortDevice.devices
-	switch preferences.GetSortColumn() {
-	case "device_id":
-		if preferences.IsAscending() {
-			return strings.Compare(devices[i].DeviceID, devices[j].DeviceID) < 0
-		} else {
-			return strings.Compare(devices[i].DeviceID, devices[j].DeviceID) > 0
+	return compareDevicesBy(sortDevice.keys, sortDevice.devices[i], sortDevice.devices[j]) < 0
+}
+
+// compareDevicesBy compares two devices by the sort keys. Returns a negative number if device a is sorted before
+// device b, a positive number if it is sorted after and 0 if they are equal in all the keys
+func compareDevicesBy(keys []data.SortKey, a Device, b Device) int {
+	for _, key := range keys {
+		comparison := compareDevices(key.Column, a, b)
+		if comparison != 0 {
+			if key.Ascending {
+				return comparison
+			}
+			return -comparison
 		}
+	}
+	return 0
+}
+
+// compareDevices compares the column of two devices. Returns a negative number if the column of device a is lesser
+// than the column of device b, a positive number if it is greater and 0 if they are equal or the column is unknown
+func compareDevices(column string, a Device, b Device) int {
+	switch column {
+	case "device_id":
+		return strings.Compare(a.DeviceID, b.DeviceID)
 	case "display_name":
-		if preferences.IsAscending() {
-			return strings.Compare(strings.ToLower(devices[i].DisplayName), strings.ToLower(devices[j].DisplayName)) < 0
-		} else {
-			return strings.Compare(strings.ToLower(devices[i].DisplayName), strings.ToLower(devices[j].DisplayName)) > 0
-		}
+		return strings.Compare(strings.ToLower(a.DisplayName), strings.ToLower(b.DisplayName))
 	case "active_state":
-		if preferences.IsAscending() {
-			return strings.Compare(devices[i].ActiveState, devices[j].ActiveState) < 0
-		} else {
-			return strings.Compare(devices[i].ActiveState, devices[j].ActiveState) > 0
-		}
+		return strings.Compare(a.ActiveState, b.ActiveState)
 	case "online":
-		if !preferences.IsAscending() {
-			return devices[i].Online && !devices[j].Online
-		} else {
-			return devices[j].Online && !devices[i].Online
-		}
+		return compareBool(a.Online, b.Online)
 	case "lat":
-		if preferences.IsAscending() {
-			return devices[i].LatestDevicePoint.Lat < devices[j].LatestDevicePoint.Lat
-		} else {
-			return devices[i].LatestDevicePoint.Lat > devices[j].LatestDevicePoint.Lat
-		}
+		return cmp.Compare(a.LatestDevicePoint.Lat, b.LatestDevicePoint.Lat)
 	case "lng":
-		if preferences.IsAscending() {
-			return devices[i].LatestDevicePoint.Lng < devices[j].LatestDevicePoint.Lng
-		} else {
-			return devices[i].LatestDevicePoint.Lng > devices[j].LatestDevicePoint.Lng
-		}
+		return cmp.Compare(a.LatestDevicePoint.Lng, b.LatestDevicePoint.Lng)
 	case "altitude":
-		if preferences.IsAscending() {
-			return devices[i].LatestDevicePoint.Altitude < devices[j].LatestDevicePoint.Altitude
-		} else {
-			return devices[i].LatestDevicePoint.Altitude > devices[j].LatestDevicePoint.Altitude
+		return cmp.Compare(a.LatestDevicePoint.Altitude, b.LatestDevicePoint.Altitude)
+	case "drive_status":
+		return strings.Compare(a.LatestDevicePoint.DeviceStatus.DriveStatus, b.LatestDevicePoint.DeviceStatus.DriveStatus)
+	case "distance":
+		return compareOptionalFloat(a.Distance, b.Distance)
+	}
+	return 0
+}
+
+// compareOptionalFloat compares two optional numbers, a missing number is greater than any number
+func compareOptionalFloat(a *float64, b *float64) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return cmp.Compare(*a, *b)
+}
+
+// deviceColumn returns the value of the column of the device formatted as text, or an empty string when the device
+// has no value
+func deviceColumn(device Device, column string) string {
+	switch column {
+	case "device_id":
+		return device.DeviceID
+	case "display_name":
+		return device.DisplayName
+	case "active_state":
+		return device.ActiveState
+	case "online":
+		return strconv.FormatBool(device.Online)
+	case "lat":
+		return strconv.FormatFloat(device.LatestDevicePoint.Lat, 'g', -1, 64)
+	case "lng":
+		return strconv.FormatFloat(device.LatestDevicePoint.Lng, 'g', -1, 64)
+	case "altitude":
+		return strconv.FormatFloat(device.LatestDevicePoint.Altitude, 'g', -1, 64)
+	case "drive_status":
+		return device.LatestDevicePoint.DeviceStatus.DriveStatus
+	case "image":
+		return device.Image
+	case "speed":
+		return formatOptionalFloat(device.LatestDevicePoint.Speed)
+	case "angle":
+		return formatOptionalFloat(device.LatestDevicePoint.Angle)
+	case "odometer":
+		return formatOptionalFloat(device.LatestDevicePoint.Odometer)
+	case "battery_voltage":
+		return formatOptionalFloat(device.LatestDevicePoint.BatteryVoltage)
+	case "fuel_level":
+		return formatOptionalFloat(device.LatestDevicePoint.FuelLevel)
+	case "dt_tracker":
+		return formatOptionalTime(device.LatestDevicePoint.DtTracker)
+	case "dt_server":
+		return formatOptionalTime(device.LatestDevicePoint.DtServer)
+	case "account":
+		return device.Account
+	case "idle_s":
+		return formatOptionalInt(device.IdleDuration)
+	case "stale":
+		return strconv.FormatBool(device.Stale)
+	case "last_seen_ago":
+		return formatOptionalInt(device.LastSeenAgo)
+	case "last_moved_ago":
+		return formatOptionalInt(device.LastMovedAgo)
+	case "distance":
+		return formatOptionalFloat(device.Distance)
+	case "address":
+		if device.Address != nil {
+			return device.Address.String()
 		}
+	}
+	return ""
+}
+
+// formatOptionalFloat formats the number as text, or returns an empty string when there is no number
+func formatOptionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
+
+// formatOptionalInt formats the number as text, or returns an empty string when there is no number
+func formatOptionalInt(value *int64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*value, 10)
+}
+
+// formatOptionalTime formats the time as RFC 3339 text, or returns an empty string when there is no time
+func formatOptionalTime(value *time.Time) string {
+	if value == nil {
+		return ""
+	}
+	return value.Format(time.RFC3339)
+}
+
+// setDeviceColumn parses the text value and stores it in the column of the device. It is the inverse of deviceColumn
+// for the sort columns
+func setDeviceColumn(device *Device, column string, value string) error {
+	var err error
+	switch column {
+	case "device_id":
+		device.DeviceID = value
+	case "display_name":
+		device.DisplayName = value
+	case "active_state":
+		device.ActiveState = value
+	case "online":
+		device.Online, err = strconv.ParseBool(value)
+	case "lat":
+		device.LatestDevicePoint.Lat, err = strconv.ParseFloat(value, 64)
+	case "lng":
+		device.LatestDevicePoint.Lng, err = strconv.ParseFloat(value, 64)
+	case "altitude":
+		device.LatestDevicePoint.Altitude, err = strconv.ParseFloat(value, 64)
 	case "drive_status":
-		if preferences.IsAscending() {
-			return strings.Compare(devices[i].LatestDevicePoint.DeviceStatus.DriveStatus, devices[j].LatestDevicePoint.DeviceStatus.DriveStatus) < 0
-		} else {
-			return strings.Compare(devices[i].LatestDevicePoint.DeviceStatus.DriveStatus, devices[j].LatestDevicePoint.DeviceStatus.DriveStatus) > 0
+		device.LatestDevicePoint.DeviceStatus.DriveStatus = value
+	case "distance":
+		device.Distance = nil
+		if value != "" {
+			var distance float64
+			distance, err = strconv.ParseFloat(value, 64)
+			device.Distance = &distance
 		}
+	default:
+		err = fmt.Errorf("unknown column %s", column)
 	}
-	return false
+	return err
 }
 
-// sortDevices helper method for sorting the devices based on user preferences
-func sortDevices(devices []Device, preferences data.Preferences) []Device {
+// compareBool compares two booleans, false is lesser than true
+func compareBool(a bool, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// preferencesSortKeys returns the sort keys of the user preferences
+func preferencesSortKeys(preferences data.Preferences) []data.SortKey {
+	return []data.SortKey{{Column: preferences.GetSortColumn(), Ascending: preferences.IsAscending()}}
+}
+
+// orderKeys returns the sort keys followed by the device id, so that devices which are equal in all the sort keys are
+// always sorted in the same order and every device has a unique position which a cursor can point to
+func orderKeys(keys []data.SortKey) []data.SortKey {
+	for _, key := range keys {
+		if key.Column == "device_id" {
+			return keys
+		}
+	}
+	return append(append([]data.SortKey{}, keys...), data.SortKey{Column: "device_id", Ascending: true})
+}
+
+// sortDevicesBy helper method for sorting the devices by the sort keys
+func sortDevicesBy(devices []Device, keys []data.SortKey) []Device {
 	sortDevice := SortDevice{
-		devices:     devices,
-		preferences: preferences,
+		devices: devices,
+		keys:    orderKeys(keys),
 	}
 	sort.Sort(sortDevice)
 	return sortDevice.devices
 }
 
+// visibleDevices helper method which applies the individual device preferences to the devices and returns only the
+// devices which are not hidden
+func visibleDevices(devices []Device, preferences data.Preferences) []Device {
+	if preferences.GetDevicePreferences() == nil {
+		// Copying the devices since they are shared with the cache and are sorted by the caller
+		return append([]Device(nil), devices...)
+	}
+	visible := make([]Device, 0)
+	for _, device := range devices {
+		matched := false
+		for _, devicePreference := range preferences.GetDevicePreferences() {
+			if device.DeviceID == devicePreference.DeviceID {
+				matched = true
+				device.Image = devicePreference.Image
+				if !devicePreference.Hidden {
+					visible = append(visible, device)
+				}
+			}
+		}
+		if !matched {
+			device.Image = DefaultImagePath
+			visible = append(visible, device)
+		}
+	}
+	return visible
+}
+
+// deviceSelection holds the devices selected for a request by the preferences or by the view of the user
+type deviceSelection struct {
+	// devices are the visible devices matching the filters of the view, sorted by keys
+	devices      []Device
+	keys         []data.SortKey
+	numberOfRows int
+	view         *data.View
+	// groups holds the groups of every device which has groups
+	groups map[string][]string
+	// version is the version of the preferences used to select the devices and modified the time they were changed
+	version  int
+	modified time.Time
+}
+
+// selectDevices applies the device preferences and the view selected by the view query param, or the default view of
+// the user, to the devices. Returns errViewNotFound when the requested view does not exist
+func (h *Handler) selectDevices(r *http.Request, devices []Device) (deviceSelection, error) {
+	var selection deviceSelection
+	viewName := r.URL.Query().Get("view")
+	selection.modified = h.Preferences.Modified()
+	h.Preferences.Read(func(preferences data.Preferences) {
+		selection.version = preferences.GetVersion()
+		// Selecting the requested view, or the default view of the user when no view is requested
+		if viewName != "" {
+			selection.view = data.FindView(preferences, requestUser(r), viewName)
+		} else {
+			selection.view = data.DefaultView(preferences, requestUser(r))
+		}
+		// Appending the individual device preferences to the response
+		selection.devices = visibleDevices(h.accountDevices(r, devices), preferences)
+		selection.groups = deviceGroups(preferences)
+		now := time.Now()
+		h.annotateIdle(selection.devices, preferences, selection.groups, now)
+		h.annotateActivity(selection.devices, preferences, selection.groups, now)
+		h.geocoder.annotateAddresses(selection.devices)
+		selection.numberOfRows = preferences.GetNumberOfRows()
+		selection.keys = preferencesSortKeys(preferences)
+		if selection.view == nil {
+			return
+		}
+		// Copying the view since the preferences may change once the lock is released
+		view := *selection.view
+		selection.view = &view
+		selection.devices = filterDevices(selection.devices, view.Filters, selection.groups)
+		if len(view.Sort) > 0 {
+			selection.keys = view.Sort
+		}
+		selection.numberOfRows = view.NumberOfRows
+	})
+	if viewName != "" && selection.view == nil {
+		return selection, errViewNotFound
+	}
+	// Sorting the devices based on the user preferences or the view
+	selection.keys = orderKeys(selection.keys)
+	selection.devices = sortDevicesBy(selection.devices, selection.keys)
+	return selection, nil
+}
+
+// devicesETag returns the weak ETag of the response of the devices api for the snapshot of the devices, the version
+// of the preferences, the user making the request, the negotiated format and the query of the request. The state of
+// the selected devices derived from their recorded positions is part of the ETag as well, since it changes over time
+func devicesETag(snapshot deviceSnapshot, version int, user string, format string, query string, devices []Device) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%d\n%s\n%s\n%s\n", snapshot.hash, version, user, format, query)
+	for _, device := range devices {
+		fmt.Fprintf(hash, "%s:%s:%s:%s:%s\n", device.DeviceID, deviceColumn(device, "idle_s"), deviceColumn(device, "stale"),
+			deviceColumn(device, "last_seen_ago"), deviceColumn(device, "last_moved_ago"))
+	}
+	return `W/"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// latest returns the latest of the times
+func latest(times ...time.Time) time.Time {
+	var result time.Time
+	for _, t := range times {
+		if t.After(result) {
+			result = t
+		}
+	}
+	return result
+}
+
 // DevicesHandler handler method for the get request for the devices api. Accepts a request and response object.
+// The view query param selects a saved view of the user which filters, sorts and paginates the devices, otherwise the
+// default view of the user or the preferences are used. The devices are paginated either by the page query param or
+// by the opaque cursor returned in the previous response, page_size overrides the number of rows of a page. The fields
+// query param limits the devices to the listed fields and the stale query param to the devices which are stale or not
+// stale. The bbox, near and nearest query params limit the devices to an area and return their distance to the point
+// of the query. The devices are also returned as GeoJSON, KML or GPX selected by
+// the format query param or the Accept header. Requests holding the ETag of the current response are answered with 304
 func (h *Handler) DevicesHandler(w http.ResponseWriter, r *http.Request) {
-	preferences := h.Preferences
 	enableCors(w)
-	if r.Method == http.MethodGet {
-		// Constructing the api url by appending the api key
-		apiUrl := fmt.Sprintf(OneStepDeviceApiUrl, os.Getenv("API_KEY"))
-		res, err := h.httpClient.Get(apiUrl)
+	snapshot, err := h.fetchSnapshot(r.Context())
 
-		// Checking if the api call had an error, and if it has sending the error in response
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Checking if the api call had an error, and if it has sending the error in response
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+
+	h.writeFailedAccounts(w, r, snapshot)
+
+	// Extracting the page number query param from the url
+	queryParams := r.URL.Query()
+	page, err := strconv.Atoi(queryParams.Get("page"))
+
+	if err != nil {
+		page = 1
+	}
+	if page == 0 {
+		http.Error(w, "Page does not exist", http.StatusBadRequest)
+		return
+	}
+	pageSize := 0
+	if queryParams.Has("page_size") {
+		pageSize, err = strconv.Atoi(queryParams.Get("page_size"))
+		if err != nil || (pageSize != -1 && (pageSize < 1 || pageSize > data.MaxNumberOfRows)) {
+			http.Error(w, fmt.Sprintf("Page size must be -1 or between 1 and %d", data.MaxNumberOfRows), http.StatusBadRequest)
 			return
 		}
+	}
+	fields, err := parseFields(queryParams.Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stale, err := parseStale(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spatial, err := parseSpatialQuery(queryParams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	format, ok := deviceFormat(r)
+	if !ok {
+		http.Error(w, "Format must be one of json, geojson, kml, gpx", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 
-		// Extracting the page number query param from the url
-		queryParams := r.URL.Query()
-		page, err := strconv.Atoi(queryParams.Get("page"))
+	selection, err := h.selectDevices(r, snapshot.devices)
+	if err != nil {
+		http.Error(w, "View does not exist", http.StatusNotFound)
+		return
+	}
+	if stale != nil {
+		selection.devices = filterStale(selection.devices, *stale)
+	}
+	if spatial != nil {
+		selection.devices, selection.keys = spatial.apply(snapshot.index, selection.devices, selection.keys)
+	}
+	// The response only changes with the devices, the preferences and the request, so a client holding the response
+	// of the same request for the same devices and preferences already holds the current response
+	etag := devicesETag(snapshot, selection.version, requestUser(r), format, r.URL.RawQuery, selection.devices)
+	if checkNotModified(w, r, etag, latest(snapshot.changedAt, selection.modified)) {
+		return
+	}
+	visible, keys, view := selection.devices, selection.keys, selection.view
+	if !queryParams.Has("fields") {
+		fields = viewFields(view)
+	}
+	// The geographic formats hold all the devices since they are loaded as a whole by the gis tools
+	switch format {
+	case "geojson":
+		writeGeoJSON(w, visible, fields)
+		return
+	case "kml":
+		writeKML(w, r, visible, fields)
+		return
+	case "gpx":
+		h.writeGPX(w, visible)
+		return
+	}
+	numberOfRows := selection.numberOfRows
+	if pageSize != 0 {
+		numberOfRows = pageSize
+	}
 
+	var devicesResponse GetDevicesResponse
+	devicesResponse.PageNumber = page
+	if view != nil {
+		devicesResponse.View = view.Name
+		devicesResponse.Columns = view.Columns
+	}
+
+	// Handling pagination
+	current := devicesPage{start: 0, end: len(visible)}
+	if cursor := queryParams.Get("cursor"); cursor != "" {
+		current, err = cursorPage(visible, keys, cursor, numberOfRows)
 		if err != nil {
-			page = 1
+			http.Error(w, "Cursor is invalid", http.StatusBadRequest)
+			return
+		}
+		devicesResponse.PageNumber = 1
+		if numberOfRows != -1 {
+			devicesResponse.PageNumber = current.start/numberOfRows + 1
 		}
-		if page == 0 {
+	} else if numberOfRows != -1 {
+		if (page-1)*numberOfRows >= len(visible) {
 			http.Error(w, "Page does not exist", http.StatusBadRequest)
 			return
 		}
-		defer res.Body.Close()
-		var resultList ApiResponse
-
-		// Decoding the response and deserializing into the resultList object
-		err = json.NewDecoder(res.Body).Decode(&resultList)
+		current = devicesPage{start: (page - 1) * numberOfRows, end: min(page*numberOfRows, len(visible))}
+	}
+	devicesResponse.NextPage = current.end < len(visible)
+	devicesResponse.PreviousPage = current.start > 0
+	devicesResponse.TotalCount = len(visible)
+	devicesResponse.TotalPages = totalPages(len(visible), numberOfRows)
+	w.Header().Add("Link", pageLink(r, "", "first"))
+	if devicesResponse.PreviousPage {
+		devicesResponse.PreviousCursor = encodeCursor(keys, visible, current.start, true)
+		w.Header().Add("Link", pageLink(r, devicesResponse.PreviousCursor, "prev"))
+	}
+	if devicesResponse.NextPage {
+		devicesResponse.NextCursor = encodeCursor(keys, visible, current.end-1, false)
+		w.Header().Add("Link", pageLink(r, devicesResponse.NextCursor, "next"))
+	}
+	devicesResponse.Devices = visible[current.start:current.end]
+	if fields != nil {
+		projected, err := projectDevices(devicesResponse.Devices, fields)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		var visibleDevices []Device
-
-		// Appending the individual device preferences to the response
-		if preferences.GetDevicePreferences() != nil {
-			visibleDevices = make([]Device, 0)
-			for _, device := range resultList.Devices {
-				matched := false
-				for _, devicePreference := range preferences.GetDevicePreferences() {
-					if device.DeviceID == devicePreference.DeviceID {
-						matched = true
-						device.Image = devicePreference.Image
-						if !devicePreference.Hidden {
-							visibleDevices = append(visibleDevices, device)
-						}
-					}
-				}
-				if !matched {
-					device.Image = DefaultImagePath
-					visibleDevices = append(visibleDevices, device)
-				}
-			}
-		} else {
-			visibleDevices = resultList.Devices
-		}
-		var devicesResponse GetDevicesResponse
-		devicesResponse.PageNumber = page
-
-		// Sorting the devices based on the user preferences
-		visibleDevices = sortDevices(visibleDevices, preferences)
+		json.NewEncoder(w).Encode(projectedDevicesResponse{GetDevicesResponse: devicesResponse, Devices: projected})
+		return
+	}
+	// Encoding the response to json format for response
+	json.NewEncoder(w).Encode(devicesResponse)
+}
 
-		// Handling pagination
-		if preferences.GetNumberOfRows() != -1 {
-			if (page-1)*preferences.GetNumberOfRows() >= len(visibleDevices) {
-				http.Error(w, "Page does not exist", http.StatusBadRequest)
-				return
-			}
-			if (page)*preferences.GetNumberOfRows() >= len(visibleDevices) {
-				devicesResponse.NextPage = false
-			} else {
-				devicesResponse.NextPage = true
-			}
-			visibleDevices = visibleDevices[(page-1)*preferences.GetNumberOfRows() : int(math.Min(float64((page)*preferences.GetNumberOfRows()), float64(len(visibleDevices))))]
-			if page == 1 {
-				devicesResponse.PreviousPage = false
-			} else {
-				devicesResponse.PreviousPage = true
-			}
-		} else {
-			devicesResponse.PreviousPage = false
-			devicesResponse.NextPage = false
-		}
-		devicesResponse.Devices = visibleDevices
-		// Encoding the response to json format for response
-		json.NewEncoder(w).Encode(devicesResponse)
-	} else {
-		// Handling error for all other http methods
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+// DeviceHandler handler method for the get request of a single device. The device id is read from the path.
+// The device is served from the cached upstream data when available and supports conditional requests, the device
+// is modified when it is fetched again or when the preferences change
+func (h *Handler) DeviceHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	snapshot, err := h.cachedSnapshot(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	h.writeFailedAccounts(w, r, snapshot)
+	device, ok := h.accountDevice(r, snapshot.devices, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
 	}
+	// Reading the time the preferences were modified first, so that a change made meanwhile is not reported as seen
+	modified := h.Preferences.Modified()
+	devicePreferences := h.devicePreferences(device)
+	device.Image = devicePreferences.Image
+	device.Address = h.geocoder.resolve(device.LatestDevicePoint.Lat, device.LatestDevicePoint.Lng)
+	serveJSON(w, r, GetDeviceResponse{Device: device, Preferences: devicePreferences}, latest(snapshot.fetchedAt, modified))
 }
@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"main/data"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultExportLanguage is the language of the column headers of an export when no supported language is requested
+const DefaultExportLanguage = "en"
+
+// exportHeaders holds the header of every exported column, keyed by language
+var exportHeaders = map[string]map[string]string{
+	"en": {
+		"device_id": "Device ID", "display_name": "Name", "active_state": "Active state", "online": "Online",
+		"image": "Image", "lat": "Latitude", "lng": "Longitude", "altitude": "Altitude", "speed": "Speed (km/h)",
+		"angle": "Heading (°)", "odometer": "Odometer (km)", "battery_voltage": "Battery voltage (V)",
+		"fuel_level": "Fuel level (%)", "dt_tracker": "Device time", "dt_server": "Server time",
+		"drive_status": "Drive status", "account": "Account", "idle_s": "Idle (s)", "stale": "Stale",
+		"last_seen_ago": "Last seen (s ago)", "last_moved_ago": "Last moved (s ago)",
+		"distance": "Distance (m)", "address": "Address", "group": "Groups",
+	},
+	"es": {
+		"device_id": "ID del dispositivo", "display_name": "Nombre", "active_state": "Estado de actividad",
+		"online": "En línea", "image": "Imagen", "lat": "Latitud", "lng": "Longitud", "altitude": "Altitud",
+		"speed": "Velocidad (km/h)", "angle": "Rumbo (°)", "odometer": "Odómetro (km)",
+		"battery_voltage": "Voltaje de batería (V)", "fuel_level": "Nivel de combustible (%)",
+		"dt_tracker": "Hora del dispositivo", "dt_server": "Hora del servidor", "drive_status": "Estado de conducción",
+		"account": "Cuenta", "idle_s": "Ralentí (s)", "stale": "Sin datos recientes",
+		"last_seen_ago": "Última señal (hace s)", "last_moved_ago": "Último movimiento (hace s)",
+		"distance": "Distancia (m)", "address": "Dirección", "group": "Grupos",
+	},
+	"fr": {
+		"device_id": "ID de l'appareil", "display_name": "Nom", "active_state": "État d'activité", "online": "En ligne",
+		"image": "Image", "lat": "Latitude", "lng": "Longitude", "altitude": "Altitude", "speed": "Vitesse (km/h)",
+		"angle": "Cap (°)", "odometer": "Odomètre (km)", "battery_voltage": "Tension de la batterie (V)",
+		"fuel_level": "Niveau de carburant (%)", "dt_tracker": "Heure de l'appareil", "dt_server": "Heure du serveur",
+		"drive_status": "État de conduite", "account": "Compte", "idle_s": "Ralenti (s)", "stale": "Obsolète",
+		"last_seen_ago": "Vu il y a (s)", "last_moved_ago": "Déplacé il y a (s)",
+		"distance": "Distance (m)", "address": "Adresse", "group": "Groupes",
+	},
+	"de": {
+		"device_id": "Geräte-ID", "display_name": "Name", "active_state": "Aktivitätsstatus", "online": "Online",
+		"image": "Bild", "lat": "Breitengrad", "lng": "Längengrad", "altitude": "Höhe",
+		"speed": "Geschwindigkeit (km/h)", "angle": "Kurs (°)", "odometer": "Kilometerstand (km)",
+		"battery_voltage": "Batteriespannung (V)", "fuel_level": "Tankfüllstand (%)", "dt_tracker": "Gerätezeit",
+		"dt_server": "Serverzeit", "drive_status": "Fahrstatus", "account": "Konto", "idle_s": "Leerlauf (s)", "stale": "Veraltet",
+		"last_seen_ago": "Zuletzt gesehen vor (s)", "last_moved_ago": "Zuletzt bewegt vor (s)",
+		"distance": "Entfernung (m)", "address": "Adresse", "group": "Gruppen",
+	},
+}
+
+// exportNumberColumns lists the columns exported as numbers, the other columns are exported as text
+var exportNumberColumns = []string{"lat", "lng", "altitude", "speed", "angle", "odometer", "battery_voltage", "fuel_level", "idle_s",
+	"last_seen_ago", "last_moved_ago", "distance"}
+
+// rowWriter writes the rows of an export. The rows are written to the response as they are added, so that the export
+// is not held in memory
+type rowWriter interface {
+	// WriteRow writes a row holding the values of the columns
+	WriteRow(columns []string, values []string) error
+	// Close writes the end of the export
+	Close() error
+}
+
+// csvRowWriter writes the rows as comma separated values
+type csvRowWriter struct {
+	writer *csv.Writer
+}
+
+// csvFormulaPrefixes holds the first characters of the cells which spreadsheets evaluate as formulas
+const csvFormulaPrefixes = "=+-@\t\r"
+
+func (c *csvRowWriter) WriteRow(columns []string, values []string) error {
+	cells := make([]string, len(values))
+	for idx, value := range values {
+		// A text cell which would be evaluated as a formula when the export is opened is prefixed with a quote. The
+		// number columns are left as is, so that negative numbers are still numbers
+		if value != "" && strings.ContainsRune(csvFormulaPrefixes, rune(value[0])) && !slices.Contains(exportNumberColumns, columns[idx]) {
+			value = "'" + value
+		}
+		cells[idx] = value
+	}
+	return c.writer.Write(cells)
+}
+
+func (c *csvRowWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// xlsxRowWriter writes the rows to the single worksheet of an Office Open XML workbook. The cells of the number
+// columns hold numbers and the other cells inline strings, so that no shared strings table has to be built first
+type xlsxRowWriter struct {
+	archive *zip.Writer
+	sheet   io.Writer
+	rows    int
+}
+
+// xlsxParts holds the parts of the workbook other than the worksheet, which is written by the xlsxRowWriter
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Devices" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// newXlsxRowWriter writes the parts of the workbook preceding the rows to w
+func newXlsxRowWriter(w io.Writer) (*xlsxRowWriter, error) {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(file, part.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxRowWriter{archive: archive, sheet: sheet}, nil
+}
+
+func (x *xlsxRowWriter) WriteRow(columns []string, values []string) error {
+	x.rows++
+	var row strings.Builder
+	fmt.Fprintf(&row, `<row r="%d">`, x.rows)
+	for idx, value := range values {
+		if value == "" {
+			continue
+		}
+		// The first row holds the headers, which are always text
+		reference := cellReference(idx, x.rows)
+		if x.rows > 1 && slices.Contains(exportNumberColumns, columns[idx]) {
+			fmt.Fprintf(&row, `<c r="%s" t="n"><v>%s</v></c>`, reference, value)
+			continue
+		}
+		fmt.Fprintf(&row, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, reference)
+		xml.EscapeText(&row, []byte(value))
+		row.WriteString(`</t></is></c>`)
+	}
+	row.WriteString(`</row>`)
+	_, err := io.WriteString(x.sheet, row.String())
+	return err
+}
+
+// cellReference returns the reference of the cell in the column and row, e.g. AB12. column starts at 0 and row at 1
+func cellReference(column int, row int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return name + strconv.Itoa(row)
+}
+
+func (x *xlsxRowWriter) Close() error {
+	_, err := io.WriteString(x.sheet, `</sheetData></worksheet>`)
+	if err != nil {
+		return err
+	}
+	return x.archive.Close()
+}
+
+// parseColumns parses the comma separated list of the columns query param. Returns nil when no columns are requested
+func parseColumns(value string) ([]string, error) {
+	var columns []string
+	for _, column := range strings.Split(value, ",") {
+		column = strings.TrimSpace(column)
+		if column == "" {
+			continue
+		}
+		if !slices.Contains(data.ViewColumns, column) {
+			return nil, fmt.Errorf("column %s does not exist, columns must be one of %s", column, strings.Join(data.ViewColumns, ", "))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// exportLanguage returns the language of the column headers, read from the lang query param or else from the
+// Accept-Language header. Only the primary language subtag is used, e.g. es-MX selects es
+func exportLanguage(r *http.Request) string {
+	requested := []string{r.URL.Query().Get("lang")}
+	for _, language := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		language, _, _ = strings.Cut(language, ";")
+		requested = append(requested, language)
+	}
+	for _, language := range requested {
+		language, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(language)), "-")
+		if _, ok := exportHeaders[language]; ok {
+			return language
+		}
+	}
+	return DefaultExportLanguage
+}
+
+// ExportDevicesHandler is the handler function for the get request which exports the devices as a csv file or an
+// excel workbook selected by the format query param. The devices are filtered and sorted like the devices api but
+// are not paginated. The columns query param lists the exported columns, otherwise the columns of the view or all the
+// fields of the devices are exported. The headers are in the language of the lang query param or the
+// Accept-Language header
+func (h *Handler) ExportDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, "Format must be one of csv, xlsx", http.StatusBadRequest)
+		return
+	}
+	columns, err := parseColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, err := h.fetchSnapshot(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	h.writeFailedAccounts(w, r, snapshot)
+	selection, err := h.selectDevices(r, snapshot.devices)
+	if err != nil {
+		http.Error(w, "View does not exist", http.StatusNotFound)
+		return
+	}
+	if columns == nil && selection.view != nil {
+		columns = selection.view.Columns
+	}
+	if len(columns) == 0 {
+		columns = data.DeviceFields
+	}
+
+	var rows rowWriter
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", `attachment; filename="devices.xlsx"`)
+		rows, err = newXlsxRowWriter(w)
+		if err != nil {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="devices.csv"`)
+		rows = &csvRowWriter{writer: csv.NewWriter(w)}
+	}
+	headers := exportHeaders[exportLanguage(r)]
+	values := make([]string, len(columns))
+	for idx, column := range columns {
+		values[idx] = headers[column]
+	}
+	if rows.WriteRow(columns, values) != nil {
+		return
+	}
+	for _, device := range selection.devices {
+		for idx, column := range columns {
+			if column == "group" {
+				values[idx] = strings.Join(selection.groups[device.DeviceID], "; ")
+			} else {
+				values[idx] = deviceColumn(device, column)
+			}
+		}
+		// The response has already started, so a failed write can only end the export early
+		if rows.WriteRow(columns, values) != nil {
+			return
+		}
+	}
+	rows.Close()
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"main/data"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Media types of the formats of the devices api other than json
+const (
+	GeoJSONContentType = "application/geo+json"
+	KMLContentType     = "application/vnd.google-earth.kml+xml"
+	GPXContentType     = "application/gpx+xml"
+)
+
+// deviceFormats lists the formats of the devices api with their media type, in the order they are negotiated
+var deviceFormats = []struct {
+	name        string
+	contentType string
+}{
+	{"json", "application/json"},
+	{"geojson", GeoJSONContentType},
+	{"kml", KMLContentType},
+	{"gpx", GPXContentType},
+}
+
+// positionFields lists the fields which are part of the geometry of a device instead of its properties
+var positionFields = []string{"lat", "lng", "altitude"}
+
+// geoJSONFeatureCollection is a GeoJSON (RFC 7946) feature collection holding a point feature for every device
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   geoJSONGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// kmlDocument is a KML 2.2 document holding a placemark for every device
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	ID           string    `xml:"id,attr"`
+	Name         string    `xml:"name"`
+	Icon         string    `xml:"Style>IconStyle>Icon>href"`
+	ExtendedData []kmlData `xml:"ExtendedData>Data"`
+	Coordinates  string    `xml:"Point>coordinates"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+// gpxDocument is a GPX 1.1 document holding a track of the recorded positions of every device
+type gpxDocument struct {
+	XMLName xml.Name   `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name   string     `xml:"name"`
+	Points []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat       float64 `xml:"lat,attr"`
+	Lon       float64 `xml:"lon,attr"`
+	Elevation float64 `xml:"ele"`
+	Time      string  `xml:"time"`
+	// Description is the address of the position, when the handler has a geocoder
+	Description string `xml:"desc,omitempty"`
+}
+
+// deviceFormat returns the format of the devices api requested by the format query param, or else negotiated from the
+// Accept header. Returns json when no other format is accepted, and false when the format query param is unknown
+func deviceFormat(r *http.Request) (string, bool) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		for _, deviceFormat := range deviceFormats {
+			if deviceFormat.name == format {
+				return format, true
+			}
+		}
+		return "", false
+	}
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaRange, _, _ = strings.Cut(mediaRange, ";")
+		for _, deviceFormat := range deviceFormats {
+			if strings.EqualFold(strings.TrimSpace(mediaRange), deviceFormat.contentType) {
+				return deviceFormat.name, true
+			}
+		}
+	}
+	return "json", true
+}
+
+// propertyFields returns the requested fields of the devices which are not part of their position, or all of them
+// when no fields are requested
+func propertyFields(fields []string) []string {
+	if fields == nil {
+		fields = data.DeviceFields
+	}
+	properties := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if !slices.Contains(positionFields, field) {
+			properties = append(properties, field)
+		}
+	}
+	return properties
+}
+
+// absoluteURL resolves the reference of an image relative to the server handling the request, so that the image can
+// be loaded by clients which did not request it from the server such as Google Earth
+func absoluteURL(r *http.Request, reference string) string {
+	parsed, err := url.Parse(reference)
+	if err != nil || parsed.IsAbs() {
+		return reference
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: "/"}).ResolveReference(parsed).String()
+}
+
+// writeGeoJSON writes the devices as a GeoJSON feature collection. The properties of a feature hold the fields of the
+// device, with the same names and values as in the json format
+func writeGeoJSON(w http.ResponseWriter, devices []Device, fields []string) {
+	properties := propertyFields(fields)
+	projected, err := projectDevices(devices, properties)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(devices))}
+	for idx, device := range devices {
+		feature := geoJSONFeature{
+			Type: "Feature",
+			ID:   device.DeviceID,
+			Geometry: geoJSONGeometry{
+				Type:        "Point",
+				Coordinates: []float64{device.LatestDevicePoint.Lng, device.LatestDevicePoint.Lat, device.LatestDevicePoint.Altitude},
+			},
+			Properties: make(map[string]any),
+		}
+		for _, field := range properties {
+			if value, ok := lookupPath(projected[idx], deviceFieldPaths[field]); ok {
+				feature.Properties[field] = value
+			}
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	w.Header().Set("Content-Type", GeoJSONContentType)
+	json.NewEncoder(w).Encode(collection)
+}
+
+// writeKML writes the devices as KML placemarks showing the icon of the device. The fields of the device are added as
+// extended data
+func writeKML(w http.ResponseWriter, r *http.Request, devices []Device, fields []string) {
+	document := kmlDocument{Name: "Devices", Placemarks: make([]kmlPlacemark, 0, len(devices))}
+	for _, device := range devices {
+		placemark := kmlPlacemark{
+			ID:   device.DeviceID,
+			Name: device.DisplayName,
+			Icon: absoluteURL(r, device.Image),
+			Coordinates: fmt.Sprintf("%s,%s,%s", deviceColumn(device, "lng"), deviceColumn(device, "lat"),
+				deviceColumn(device, "altitude")),
+		}
+		for _, field := range propertyFields(fields) {
+			if value := deviceColumn(device, field); value != "" {
+				placemark.ExtendedData = append(placemark.ExtendedData, kmlData{Name: field, Value: value})
+			}
+		}
+		document.Placemarks = append(document.Placemarks, placemark)
+	}
+	writeXML(w, KMLContentType, document)
+}
+
+// writeGPX writes the recorded positions of the devices as GPX tracks, one track for every device
+func (h *Handler) writeGPX(w http.ResponseWriter, devices []Device) {
+	document := gpxDocument{Version: "1.1", Creator: "one-step-project-server", Tracks: make([]gpxTrack, 0, len(devices))}
+	for _, device := range devices {
+		positions := h.positions.get(device.DeviceID)
+		if len(positions) == 0 {
+			continue
+		}
+		track := gpxTrack{Name: device.DisplayName, Points: make([]gpxPoint, 0, len(positions))}
+		for _, position := range positions {
+			point := gpxPoint{
+				Lat:       position.Lat,
+				Lon:       position.Lng,
+				Elevation: position.Altitude,
+				Time:      position.Time.UTC().Format(time.RFC3339),
+			}
+			if address := h.geocoder.resolve(position.Lat, position.Lng); address != nil {
+				point.Description = address.String()
+			}
+			track.Points = append(track.Points, point)
+		}
+		document.Tracks = append(document.Tracks, track)
+	}
+	writeXML(w, GPXContentType, document)
+}
+
+// writeXML writes the document as indented xml
+func writeXML(w http.ResponseWriter, contentType string, document any) {
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	encoder.Encode(document)
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AddressPrecision is the number of decimals the coordinates are rounded to before they are resolved, so that the
+// positions within about a hundred meters of each other share a cached address
+const AddressPrecision = 3
+
+// MaxAddressDistance is the distance in meters from a location beyond which the nearest place is too far to be its
+// address, so that the location has no address instead of the name of a city hundreds of kilometers away
+const MaxAddressDistance = 100000
+
+// MaxCachedAddresses is the number of resolved coordinates kept in the cache, the cache is cleared once it is full
+const MaxCachedAddresses = 100000
+
+// bundledPlaces is the dataset of the largest cities used when no dataset is supplied. It holds about 150 cities, so
+// most locations outside of them have no address
+//
+//go:embed places.csv
+var bundledPlaces string
+
+// Place is a named location of the dataset of the geocoder. Admin is the name or the code of the first level
+// administrative region holding the place, such as a state, and Country the code of its country
+type Place struct {
+	Name    string  `json:"name"`
+	Admin   string  `json:"admin"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+}
+
+// Address is the place nearest to a location, along with the distance in meters from the location to the place
+type Address struct {
+	Place    string  `json:"place"`
+	Admin    string  `json:"admin,omitempty"`
+	Country  string  `json:"country,omitempty"`
+	Distance float64 `json:"distance_m"`
+}
+
+// String formats the address as the place followed by its region and country
+func (a *Address) String() string {
+	parts := []string{a.Place}
+	for _, part := range []string{a.Admin, a.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// placeColumns holds the index of the columns of the fields of a place in the records of a dataset, -1 when the
+// dataset does not have the column
+type placeColumns struct {
+	name    int
+	lat     int
+	lng     int
+	admin   int
+	country int
+}
+
+// geoNamesColumns are the columns of the tab separated files of GeoNames, such as cities500.txt, which have no header
+var geoNamesColumns = placeColumns{name: 1, lat: 4, lng: 5, admin: 10, country: 8}
+
+// headerNames lists the accepted names of the header of every column of a dataset
+var headerNames = map[string][]string{
+	"name":    {"name", "place", "city"},
+	"lat":     {"lat", "latitude"},
+	"lng":     {"lng", "lon", "longitude"},
+	"admin":   {"admin", "admin1", "region", "state"},
+	"country": {"country", "country_code"},
+}
+
+// headerColumns returns the columns of a dataset from its header. ok is false when the record is not a header
+func headerColumns(header []string) (columns placeColumns, ok bool) {
+	find := func(field string) int {
+		for idx, name := range header {
+			for _, accepted := range headerNames[field] {
+				if strings.EqualFold(strings.TrimSpace(name), accepted) {
+					return idx
+				}
+			}
+		}
+		return -1
+	}
+	columns = placeColumns{name: find("name"), lat: find("lat"), lng: find("lng"), admin: find("admin"), country: find("country")}
+	return columns, columns.name >= 0 && columns.lat >= 0 && columns.lng >= 0
+}
+
+// parsePlaces parses a dataset of places. The dataset is either a comma or tab separated file whose header names the
+// name, lat and lng columns along with the optional admin and country columns, or a GeoNames file without a header
+func parsePlaces(reader io.Reader) ([]Place, error) {
+	buffered := bufio.NewReader(reader)
+	first, err := buffered.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	records := csv.NewReader(io.MultiReader(strings.NewReader(first), buffered))
+	records.FieldsPerRecord = -1
+	records.LazyQuotes = true
+	if strings.Contains(first, "\t") {
+		records.Comma = '\t'
+	}
+	columns := geoNamesColumns
+	places := make([]Place, 0)
+	for line := 1; ; line++ {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 {
+			if header, ok := headerColumns(record); ok {
+				columns = header
+				continue
+			}
+		}
+		place, err := parsePlace(record, columns)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		places = append(places, place)
+	}
+	if len(places) == 0 {
+		return nil, errors.New("the dataset holds no places")
+	}
+	return places, nil
+}
+
+// parsePlace parses the place of a record of a dataset
+func parsePlace(record []string, columns placeColumns) (Place, error) {
+	field := func(column int) string {
+		if column < 0 || column >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[column])
+	}
+	place := Place{Name: field(columns.name), Admin: field(columns.admin), Country: field(columns.country)}
+	if place.Name == "" {
+		return Place{}, errors.New("the place has no name")
+	}
+	var err error
+	place.Lat, err = strconv.ParseFloat(field(columns.lat), 64)
+	if err != nil || math.Abs(place.Lat) > 90 {
+		return Place{}, errors.New("lat must be a number between -90 and 90")
+	}
+	place.Lng, err = strconv.ParseFloat(field(columns.lng), 64)
+	if err != nil || math.Abs(place.Lng) > 180 {
+		return Place{}, errors.New("lng must be a number between -180 and 180")
+	}
+	return place, nil
+}
+
+// LoadPlaces loads the places of the dataset at the path
+func LoadPlaces(path string) ([]Place, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parsePlaces(file)
+}
+
+// BundledPlaces returns the places of the dataset bundled with the server, which holds the largest cities of the world
+func BundledPlaces() ([]Place, error) {
+	return parsePlaces(strings.NewReader(bundledPlaces))
+}
+
+// geocoder resolves locations to the nearest place of its dataset. The place of every rounded coordinate is cached.
+// The places and their index are not modified once the geocoder is created, so the mutex only guards the cache
+type geocoder struct {
+	places []Place
+	index  *spatialIndex
+	mutex  sync.RWMutex
+	cache  map[[2]float64]int
+}
+
+// newGeocoder creates a geocoder resolving locations to the places
+func newGeocoder(places []Place) *geocoder {
+	g := &geocoder{places: places, index: &spatialIndex{cells: make(map[gridCell][]string)}, cache: make(map[[2]float64]int)}
+	for idx, place := range places {
+		g.index.add(strconv.Itoa(idx), place.Lat, place.Lng)
+	}
+	return g
+}
+
+// roundCoordinate rounds the coordinate to AddressPrecision decimals
+func roundCoordinate(value float64) float64 {
+	scale := math.Pow10(AddressPrecision)
+	return math.Round(value*scale) / scale
+}
+
+// nearestPlace returns the index of the place nearest to the rounded coordinates of the location
+func (g *geocoder) nearestPlace(lat float64, lng float64) int {
+	key := [2]float64{roundCoordinate(lat), roundCoordinate(lng)}
+	g.mutex.RLock()
+	idx, ok := g.cache[key]
+	g.mutex.RUnlock()
+	if ok {
+		return idx
+	}
+	distance := func(id string) float64 {
+		idx, _ := strconv.Atoi(id)
+		return haversine(key[0], key[1], g.places[idx].Lat, g.places[idx].Lng)
+	}
+	nearest, nearestDistance := -1, math.Inf(1)
+	accept := func(string) bool { return true }
+	for id := range g.index.nearest(key[0], key[1], 1, accept, distance) {
+		idx, _ := strconv.Atoi(id)
+		if d := distance(id); d < nearestDistance || (d == nearestDistance && idx < nearest) {
+			nearest, nearestDistance = idx, d
+		}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.cache) >= MaxCachedAddresses {
+		clear(g.cache)
+	}
+	g.cache[key] = nearest
+	return nearest
+}
+
+// resolve returns the address of the location, or nil when the handler has no geocoder or the nearest place is
+// farther than MaxAddressDistance
+func (g *geocoder) resolve(lat float64, lng float64) *Address {
+	if g == nil {
+		return nil
+	}
+	place := g.places[g.nearestPlace(lat, lng)]
+	distance := haversine(lat, lng, place.Lat, place.Lng)
+	if distance > MaxAddressDistance {
+		return nil
+	}
+	return &Address{
+		Place:    place.Name,
+		Admin:    place.Admin,
+		Country:  place.Country,
+		Distance: math.Round(distance),
+	}
+}
+
+// annotateAddresses sets the address of the latest point of the devices
+func (g *geocoder) annotateAddresses(devices []Device) {
+	for idx := range devices {
+		devices[idx].Address = g.resolve(devices[idx].LatestDevicePoint.Lat, devices[idx].LatestDevicePoint.Lng)
+	}
+}
+
+// annotateTrip sets the address of the start and the end of the trip
+func (g *geocoder) annotateTrip(trip *Trip) {
+	trip.Start.Address = g.resolve(trip.Start.Lat, trip.Start.Lng)
+	trip.End.Address = g.resolve(trip.End.Lat, trip.End.Lng)
+}
+
+// SetPlaces makes the handler resolve the locations of the devices, their trips, stops and recorded positions to the
+// nearest of the places
+func (h *Handler) SetPlaces(places []Place) {
+	h.geocoder = newGeocoder(places)
+}
@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// AlertTimeout is the time allowed to deliver the notification of an alert to a channel which does not set its timeout
+const AlertTimeout = 10 * time.Second
+
+// AlertWorkers is the number of notifications delivered concurrently
+const AlertWorkers = 4
+
+// AlertQueueSize is the number of notifications waiting for delivery, further notifications are dropped
+const AlertQueueSize = 100
+
+// Types of an AlertChannel
+const (
+	AlertChannelWebhook = "webhook"
+	AlertChannelSMTP    = "smtp"
+)
+
+// AlertChannel is a destination of the notifications of the alerts. A webhook channel posts the alert as json to the
+// URL. An smtp channel mails the alert from From to the To addresses through the smtp server at Address, authenticating
+// with Username and Password when set. TimeoutSeconds is the time allowed to deliver a notification, AlertTimeout when
+// 0
+type AlertChannel struct {
+	Name           string   `json:"name"`
+	Type           string   `json:"type"`
+	URL            string   `json:"url,omitempty"`
+	Address        string   `json:"address,omitempty"`
+	From           string   `json:"from,omitempty"`
+	To             []string `json:"to,omitempty"`
+	Username       string   `json:"username,omitempty"`
+	Password       string   `json:"password,omitempty"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+}
+
+// alertClient is the client posting the notifications of the webhook channels, the requests are limited by the timeout
+// of their channel
+var alertClient = &http.Client{}
+
+// validate checks that the channel has a name and the settings of its type
+func (c AlertChannel) validate() error {
+	if c.Name == "" {
+		return errors.New("must have a name")
+	}
+	if c.TimeoutSeconds < 0 {
+		return errors.New("timeout_seconds must not be negative")
+	}
+	switch c.Type {
+	case AlertChannelWebhook:
+		if c.URL == "" {
+			return errors.New("must have a url")
+		}
+	case AlertChannelSMTP:
+		if c.Address == "" || c.From == "" || len(c.To) == 0 {
+			return errors.New("must have an address, a from and a to")
+		}
+	default:
+		return fmt.Errorf("type must be one of %s, %s", AlertChannelWebhook, AlertChannelSMTP)
+	}
+	return nil
+}
+
+// notification is an alert waiting to be delivered to a channel
+type notification struct {
+	alert   Alert
+	channel AlertChannel
+}
+
+// notify queues the alert for delivery to the channels of its rule by the workers of the engine. Must be called while
+// holding the mutex of the engine. A notification which cannot be queued or delivered is logged
+func (e *alertEngine) notify(alert Alert) {
+	e.workers.Do(func() {
+		for range AlertWorkers {
+			go e.deliver()
+		}
+	})
+	for _, rule := range e.rules {
+		if rule.Name != alert.Rule {
+			continue
+		}
+		for _, name := range rule.Channels {
+			channel, ok := e.channels[name]
+			if !ok {
+				continue
+			}
+			select {
+			case e.queue <- notification{alert: alert, channel: channel}:
+			default:
+				log.Printf("Dropping alert %s for channel %s since %d notifications are waiting", alert.ID, channel.Name, AlertQueueSize)
+			}
+		}
+	}
+}
+
+// deliver sends the queued notifications to their channels
+func (e *alertEngine) deliver() {
+	for notification := range e.queue {
+		if err := notification.channel.send(notification.alert); err != nil {
+			log.Printf("Error occurred while sending alert %s to channel %s: %v", notification.alert.ID, notification.channel.Name, err)
+		}
+	}
+}
+
+// send delivers the alert to the channel
+func (c AlertChannel) send(alert Alert) error {
+	if c.Type == AlertChannelSMTP {
+		return c.mail(alert)
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := alertClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// mail sends the alert as a plain text email. The subject is encoded, so that a display name holding line breaks
+// cannot add headers to the email
+func (c AlertChannel) mail(alert Alert) error {
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", c.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(c.To, ", "))
+	subject := fmt.Sprintf("[%s] %s: %s", alert.State, alert.Rule, alert.DisplayName)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&message, "%s\r\n\r\nAlert %s of device %s fired at %s", alert.Message, alert.ID, alert.DeviceID, alert.FiredAt.Format(time.RFC3339))
+	if alert.ResolvedAt != nil {
+		fmt.Fprintf(&message, " and was resolved at %s", alert.ResolvedAt.Format(time.RFC3339))
+	}
+	message.WriteString(".\r\n")
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return c.sendMail(auth, []byte(message.String()))
+}
+
+// sendMail sends the message through the smtp server of the channel like smtp.SendMail, but the connection has a
+// deadline, so that a server which does not answer cannot block the worker delivering the notification
+func (c AlertChannel) sendMail(auth smtp.Auth, message []byte) error {
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", c.Address, c.timeout())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(c.timeout()))
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support authentication")
+		}
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(c.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// timeout returns the time allowed to deliver a notification to the channel
+func (c AlertChannel) timeout() time.Duration {
+	if c.TimeoutSeconds > 0 {
+		return time.Duration(c.TimeoutSeconds) * time.Second
+	}
+	return AlertTimeout
+}
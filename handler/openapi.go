@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenApiVersion is the version of the OpenAPI specification served by the server
+const OpenApiVersion = "3.0.3"
+
+// pathParameterPattern matches the path parameters of a route pattern such as {id} or {name...}
+var pathParameterPattern = regexp.MustCompile(`\{(\w+)(\.\.\.)?}`)
+
+// schemaBuilder builds json schemas from go types. Named struct types are added to the components of the
+// specification and referenced from the schemas using them
+type schemaBuilder struct {
+	components map[string]any
+}
+
+// schema returns the json schema describing the json encoding of values of type t
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			// Registering the name before building the schema so that recursive types terminate
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// structSchema returns the json schema of an object with the exported fields of the struct type as properties
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+			if nilable(field.Type) {
+				// The field is encoded as null when it is nil
+				properties[name] = nullable(properties[name].(map[string]any))
+			}
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// patchSchema returns the json schema of a json merge patch of values of type t. The members of an object are optional
+// and can be null to remove them. Objects are merged recursively, so the values of their members are patches as well,
+// while arrays and the other values are replaced. The patches of named struct types are added to the components
+// like their schema, named after the type followed by Patch
+func (b *schemaBuilder) patchSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": nullable(b.patchSchema(t.Elem()))}
+	case t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}):
+		return b.schema(t)
+	}
+	component := t.Name() + "Patch"
+	if _, ok := b.components[component]; ok && t.Name() != "" {
+		return map[string]any{"$ref": "#/components/schemas/" + component}
+	}
+	if t.Name() != "" {
+		// Registering the name before building the schema so that recursive types terminate
+		b.components[component] = nil
+	}
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = nullable(b.patchSchema(field.Type))
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if t.Name() == "" {
+		return schema
+	}
+	b.components[component] = schema
+	return map[string]any{"$ref": "#/components/schemas/" + component}
+}
+
+// nilable returns true when values of type t can be nil
+func nilable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	}
+	return false
+}
+
+// nullable returns the schema allowing null as well. A reference is wrapped in allOf, since the other keywords of a
+// reference are ignored
+func nullable(schema map[string]any) map[string]any {
+	if _, ok := schema["$ref"]; ok {
+		return map[string]any{"allOf": []any{schema}, "nullable": true}
+	}
+	schema["nullable"] = true
+	return schema
+}
+
+// mediaType returns the OpenAPI media type object of the content
+func (b *schemaBuilder) mediaType(c *content) map[string]any {
+	schema := c.Raw
+	if schema == nil && c.Patch {
+		schema = b.patchSchema(reflect.TypeOf(c.Schema))
+	} else if schema == nil {
+		schema = b.schema(reflect.TypeOf(c.Schema))
+	}
+	return map[string]any{c.ContentType: map[string]any{"schema": schema}}
+}
+
+// operation returns the OpenAPI operation object describing the route
+func (b *schemaBuilder) operation(route route) map[string]any {
+	parameters := make([]any, 0)
+	for _, match := range pathParameterPattern.FindAllStringSubmatch(route.Path, -1) {
+		parameters = append(parameters, map[string]any{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, query := range route.Query {
+		parameters = append(parameters, map[string]any{
+			"name": query.Name, "in": "query", "description": query.Description, "schema": map[string]any{"type": query.Type},
+		})
+	}
+	for _, header := range route.Headers {
+		parameters = append(parameters, map[string]any{
+			"name": header.Name, "in": "header", "description": header.Description, "schema": map[string]any{"type": header.Type},
+		})
+	}
+	responses := map[string]any{}
+	status := route.Success
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if route.Response != nil {
+		successContent := b.mediaType(route.Response)
+		for _, alternative := range route.Alternatives {
+			for contentType, mediaType := range b.mediaType(alternative) {
+				successContent[contentType] = mediaType
+			}
+		}
+		success["content"] = successContent
+	}
+	responses[strconv.Itoa(status)] = success
+	for _, status := range append(route.Statuses, http.StatusMethodNotAllowed) {
+		response := map[string]any{"description": http.StatusText(status)}
+		if errorContent, ok := route.ErrorContent[status]; ok {
+			response["content"] = b.mediaType(errorContent)
+		} else if status >= http.StatusBadRequest {
+			response["content"] = map[string]any{
+				"text/plain": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+			}
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	operation := map[string]any{
+		"summary":     route.Summary,
+		"operationId": operationId(route),
+		"parameters":  parameters,
+		"responses":   responses,
+	}
+	if len(route.Request) > 0 {
+		requestContent := map[string]any{}
+		for _, request := range route.Request {
+			for contentType, mediaType := range b.mediaType(request) {
+				requestContent[contentType] = mediaType
+			}
+		}
+		operation["requestBody"] = map[string]any{"required": true, "content": requestContent}
+	}
+	return operation
+}
+
+// operationId returns a unique id for the route derived from its method and path, e.g. getDevicesIdIcon
+func operationId(route route) string {
+	id := strings.ToLower(route.Method)
+	for _, segment := range strings.Split(pathParameterPattern.ReplaceAllString(route.Path, "$1"), "/") {
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '.' || r == '_' || r == '-' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// OpenApiSpec returns the OpenAPI specification of the apis served by the handler. The schemas are generated from
+// the go structures used to encode and decode the request and response bodies
+func (h *Handler) OpenApiSpec() map[string]any {
+	builder := &schemaBuilder{components: map[string]any{
+		"Error": map[string]any{"type": "string", "description": "Plain text description of the error"},
+	}}
+	paths := map[string]any{}
+	for _, route := range h.routes() {
+		path := pathParameterPattern.ReplaceAllString(route.Path, "{$1}")
+		if _, ok := paths[path]; !ok {
+			paths[path] = map[string]any{}
+		}
+		paths[path].(map[string]any)[strings.ToLower(route.Method)] = builder.operation(route)
+	}
+	return map[string]any{
+		"openapi": OpenApiVersion,
+		"info": map[string]any{
+			"title":       "One Step Project Server",
+			"version":     "1",
+			"description": "The apis are also served without the " + ApiPrefix + " prefix for older clients",
+		},
+		"servers":    []any{map[string]any{"url": ApiPrefix}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": builder.components},
+	}
+}
+
+// OpenApiHandler is the handler method which returns the OpenAPI specification of the server
+func (h *Handler) OpenApiHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(h.OpenApiSpec())
+}
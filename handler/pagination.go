@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/data"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+)
+
+// errInvalidCursor is returned when a cursor can not be decoded or was created for a different sort order
+var errInvalidCursor = errors.New("invalid cursor")
+
+// deviceCursor is the decoded form of the opaque cursor returned by the devices api. It points to the position of a
+// device in the sorted devices by holding the values of the sort keys of the device, so that the following pages do
+// not shift when devices appear or disappear between requests
+type deviceCursor struct {
+	// Sort is the sort order the cursor was created for, the device id being the last key
+	Sort []data.SortKey `json:"sort"`
+	// Values holds the value of every sort key of the device
+	Values []string `json:"values"`
+	// Backward is true when the page holds the devices before the device, false when it holds the devices after it
+	Backward bool `json:"backward,omitempty"`
+	// Duplicates is the number of devices sorted before the device which are equal to it in every sort key, i.e. the
+	// other entries of a device listed more than once by the one step api
+	Duplicates int `json:"duplicates,omitempty"`
+}
+
+// devicesPage is a page of the sorted devices, from the device at index start up to the device before index end
+type devicesPage struct {
+	start int
+	end   int
+}
+
+// encodeCursor returns the opaque cursor pointing to the device at the index of the devices sorted by the keys
+func encodeCursor(keys []data.SortKey, devices []Device, index int, backward bool) string {
+	cursor := deviceCursor{Sort: keys, Values: make([]string, 0, len(keys)), Backward: backward}
+	for _, key := range keys {
+		cursor.Values = append(cursor.Values, deviceColumn(devices[index], key.Column))
+	}
+	for idx := index - 1; idx >= 0 && compareDevicesBy(keys, devices[idx], devices[index]) == 0; idx-- {
+		cursor.Duplicates++
+	}
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor decodes the opaque cursor of the devices sorted by the keys. Returns a device holding the values of the
+// sort keys along with the cursor
+func decodeCursor(keys []data.SortKey, encoded string) (Device, deviceCursor, error) {
+	var device Device
+	var cursor deviceCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(decoded, &cursor) != nil {
+		return device, cursor, errInvalidCursor
+	}
+	if !slices.Equal(cursor.Sort, keys) || len(cursor.Values) != len(keys) || cursor.Duplicates < 0 {
+		return device, cursor, errInvalidCursor
+	}
+	for idx, key := range keys {
+		if setDeviceColumn(&device, key.Column, cursor.Values[idx]) != nil {
+			return device, cursor, errInvalidCursor
+		}
+	}
+	return device, cursor, nil
+}
+
+// cursorPage returns the page of at most numberOfRows devices after or before the device the cursor points to. The
+// devices must be sorted by the keys. A numberOfRows of -1 returns all the devices after or before the device. The
+// devices equal to the device in every sort key are told apart by their position among them
+func cursorPage(devices []Device, keys []data.SortKey, encoded string, numberOfRows int) (devicesPage, error) {
+	boundary, cursor, err := decodeCursor(keys, encoded)
+	if err != nil {
+		return devicesPage{}, err
+	}
+	first := sort.Search(len(devices), func(i int) bool { return compareDevicesBy(keys, devices[i], boundary) >= 0 })
+	after := sort.Search(len(devices), func(i int) bool { return compareDevicesBy(keys, devices[i], boundary) > 0 })
+	// position is the index of the device, or of the device following it when it disappeared
+	position := min(first+cursor.Duplicates, after)
+	if cursor.Backward {
+		end := position
+		if numberOfRows == -1 {
+			return devicesPage{start: 0, end: end}, nil
+		}
+		return devicesPage{start: max(0, end-numberOfRows), end: end}, nil
+	}
+	start := min(position+1, after)
+	if numberOfRows == -1 {
+		return devicesPage{start: start, end: len(devices)}, nil
+	}
+	return devicesPage{start: start, end: min(len(devices), start+numberOfRows)}, nil
+}
+
+// totalPages returns the number of pages of numberOfRows devices needed to show count devices
+func totalPages(count int, numberOfRows int) int {
+	if count == 0 {
+		return 0
+	}
+	if numberOfRows == -1 {
+		return 1
+	}
+	return (count + numberOfRows - 1) / numberOfRows
+}
+
+// pageLink returns the value of a Link header pointing to the page of the cursor. The other query params of the
+// request are kept, and the link points to the first page when the cursor is empty
+func pageLink(r *http.Request, cursor string, rel string) string {
+	query := r.URL.Query()
+	query.Del("page")
+	query.Del("cursor")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, link.String(), rel)
+}
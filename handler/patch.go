@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// decodeMergePatch decodes the json merge patch of the body of the request. The patch must be a json object, since
+// any other patch would replace the whole document instead of some of its fields
+func decodeMergePatch(r *http.Request) (map[string]any, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var patch map[string]any
+	err = json.Unmarshal(body, &patch)
+	if err != nil {
+		return nil, err
+	}
+	if patch == nil {
+		return nil, errors.New("the patch must be a json object")
+	}
+	return patch, nil
+}
+
+// applyMergePatch applies the json merge patch to the json encoding of value and returns the patched json document
+func applyMergePatch(value any, patch any) ([]byte, error) {
+	current, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var target any
+	err = json.Unmarshal(current, &target)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(target, patch))
+}
+
+// mergePatch applies the json merge patch (RFC 7396) to the target document and returns the patched document.
+// Objects are merged recursively, null removes a member and any other value replaces the target
+func mergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
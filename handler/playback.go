@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/data"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPlaybackStep is the time between the snapshots of a playback without a step
+const DefaultPlaybackStep = time.Minute
+
+// MaxPlaybackFrames is the largest number of snapshots of a playback
+const MaxPlaybackFrames = 1000
+
+// MaxPlaybackSpeed is the largest speed multiplier of a streamed playback
+const MaxPlaybackSpeed = 3600
+
+// PlaybackPosition is the position of a device in a snapshot of a playback. The location and altitude between two
+// recorded positions are interpolated linearly, and the drive status is the one of the earlier position
+type PlaybackPosition struct {
+	DeviceID    string  `json:"device_id"`
+	DisplayName string  `json:"display_name"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"lng"`
+	Altitude    float64 `json:"altitude"`
+	DriveStatus string  `json:"drive_status"`
+}
+
+// PlaybackFrame is a snapshot of the positions of the fleet at a time of a playback. A device is only part of the
+// snapshots following its first recorded position, and stays at its last recorded position afterwards
+type PlaybackFrame struct {
+	Time    time.Time          `json:"time"`
+	Devices []PlaybackPosition `json:"devices"`
+}
+
+// GetPlaybackResponse structure representing the data for the get api of the playback of the positions of the fleet
+type GetPlaybackResponse struct {
+	From   time.Time       `json:"from"`
+	To     time.Time       `json:"to"`
+	Step   float64         `json:"step_s"`
+	Frames []PlaybackFrame `json:"frames"`
+}
+
+// playbackTrack is the recorded positions of a device which is played back, along with the index of the position
+// preceding the last snapshot
+type playbackTrack struct {
+	device    Device
+	positions []Position
+	current   int
+}
+
+// playbackRange holds the query params of the playback apis
+type playbackRange struct {
+	from   time.Time
+	to     time.Time
+	step   time.Duration
+	groups []string
+}
+
+// parsePlaybackRange parses the from, to, step and group query params
+func parsePlaybackRange(r *http.Request) (playbackRange, error) {
+	from, to, ok := parseTimeRange(r)
+	if !ok || from.IsZero() || to.IsZero() {
+		return playbackRange{}, errors.New("From and to must be RFC 3339 times, with from before to")
+	}
+	query := playbackRange{from: from, to: to, step: DefaultPlaybackStep, groups: r.URL.Query()["group"]}
+	if value := r.URL.Query().Get("step"); value != "" {
+		step, err := time.ParseDuration(value)
+		if err != nil || step <= 0 {
+			return playbackRange{}, errors.New("Step must be a positive duration such as 30s")
+		}
+		query.step = step
+	}
+	if to.Sub(from)/query.step >= MaxPlaybackFrames {
+		return playbackRange{}, fmt.Errorf("The playback must have at most %d snapshots, use a larger step", MaxPlaybackFrames)
+	}
+	return query, nil
+}
+
+// parsePlaybackSpeed parses the speed query param of the streamed playback, 1 when not set
+func parsePlaybackSpeed(query url.Values) (float64, error) {
+	if !query.Has("speed") {
+		return 1, nil
+	}
+	speed, err := strconv.ParseFloat(query.Get("speed"), 64)
+	if err != nil || speed <= 0 || speed > MaxPlaybackSpeed {
+		return 0, fmt.Errorf("Speed must be a multiplier greater than 0 and at most %d", MaxPlaybackSpeed)
+	}
+	return speed, nil
+}
+
+// inGroups returns true when the device is in one of the groups, or when there are no groups
+func inGroups(deviceGroups []string, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if slices.ContainsFunc(deviceGroups, func(deviceGroup string) bool { return strings.EqualFold(deviceGroup, group) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// playbackTracks returns the recorded positions of the devices which are not hidden and are in one of the groups of
+// the query
+func (h *Handler) playbackTracks(r *http.Request, devices []Device, query playbackRange) []*playbackTrack {
+	tracks := make([]*playbackTrack, 0)
+	h.Preferences.Read(func(preferences data.Preferences) {
+		groups := deviceGroups(preferences)
+		for _, device := range uniqueDevices(visibleDevices(h.accountDevices(r, devices), preferences)) {
+			if !inGroups(groups[device.DeviceID], query.groups) {
+				continue
+			}
+			if positions := h.positions.get(device.DeviceID); len(positions) > 0 {
+				tracks = append(tracks, &playbackTrack{device: device, positions: positions})
+			}
+		}
+	})
+	return tracks
+}
+
+// position returns the position of the device at the time, false when the device has no recorded position before it.
+// The times must increase from a call to the next
+func (p *playbackTrack) position(t time.Time) (PlaybackPosition, bool) {
+	if t.Before(p.positions[0].Time) {
+		return PlaybackPosition{}, false
+	}
+	for p.current+1 < len(p.positions) && !p.positions[p.current+1].Time.After(t) {
+		p.current++
+	}
+	previous := p.positions[p.current]
+	position := PlaybackPosition{
+		DeviceID:    p.device.DeviceID,
+		DisplayName: p.device.DisplayName,
+		Lat:         previous.Lat,
+		Lng:         previous.Lng,
+		Altitude:    previous.Altitude,
+		DriveStatus: previous.DriveStatus,
+	}
+	if p.current+1 < len(p.positions) {
+		next := p.positions[p.current+1]
+		fraction := float64(t.Sub(previous.Time)) / float64(next.Time.Sub(previous.Time))
+		position.Lat += (next.Lat - previous.Lat) * fraction
+		position.Lng += (next.Lng - previous.Lng) * fraction
+		position.Altitude += (next.Altitude - previous.Altitude) * fraction
+	}
+	return position, true
+}
+
+// playbackFrame returns the snapshot of the positions of the devices at the time
+func playbackFrame(tracks []*playbackTrack, t time.Time) PlaybackFrame {
+	frame := PlaybackFrame{Time: t, Devices: make([]PlaybackPosition, 0, len(tracks))}
+	for _, track := range tracks {
+		if position, ok := track.position(t); ok {
+			frame.Devices = append(frame.Devices, position)
+		}
+	}
+	return frame
+}
+
+// PlaybackHandler is the handler function for the get request of the playback of the positions of the fleet. Returns
+// the snapshots of the devices which are not hidden, interpolated from their recorded positions every step from the from
+// query param to the to query param. The group query params limit the devices to the groups
+func (h *Handler) PlaybackHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	query, err := parsePlaybackRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	tracks := h.playbackTracks(r, devices, query)
+	response := GetPlaybackResponse{From: query.from, To: query.to, Step: query.step.Seconds(), Frames: make([]PlaybackFrame, 0)}
+	for t := query.from; !t.After(query.to); t = t.Add(query.step) {
+		response.Frames = append(response.Frames, playbackFrame(tracks, t))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// PlaybackStreamHandler is the handler function for the get request of the streamed playback of the positions of the
+// fleet. The snapshots of the playback api are sent as server sent events, waiting the step divided by the speed query
+// param between two snapshots. An end event is sent after the last snapshot
+func (h *Handler) PlaybackStreamHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	query, err := parsePlaybackRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	speed, err := parsePlaybackSpeed(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	tracks := h.playbackTracks(r, devices, query)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	controller := http.NewResponseController(w)
+	interval := time.Duration(float64(query.step) / speed)
+	for t := query.from; !t.After(query.to); t = t.Add(query.step) {
+		if t != query.from {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+		encoded, _ := json.Marshal(playbackFrame(tracks, t))
+		fmt.Fprintf(w, "event: frame\ndata: %s\n\n", encoded)
+		controller.Flush()
+	}
+	fmt.Fprint(w, "event: end\ndata: {}\n\n")
+	controller.Flush()
+}
@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DefaultPollInterval is the interval at which the devices are polled from the one step api
+const DefaultPollInterval = DeviceCacheTTL
+
+// Poll fetches the devices from the one step api every interval until the context is done, so that the positions,
+// trips, alerts and activity of the devices are recorded even when no client requests the devices. A failed fetch is
+// logged and retried at the next interval
+func (h *Handler) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := h.fetchSnapshot(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error occurred while polling the devices: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxPositions is the number of positions kept in the history of a device, older positions are dropped
+const MaxPositions = 1000
+
+// Position is a position of a device recorded from the one step api
+type Position struct {
+	Time        time.Time `json:"time"`
+	Lat         float64   `json:"lat"`
+	Lng         float64   `json:"lng"`
+	Altitude    float64   `json:"altitude"`
+	Speed       *float64  `json:"speed,omitempty"`
+	DriveStatus string    `json:"drive_status"`
+}
+
+// positionHistory records the positions of the devices every time they are fetched from the one step api. A position
+// is only recorded when the device moved or its drive status changed since its last recorded position
+type positionHistory struct {
+	mutex     sync.RWMutex
+	positions map[string][]Position
+}
+
+// newPositionHistory creates an empty position history
+func newPositionHistory() *positionHistory {
+	return &positionHistory{positions: make(map[string][]Position)}
+}
+
+// devicePosition returns the position of the latest point of the device. The time is the time the point was recorded
+// by the device, or fetchedAt when one step did not return it
+func devicePosition(device Device, fetchedAt time.Time) Position {
+	position := Position{
+		Time:        fetchedAt,
+		Lat:         device.LatestDevicePoint.Lat,
+		Lng:         device.LatestDevicePoint.Lng,
+		Altitude:    device.LatestDevicePoint.Altitude,
+		Speed:       device.LatestDevicePoint.Speed,
+		DriveStatus: device.LatestDevicePoint.DeviceStatus.DriveStatus,
+	}
+	if device.LatestDevicePoint.DtTracker != nil {
+		position.Time = *device.LatestDevicePoint.DtTracker
+	}
+	return position
+}
+
+// record appends the positions of the devices fetched at fetchedAt to their history. Only the first device with a
+// given id is recorded. Returns the positions which were appended, keyed by device id
+func (p *positionHistory) record(devices []Device, fetchedAt time.Time) map[string]Position {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	recorded := make(map[string]Position)
+	for _, device := range uniqueDevices(devices) {
+		position := devicePosition(device, fetchedAt)
+		history := p.positions[device.DeviceID]
+		if len(history) > 0 {
+			last := history[len(history)-1]
+			if !position.Time.After(last.Time) || (last.Lat == position.Lat && last.Lng == position.Lng && last.DriveStatus == position.DriveStatus) {
+				continue
+			}
+		}
+		if len(history) >= MaxPositions {
+			history = history[len(history)-MaxPositions+1:]
+		}
+		p.positions[device.DeviceID] = append(history, position)
+		recorded[device.DeviceID] = position
+	}
+	return recorded
+}
+
+// get returns a copy of the recorded positions of the device, oldest first
+func (p *positionHistory) get(deviceId string) []Position {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return append([]Position(nil), p.positions[deviceId]...)
+}
@@ -1,20 +1,39 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"main/data"
+	"math"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-// PreferencesHandler is the handler function for the preferences api call, handles both get and post request.
+// SavePreferencesHandler is the handler function for the post request of the preferences api.
+// The preferences are read from an application/json body, or from the data field of a form. When the request has an
+// If-Match header the preferences are only saved if it matches the ETag of the stored preferences. A user who does not
+// see every account can only write the preferences of the devices of the accounts the user can see and the views of the
+// user, the others are kept.
 // Accepts a request and response object
-func (h *Handler) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) SavePreferencesHandler(w http.ResponseWriter, r *http.Request) {
 	enableCors(w)
-	if r.Method == http.MethodPost {
+	var document []byte
+	if isJSON(r) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		document = body
+	} else {
 		err := r.ParseForm()
 		if err != nil {
 			log.Println(err)
@@ -22,129 +41,497 @@ func (h *Handler) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// Extracting form data present in data field
-		dataField := r.Form.Get("data")
-		// Deserializing the data into a preferences object
-		err = json.Unmarshal([]byte(dataField), &h.Preferences)
+		document = []byte(r.Form.Get("data"))
+	}
+	deviceIds := h.deviceIds(r.Context())
+	accountIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	user := requestUser(r)
+	// Deserializing the data into the preferences and validating them, the previous preferences are kept when the
+	// data is invalid
+	err = h.Preferences.Update(user, ifMatchVersion(r), func(preferences data.Preferences) error {
+		err := validateAccountDocument(document, user, accountIds)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-		// Saving the preferences to the storage
-		err = h.Preferences.Save()
+		document, err := mergeAccountDocument(preferences, document, user, accountIds, false)
 		if err != nil {
-			log.Println("Error while persisting preferences")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
+		}
+		err = data.Decode(preferences, document)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidDocument, err)
 		}
-		response := Response{Message: "Request processed successfully"}
+		return data.Validate(preferences, deviceIds)
+	})
+	if err != nil {
+		log.Println(err)
+		// A json body which cannot be decoded is a bad request, while the form keeps reporting it as a server error
+		status := http.StatusInternalServerError
+		if isJSON(r) && errors.Is(err, errInvalidDocument) {
+			status = http.StatusBadRequest
+		}
+		writePreferencesError(w, err, status)
+		return
+	}
+	response := Response{Message: "Request processed successfully"}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", preferencesETag(h.Preferences.Version()))
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(response)
+}
 
-		json.NewEncoder(w).Encode(response)
-	} else if r.Method == http.MethodGet {
-		// Formatting the onestep api url by appending the API_KEY
-		apiUrl := fmt.Sprintf(OneStepDeviceApiUrl, os.Getenv("API_KEY"))
-		res, err := h.httpClient.Get(apiUrl)
-		defer res.Body.Close()
+// PatchPreferencesHandler is the handler function for the patch request of the preferences api. The body is a json
+// merge patch (RFC 7396) which is applied to the stored preferences, so fields missing from the body are kept and a
+// null removes the field, which gets its default value. The patch of a user who does not see every account is applied
+// to the preferences the user can see, like the post request. Honors the If-Match header like the post request.
+// Responds with the updated preferences
+func (h *Handler) PatchPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deviceIds := h.deviceIds(r.Context())
+	accountIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	user := requestUser(r)
+	err = h.Preferences.Update(user, ifMatchVersion(r), func(preferences data.Preferences) error {
+		// The patch is applied to the preferences the user can see
+		current, err := json.Marshal(preferences)
+		if err == nil {
+			current, err = accountPreferences(current, user, accountIds)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-		var resultList ApiResponse
-		// Deserializing the api response into a resultList object
-		err = json.NewDecoder(res.Body).Decode(&resultList)
+		document, err := applyMergePatch(json.RawMessage(current), patch)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
+		}
+		err = validateAccountDocument(document, user, accountIds)
+		if err != nil {
+			return err
+		}
+		document, err = mergeAccountDocument(preferences, document, user, accountIds, true)
+		if err != nil {
+			return err
+		}
+		// The patched document holds every field of the preferences, so it is decoded into the default preferences which
+		// replace the stored ones, and the fields removed by a null of the patch get their default value
+		patched := data.GetNewPreferences()
+		err = data.Decode(patched, document)
+		if err == nil {
+			document, err = json.Marshal(patched)
+		}
+		if err == nil {
+			err = data.Replace(preferences, document)
+		}
+		if err != nil {
+			return err
+		}
+		return data.Validate(preferences, deviceIds)
+	})
+	if err != nil {
+		writePreferencesError(w, err, http.StatusBadRequest)
+		return
+	}
+	h.writePreferences(w, r)
+}
+
+// PatchDevicePreferencesHandler is the handler function for the patch request of the preferences of a single device.
+// The body is a json merge patch (RFC 7396) which is applied to the preferences of the device read from the path.
+// Honors the If-Match header like the post request. Responds with the updated device preferences
+func (h *Handler) PatchDevicePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	deviceId := r.PathValue("id")
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	visible, err := h.canSeeDevice(r, deviceId)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if !visible {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
+	}
+	var device *Device
+	for idx := range devices {
+		if devices[idx].DeviceID == deviceId {
+			device = &devices[idx]
+			break
+		}
+	}
+	var updated data.DevicePreferences
+	err = h.Preferences.Update(requestUser(r), ifMatchVersion(r), func(preferences data.Preferences) error {
+		devicePreference := findDevicePreferences(preferences, deviceId)
+		if devicePreference == nil {
+			if device == nil {
+				return errDeviceNotFound
+			}
+			// Devices which were added after the preferences were last fetched have no preferences yet
+			preferences.SetDevicePreferences(append(preferences.GetDevicePreferences(), data.DevicePreferences{
+				DeviceID:    device.DeviceID,
+				DisplayName: device.DisplayName,
+				Image:       DefaultImagePath,
+			}))
+			devicePreference = findDevicePreferences(preferences, deviceId)
+		}
+		document, err := applyMergePatch(devicePreference, patch)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(document, &updated)
+		if err != nil {
+			return err
+		}
+		// The device a preference belongs to can not be changed
+		updated.DeviceID = deviceId
+		*devicePreference = updated
+		return nil
+	})
+	if errors.Is(err, errDeviceNotFound) {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writePreferencesError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", preferencesETag(h.Preferences.Version()))
+	json.NewEncoder(w).Encode(updated)
+}
+
+// HistoryHandler is the handler function for the get request of the preferences history. Lists every change to the
+// preferences, oldest first. The snapshots of the preferences are only included when the snapshots query param is true.
+// The changes of the devices of accounts the user cannot see are left out
+func (h *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	deviceIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	changes, err := h.Preferences.History().List()
+	if err == nil {
+		changes, err = accountChanges(changes, requestUser(r), deviceIds)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("snapshots") != "true" {
+		for idx := range changes {
+			changes[idx].Snapshot = nil
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetHistoryResponse{Changes: changes})
+}
+
+// RevertPreferencesHandler is the handler function for the post request which restores the preferences of the version
+// read from the path. The revert is recorded in the history as a new change. Honors the If-Match header like the post
+// request of the preferences. The preferences of the devices of the accounts the user cannot see and the views of the
+// other users are left as they are. Responds with the restored preferences
+func (h *Handler) RevertPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "Version does not exist", http.StatusNotFound)
+		return
+	}
+	accountIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	user := requestUser(r)
+	// A user who does not see every account only restores the preferences of the devices and the views the user can see
+	err = h.Preferences.Revert(user, ifMatchVersion(r), version, func(preferences data.Preferences, snapshot []byte) ([]byte, error) {
+		snapshot, err := accountPreferences(snapshot, user, accountIds)
+		if err != nil {
+			return nil, err
+		}
+		return mergeAccountDocument(preferences, snapshot, user, accountIds, true)
+	})
+	if errors.Is(err, data.ErrVersionNotFound) {
+		http.Error(w, "Version does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writePreferencesError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.writePreferences(w, r)
+}
+
+// errDeviceNotFound is returned when a device does not exist
+var errDeviceNotFound = errors.New("device does not exist")
+
+// errInvalidDocument is returned when the preferences cannot be decoded from the document of a request
+var errInvalidDocument = errors.New("invalid preferences document")
+
+// deviceIds returns the ids of the devices returned by the one step api, which the preferences are validated against.
+// When the one step api is unavailable the ids of the devices fetched last are returned even when the cache expired,
+// or nil when the devices were never fetched, so that an outage of the one step api does not prevent saving the
+// preferences
+func (h *Handler) deviceIds(ctx context.Context) []string {
+	devices, _, err := h.cachedDevices(ctx)
+	if err != nil {
+		snapshot, ok := h.cache.lastKnown()
+		if !ok {
+			log.Printf("Validating the preferences without checking that their devices exist: %v", err)
+			return nil
 		}
+		devices = snapshot.devices
+	}
+	deviceIds := make([]string, 0, len(devices))
+	for _, device := range devices {
+		deviceIds = append(deviceIds, device.DeviceID)
+	}
+	return deviceIds
+}
+
+// writePreferencesError writes the error of a preferences update. The field errors of a *data.ValidationError are
+// written with status 400, a stale If-Match header is answered with 412 and other errors are written with the status
+func writePreferencesError(w http.ResponseWriter, err error, status int) {
+	var validationError *data.ValidationError
+	if errors.Is(err, data.ErrVersionMismatch) {
+		http.Error(w, "Preferences have been modified", http.StatusPreconditionFailed)
+		return
+	}
+	if !errors.As(err, &validationError) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ValidationErrorResponse{Message: "Invalid preferences", Errors: validationError.Errors})
+}
+
+// preferencesETag returns the ETag of the given version of the preferences
+func preferencesETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersion returns the version of the preferences the If-Match header of the request refers to, or
+// data.AnyVersion when the header is missing or *. A header which does not refer to a version never matches
+func ifMatchVersion(r *http.Request) int {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return data.AnyVersion
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`))
+	if err != nil || version < 0 {
+		return math.MinInt
+	}
+	return version
+}
+
+// isJSON returns true if the body of the request is json
+func isJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// GetPreferencesHandler is the handler function for the get request of the preferences api. The ETag of the
+// response is the version of the preferences, requests holding the ETag of the current version are answered with 304.
+// Only the preferences of the devices of the accounts the user can see are returned, like their views by
+// accountPreferences. The stored preferences of the
+// devices which are not listed are kept when an account could not be fetched, since they may belong to that account.
+// Accepts a request and response object
+func (h *Handler) GetPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	snapshot, err := h.fetchSnapshot(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	h.writeFailedAccounts(w, r, snapshot)
+	err = h.Preferences.Update(requestUser(r), data.AnyVersion, func(preferences data.Preferences) error {
 		// Creating a device preferences array which holds individual device preferences
 		var devicePreferences = make([]data.DevicePreferences, 0)
-		for _, device := range resultList.Devices {
+		fetched := make(map[string]bool)
+		for _, device := range uniqueDevices(snapshot.devices) {
+			fetched[device.DeviceID] = true
 			matched := data.DevicePreferences{
 				DeviceID:    device.DeviceID,
 				DisplayName: device.DisplayName,
 				Hidden:      false,
 				Image:       DefaultImagePath,
 			}
-			for _, devicePreference := range h.Preferences.GetDevicePreferences() {
-				if devicePreference.DeviceID == device.DeviceID {
-					matched.Hidden = devicePreference.Hidden
-					matched.Image = devicePreference.Image
-					break
-				}
+			if devicePreference := findDevicePreferences(preferences, device.DeviceID); devicePreference != nil {
+				matched.Hidden = devicePreference.Hidden
+				matched.Image = devicePreference.Image
+				matched.Groups = devicePreference.Groups
+				matched.Tags = devicePreference.Tags
 			}
 			devicePreferences = append(devicePreferences, matched)
 		}
-		// Updating the device preferences to include the new devices which could have been added
-		err = h.Preferences.SetDevicePreferences(devicePreferences)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if len(snapshot.failed) > 0 {
+			for _, devicePreference := range preferences.GetDevicePreferences() {
+				if !fetched[devicePreference.DeviceID] {
+					devicePreferences = append(devicePreferences, devicePreference)
+				}
+			}
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(h.Preferences)
-	} else {
-		// Handling error for other method types other than get and post
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		// Updating the device preferences to include the new devices which could have been added
+		preferences.SetDevicePreferences(devicePreferences)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deviceIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	var body []byte
+	var version int
+	h.Preferences.Read(func(preferences data.Preferences) {
+		version = preferences.GetVersion()
+		body, err = json.Marshal(preferences)
+	})
+	if err == nil {
+		body, err = accountPreferences(body, requestUser(r), deviceIds)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	if checkNotModified(w, r, preferencesETag(version), h.Preferences.Modified()) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
 }
 
-// Upload is the method which handles image uploads. Accepts a request and response object
+// writePreferences writes the preferences along with their ETag to the response, holding only the preferences of the
+// devices of the accounts the user making the request can see
+func (h *Handler) writePreferences(w http.ResponseWriter, r *http.Request) {
+	deviceIds, err := h.accountDeviceIds(r)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	var body []byte
+	var version int
+	h.Preferences.Read(func(preferences data.Preferences) {
+		version = preferences.GetVersion()
+		body, err = json.Marshal(preferences)
+	})
+	if err == nil {
+		body, err = accountPreferences(body, requestUser(r), deviceIds)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", preferencesETag(version))
+	w.Write(append(body, '\n'))
+}
+
+// Upload is the method which handles image uploads. Accepts a request and response object.
+// The device id is read from the path when present, otherwise from the device_id query param. Ids which could refer to
+// another directory are rejected with 400
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 	enableCors(w)
-	if r.Method == http.MethodPost {
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	deviceId := r.PathValue("id")
+	if deviceId == "" {
 		// extracting device_id from query params
-		queryParams := r.URL.Query()
-		deviceId := queryParams.Get("device_id")
-		// Create a directory if it doesn't exist
-		err = h.FileSystem.MkdirAll("images", os.ModePerm)
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Constructing image file path
-		imageFilePath := "images/" + deviceId + filepath.Ext(header.Filename)
-		// Creating a file in the server to hold the image
-		serverFile, err := h.FileSystem.Create(imageFilePath)
-		defer serverFile.Close()
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Copying the uploaded image to the newly created file
-		_, err = h.FileSystem.Copy(serverFile, file)
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// setting the updated image in the device preferences
-		for idx, _ := range h.Preferences.GetDevicePreferences() {
-			if h.Preferences.GetDevicePreferences()[idx].DeviceID == deviceId {
-				h.Preferences.GetDevicePreferences()[idx].Image = "/" + imageFilePath
-				break
-			}
+		deviceId = r.URL.Query().Get("device_id")
+	}
+	// The device id is part of the name of the image file
+	if !isFileName(deviceId) {
+		http.Error(w, "Invalid device id", http.StatusBadRequest)
+		return
+	}
+	visible, err := h.canSeeDevice(r, deviceId)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if !visible {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
+	}
+	// Create a directory if it doesn't exist
+	err = h.FileSystem.MkdirAll("images", os.ModePerm)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Constructing image file path from the content of the image, so that the image can be cached by clients forever
+	imageName, err := contentAddressedName(deviceId, filepath.Ext(header.Filename), file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	imageFilePath := "images/" + imageName
+	// Creating a file in the server to hold the image
+	serverFile, err := h.FileSystem.Create(imageFilePath)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer serverFile.Close()
+	// Copying the uploaded image to the newly created file
+	_, err = h.FileSystem.Copy(serverFile, file)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// setting the updated image in the device preferences and saving the preferences to storage
+	err = h.Preferences.Update(requestUser(r), data.AnyVersion, func(preferences data.Preferences) error {
+		if devicePreference := findDevicePreferences(preferences, deviceId); devicePreference != nil {
+			devicePreference.Image = "/" + imageFilePath
 		}
-		// Saving the preferences to storage
-		h.Preferences.Save()
-		response := Response{Message: "/" + imageFilePath}
+		return nil
+	})
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := Response{Message: "/" + imageFilePath}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 
-		json.NewEncoder(w).Encode(response)
-	} else {
-		// Handling error for other http methods
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-	}
+	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"main/data"
+	"slices"
+	"strings"
+)
+
+// deviceFieldPaths holds the json path of every field of data.DeviceFields in the encoded Device
+var deviceFieldPaths = map[string][]string{
+	"device_id":       {"device_id"},
+	"display_name":    {"display_name"},
+	"active_state":    {"active_state"},
+	"online":          {"online"},
+	"image":           {"image"},
+	"lat":             {"latest_accurate_device_point", "lat"},
+	"lng":             {"latest_accurate_device_point", "lng"},
+	"altitude":        {"latest_accurate_device_point", "altitude"},
+	"speed":           {"latest_accurate_device_point", "speed"},
+	"angle":           {"latest_accurate_device_point", "angle"},
+	"odometer":        {"latest_accurate_device_point", "odometer"},
+	"battery_voltage": {"latest_accurate_device_point", "battery_voltage"},
+	"fuel_level":      {"latest_accurate_device_point", "fuel_level"},
+	"dt_tracker":      {"latest_accurate_device_point", "dt_tracker"},
+	"dt_server":       {"latest_accurate_device_point", "dt_server"},
+	"drive_status":    {"latest_accurate_device_point", "device_state", "drive_status"},
+	"account":         {"account"},
+	"idle_s":          {"idle_s"},
+	"stale":           {"stale"},
+	"last_seen_ago":   {"last_seen_ago"},
+	"last_moved_ago":  {"last_moved_ago"},
+	"distance":        {"distance"},
+	"address":         {"address"},
+}
+
+// projectedDevicesResponse is the GetDevicesResponse holding only the requested fields of the devices
+type projectedDevicesResponse struct {
+	GetDevicesResponse
+	Devices []map[string]any `json:"devices"`
+}
+
+// parseFields parses the comma separated list of the fields query param. Returns nil when no fields are requested
+func parseFields(value string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !slices.Contains(data.DeviceFields, field) {
+			return nil, fmt.Errorf("field %s does not exist, fields must be one of %s", field, strings.Join(data.DeviceFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// viewFields returns the fields of the devices shown by the columns of a view, which are projected when the request
+// has no fields query param. Returns nil when the view shows every field. The device id is always projected so that
+// the devices can be told apart, and the group column is not a field of the devices
+func viewFields(view *data.View) []string {
+	if view == nil || len(view.Columns) == 0 {
+		return nil
+	}
+	fields := []string{"device_id"}
+	for _, column := range view.Columns {
+		if slices.Contains(data.DeviceFields, column) && !slices.Contains(fields, column) {
+			fields = append(fields, column)
+		}
+	}
+	return fields
+}
+
+// projectDevices returns the devices holding only the fields. The fields keep their position in the encoded Device,
+// so that clients decode the projected devices like the complete ones
+func projectDevices(devices []Device, fields []string) ([]map[string]any, error) {
+	projected := make([]map[string]any, 0, len(devices))
+	for _, device := range devices {
+		encoded, err := json.Marshal(device)
+		if err != nil {
+			return nil, err
+		}
+		var document map[string]any
+		err = json.Unmarshal(encoded, &document)
+		if err != nil {
+			return nil, err
+		}
+		projection := make(map[string]any)
+		for _, field := range fields {
+			copyPath(document, projection, deviceFieldPaths[field])
+		}
+		projected = append(projected, projection)
+	}
+	return projected, nil
+}
+
+// copyPath copies the value at the json path of the src document into the dst document, creating the objects
+// holding it. Values missing from the src document are not copied
+func copyPath(src map[string]any, dst map[string]any, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+	child, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+	next, ok := dst[path[0]].(map[string]any)
+	if !ok {
+		next = make(map[string]any)
+		dst[path[0]] = next
+	}
+	copyPath(child, next, path[1:])
+}
+
+// lookupPath returns the value at the json path of the document, and false when the document has no such value
+func lookupPath(document map[string]any, path []string) (any, bool) {
+	value, ok := document[path[0]]
+	if !ok || len(path) == 1 {
+		return value, ok
+	}
+	child, ok := value.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookupPath(child, path[1:])
+}
@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"main/data"
+	"net/http"
+	"slices"
+)
+
+// ApiPrefix is the prefix of the versioned api. The unversioned paths are kept as aliases for older clients
+const ApiPrefix = "/api/v1"
+
+// route describes an api of the server. The description is used both to register the api in the router and to
+// generate the OpenAPI specification, so that the specification always lists the apis which are served
+type route struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+	// Query lists the query params accepted by the api
+	Query []parameter
+	// Headers lists the request headers accepted by the api
+	Headers []parameter
+	// Request lists the accepted bodies of the request, empty when the api does not accept a body
+	Request []*content
+	// Response is the body of a successful response
+	Response *content
+	// Alternatives lists the other formats of a successful response which can be negotiated
+	Alternatives []*content
+	// Success is the status code of a successful response, 200 when not set
+	Success int
+	// Statuses lists the status codes of the responses other than the successful one
+	Statuses []int
+	// ErrorContent holds the bodies of the error responses which are not plain text, keyed by status code
+	ErrorContent map[int]*content
+}
+
+// parameter describes a query param of an api
+type parameter struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// content describes the body of a request or a response. Schema is either a go value whose type describes the body or
+// a raw schema when Raw is set. Patch is set when the body is a json merge patch of the values described by Schema
+type content struct {
+	ContentType string
+	Schema      any
+	Raw         map[string]any
+	Patch       bool
+}
+
+// ifMatchHeader is the header used to update the preferences only if they were not modified by another request
+var ifMatchHeader = parameter{Name: "If-Match", Description: "ETag of the preferences the update is based on", Type: "string"}
+
+// ifNoneMatchHeader is the header used to get a response only if it changed since the response with the ETag
+var ifNoneMatchHeader = parameter{Name: "If-None-Match", Description: "ETag of a previous response, answered with 304 when unchanged", Type: "string"}
+
+// userHeader is the header identifying the user whose views are used
+var userHeader = parameter{Name: UserHeader, Description: "Name of the user, " + AnonymousUser + " when not set", Type: "string"}
+
+// tripsQuery lists the query params limiting the trips to a time range
+var tripsQuery = []parameter{
+	{Name: "from", Description: "RFC 3339 time, only the trips ending after it are returned", Type: "string"},
+	{Name: "to", Description: "RFC 3339 time, only the trips starting before it are returned", Type: "string"},
+}
+
+// stopsQuery lists the query params of the stops report
+var stopsQuery = []parameter{
+	{Name: "from", Description: "RFC 3339 time, only the stops ending after it are returned", Type: "string"},
+	{Name: "to", Description: "RFC 3339 time, only the stops starting before it are returned", Type: "string"},
+	{Name: "kind", Description: "Kind of the stops, idle or stop", Type: "string"},
+}
+
+// playbackQuery lists the query params of the playback apis
+var playbackQuery = []parameter{
+	{Name: "from", Description: "RFC 3339 time of the first snapshot", Type: "string"},
+	{Name: "to", Description: "RFC 3339 time after which there are no more snapshots", Type: "string"},
+	{Name: "step", Description: "Duration between two snapshots such as 30s, 1m when not set", Type: "string"},
+	{Name: "group", Description: "Group of the devices, can be repeated to play back the devices of several groups", Type: "string"},
+}
+
+// alertsQuery lists the query params of the alerts api
+var alertsQuery = []parameter{
+	{Name: "state", Description: "State of the alerts, firing, acknowledged or resolved", Type: "string"},
+}
+
+// upstreamStatuses returns the statuses followed by the statuses of the responses of an api which fetches the devices
+// from the one step api when the fetch fails
+func upstreamStatuses(statuses ...int) []int {
+	return append(statuses, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout)
+}
+
+// jsonContent returns the content of a json body described by the type of value
+func jsonContent(value any) *content {
+	return &content{ContentType: "application/json", Schema: value}
+}
+
+// routes returns the list of apis served by the handler
+func (h *Handler) routes() []route {
+	return []route{
+		{
+			Method: http.MethodGet, Path: "/devices", Summary: "Lists the visible devices sorted and paginated according to the preferences",
+			Handler: h.DevicesHandler,
+			Query: []parameter{
+				{Name: "page", Description: "Page number starting from 1", Type: "integer"},
+				{Name: "view", Description: "Name of the saved view of the user used instead of the default view", Type: "string"},
+				{Name: "cursor", Description: "Opaque cursor of the next_cursor or previous_cursor of a previous response, used instead of page", Type: "string"},
+				{Name: "page_size", Description: "Number of devices in a page overriding the preferences, -1 returns all the devices", Type: "integer"},
+				{Name: "fields", Description: "Comma separated list of the fields of the devices to return, e.g. device_id,lat,lng", Type: "string"},
+				{Name: "format", Description: "json (default), geojson, kml or gpx. Overrides the format negotiated from the Accept header", Type: "string"},
+				{Name: "stale", Description: "Returns only the devices which are stale when true, or which are not stale when false", Type: "boolean"},
+				{Name: "bbox", Description: "Returns only the devices inside the min lng,min lat,max lng,max lat box", Type: "string"},
+				{Name: "near", Description: "lat,lng of the point the devices within radius_m are returned of, with their distance", Type: "string"},
+				{Name: "radius_m", Description: "Radius in meters around the near point", Type: "number"},
+				{Name: "nearest", Description: "lat,lng of the point the nearest devices are returned of, sorted by their distance", Type: "string"},
+				{Name: "limit", Description: "Number of nearest devices, 10 when not set", Type: "integer"},
+			},
+			Headers:  []parameter{userHeader, ifNoneMatchHeader},
+			Response: jsonContent(GetDevicesResponse{}),
+			Alternatives: []*content{
+				{ContentType: GeoJSONContentType, Raw: map[string]any{"type": "object", "description": "GeoJSON FeatureCollection of the devices"}},
+				{ContentType: KMLContentType, Raw: map[string]any{"type": "string", "description": "KML placemarks of the devices"}},
+				{ContentType: GPXContentType, Raw: map[string]any{"type": "string", "description": "GPX tracks of the recorded positions of the devices"}},
+			},
+			Statuses: upstreamStatuses(http.StatusNotModified, http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/devices/summary", Summary: "Counts the visible devices and returns their bounding box and centroid",
+			Handler:  h.DevicesSummaryHandler,
+			Query:    []parameter{{Name: "view", Description: "Name of the saved view of the user used instead of the default view", Type: "string"}},
+			Headers:  []parameter{userHeader, ifNoneMatchHeader},
+			Response: jsonContent(DevicesSummary{}),
+			Statuses: upstreamStatuses(http.StatusNotModified, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/devices/clusters", Summary: "Clusters the visible devices on a grid of the zoom level, returning the devices alone in their cell",
+			Handler: h.ClustersHandler,
+			Query: []parameter{
+				{Name: "zoom", Description: "Zoom level between 0 and 22, the devices are not clustered above 16", Type: "integer"},
+				{Name: "bbox", Description: "Clusters only the devices inside the min lng,min lat,max lng,max lat box", Type: "string"},
+				{Name: "view", Description: "Name of the saved view of the user used instead of the default view", Type: "string"},
+				{Name: "stale", Description: "Clusters only the devices which are stale when true, or which are not stale when false", Type: "boolean"},
+			},
+			Headers:  []parameter{userHeader, ifNoneMatchHeader},
+			Response: jsonContent(GetClustersResponse{}),
+			Statuses: upstreamStatuses(http.StatusNotModified, http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/devices/export", Summary: "Exports the devices filtered and sorted like the devices api as a csv file or an excel workbook",
+			Handler: h.ExportDevicesHandler,
+			Query: []parameter{
+				{Name: "format", Description: "csv (default) or xlsx", Type: "string"},
+				{Name: "view", Description: "Name of the saved view of the user used instead of the default view", Type: "string"},
+				{Name: "columns", Description: "Comma separated list of the exported columns, defaults to the columns of the view or all the fields", Type: "string"},
+				{Name: "lang", Description: "Language of the column headers: en, es, fr or de. Defaults to the Accept-Language header", Type: "string"},
+			},
+			Headers:  []parameter{userHeader},
+			Response: &content{ContentType: "text/csv", Raw: map[string]any{"type": "string"}},
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/devices/{id}", Summary: "Returns a single device along with its device preferences",
+			Handler:  h.DeviceHandler,
+			Response: jsonContent(GetDeviceResponse{}),
+			Statuses: upstreamStatuses(http.StatusNotModified, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/devices/{id}/icon", Summary: "Returns the icon of the device or redirects to it",
+			Handler:  h.DeviceIconHandler,
+			Headers:  []parameter{userHeader},
+			Response: &content{ContentType: "image/*", Raw: map[string]any{"type": "string", "format": "binary"}},
+			Statuses: upstreamStatuses(http.StatusFound, http.StatusNotFound),
+		},
+		{
+			Method: http.MethodPost, Path: "/devices/{id}/icon", Summary: "Uploads the icon of the device",
+			Handler:  h.Upload,
+			Headers:  []parameter{userHeader},
+			Request:  []*content{uploadContent()},
+			Response: jsonContent(Response{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/devices/{id}/trips", Summary: "Lists the trips of the device detected from its drive status, oldest first",
+			Handler:  h.DeviceTripsHandler,
+			Query:    tripsQuery,
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(GetTripsResponse{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/trips", Summary: "Lists the trips of the devices which are not hidden, sorted by their start",
+			Handler:  h.TripsHandler,
+			Query:    tripsQuery,
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(GetTripsResponse{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/stops", Summary: "Lists the idle and stopped periods of the devices which are not hidden, sorted by their start",
+			Handler:  h.StopsHandler,
+			Query:    stopsQuery,
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(GetStopsResponse{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/playback", Summary: "Returns snapshots of the positions of the devices which are not hidden, interpolated from their recorded positions at a fixed step",
+			Handler:  h.PlaybackHandler,
+			Query:    playbackQuery,
+			Response: jsonContent(GetPlaybackResponse{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/playback/stream", Summary: "Streams the snapshots of the playback api as server sent events at a speed multiplier",
+			Handler: h.PlaybackStreamHandler,
+			Query: append(append([]parameter{}, playbackQuery...),
+				parameter{Name: "speed", Description: "Speed multiplier of the playback, the snapshots are sent every step divided by the speed. Defaults to 1", Type: "number"}),
+			Response: &content{ContentType: "text/event-stream", Raw: map[string]any{"type": "string", "description": "A frame event holding every snapshot as json, followed by an end event"}},
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/alerts", Summary: "Lists the alerts raised by the alert rules for the devices which are not hidden, newest first",
+			Handler:  h.AlertsHandler,
+			Query:    alertsQuery,
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(GetAlertsResponse{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodPost, Path: "/alerts/{id}/ack", Summary: "Acknowledges a firing alert",
+			Handler:  h.AcknowledgeAlertHandler,
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(Alert{}),
+			Statuses: upstreamStatuses(http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/preferences", Summary: "Returns the preferences including the preferences of every device",
+			Handler:  h.GetPreferencesHandler,
+			Headers:  []parameter{userHeader, ifNoneMatchHeader},
+			Response: jsonContent(data.PreferencesImpl{}),
+			Statuses: upstreamStatuses(http.StatusNotModified, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodPost, Path: "/preferences", Summary: "Replaces the preferences",
+			Handler: h.SavePreferencesHandler,
+			Request: []*content{jsonContent(data.PreferencesImpl{}), {ContentType: "application/x-www-form-urlencoded", Raw: map[string]any{
+				"type":     "object",
+				"required": []string{"data"},
+				"properties": map[string]any{
+					"data": map[string]any{"type": "string", "description": "JSON encoded Preferences"},
+				},
+			}}},
+			Response:     jsonContent(Response{}),
+			Statuses:     []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusPreconditionFailed},
+			ErrorContent: map[int]*content{http.StatusBadRequest: jsonContent(ValidationErrorResponse{})},
+			Headers:      []parameter{ifMatchHeader},
+		},
+		{
+			Method: http.MethodPatch, Path: "/preferences", Summary: "Applies a JSON merge patch to the preferences",
+			Handler:      h.PatchPreferencesHandler,
+			Request:      []*content{mergePatchContent(data.PreferencesImpl{})},
+			Response:     jsonContent(data.PreferencesImpl{}),
+			Statuses:     upstreamStatuses(http.StatusBadRequest, http.StatusInternalServerError, http.StatusPreconditionFailed),
+			ErrorContent: map[int]*content{http.StatusBadRequest: jsonContent(ValidationErrorResponse{})},
+			Headers:      []parameter{userHeader, ifMatchHeader},
+		},
+		{
+			Method: http.MethodPatch, Path: "/preferences/devices/{id}", Summary: "Applies a JSON merge patch to the preferences of a device",
+			Handler:  h.PatchDevicePreferencesHandler,
+			Request:  []*content{mergePatchContent(data.DevicePreferences{})},
+			Response: jsonContent(data.DevicePreferences{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusPreconditionFailed),
+			Headers:  []parameter{userHeader, ifMatchHeader},
+		},
+		{
+			Method: http.MethodGet, Path: "/preferences/history", Summary: "Lists every change to the preferences, oldest first",
+			Handler:  h.HistoryHandler,
+			Query:    []parameter{{Name: "snapshots", Description: "Includes the preferences created by every change when true", Type: "boolean"}},
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(GetHistoryResponse{}),
+			Statuses: upstreamStatuses(http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodPost, Path: "/preferences/revert/{version}", Summary: "Restores the preferences of a previous version",
+			Handler:  h.RevertPreferencesHandler,
+			Headers:  []parameter{userHeader, ifMatchHeader},
+			Response: jsonContent(data.PreferencesImpl{}),
+			Statuses: upstreamStatuses(http.StatusNotFound, http.StatusInternalServerError, http.StatusPreconditionFailed),
+		},
+		{
+			Method: http.MethodGet, Path: "/preferences/export", Summary: "Exports the preferences and the uploaded icons they reference as a zip archive",
+			Handler:  h.ExportPreferencesHandler,
+			Headers:  []parameter{userHeader},
+			Response: &content{ContentType: "application/zip", Raw: map[string]any{"type": "string", "format": "binary"}},
+			Statuses: upstreamStatuses(http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodPost, Path: "/preferences/import", Summary: "Imports a zip archive created by the export api",
+			Handler: h.ImportPreferencesHandler,
+			Query:   []parameter{{Name: "dry_run", Description: "Only reports the result of the import when true", Type: "boolean"}},
+			Headers: []parameter{ifMatchHeader},
+			Request: []*content{
+				{ContentType: "application/zip", Raw: map[string]any{"type": "string", "format": "binary"}},
+				uploadContent(),
+			},
+			Response:     jsonContent(ImportReport{}),
+			Statuses:     []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusPreconditionFailed},
+			ErrorContent: map[int]*content{http.StatusBadRequest: jsonContent(ValidationErrorResponse{})},
+		},
+		{
+			Method: http.MethodGet, Path: "/views", Summary: "Lists the saved views of the user",
+			Handler:  h.GetViewsHandler,
+			Headers:  []parameter{userHeader},
+			Response: jsonContent(GetViewsResponse{}),
+		},
+		{
+			Method: http.MethodPut, Path: "/views/{name}", Summary: "Creates or replaces a saved view of the user",
+			Handler:      h.PutViewHandler,
+			Headers:      []parameter{userHeader, ifMatchHeader},
+			Request:      []*content{jsonContent(data.View{})},
+			Response:     jsonContent(data.View{}),
+			Statuses:     []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusPreconditionFailed},
+			ErrorContent: map[int]*content{http.StatusBadRequest: jsonContent(ValidationErrorResponse{})},
+		},
+		{
+			Method: http.MethodDelete, Path: "/views/{name}", Summary: "Deletes a saved view of the user",
+			Handler:  h.DeleteViewHandler,
+			Headers:  []parameter{userHeader, ifMatchHeader},
+			Success:  http.StatusNoContent,
+			Statuses: []int{http.StatusNotFound, http.StatusInternalServerError, http.StatusPreconditionFailed},
+		},
+		{
+			Method: http.MethodPost, Path: "/upload", Summary: "Uploads the icon of a device",
+			Handler:  h.Upload,
+			Query:    []parameter{{Name: "device_id", Description: "Id of the device", Type: "string"}},
+			Headers:  []parameter{userHeader},
+			Request:  []*content{uploadContent()},
+			Response: jsonContent(Response{}),
+			Statuses: upstreamStatuses(http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError),
+		},
+		{
+			Method: http.MethodGet, Path: "/images/{name...}", Summary: "Returns an uploaded image",
+			Handler:  ImageHandler,
+			Response: &content{ContentType: "image/*", Raw: map[string]any{"type": "string", "format": "binary"}},
+			Statuses: []int{http.StatusNotFound},
+		},
+		{
+			Method: http.MethodGet, Path: "/openapi.json", Summary: "Returns this OpenAPI specification",
+			Handler:  h.OpenApiHandler,
+			Response: &content{ContentType: "application/json", Raw: map[string]any{"type": "object"}},
+		},
+	}
+}
+
+// mergePatchContent returns the content of a json merge patch of the json body described by the type of value
+func mergePatchContent(value any) *content {
+	return &content{ContentType: "application/merge-patch+json", Schema: value, Patch: true}
+}
+
+// uploadContent returns the content of the multipart request used to upload an icon
+func uploadContent() *content {
+	return &content{ContentType: "multipart/form-data", Raw: map[string]any{
+		"type":     "object",
+		"required": []string{"file"},
+		"properties": map[string]any{
+			"file": map[string]any{"type": "string", "format": "binary"},
+		},
+	}}
+}
+
+// NewRouter creates the router which serves all the apis of the server. Requests with a method which is not
+// registered for the path are answered with 405 and an Allow header listing the registered methods. The json responses
+// are compressed when the client accepts it
+func NewRouter(h *Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{ApiPrefix, ""} {
+		for _, route := range h.routes() {
+			compressible := route.Response != nil && slices.Contains(compressedContentTypes, route.Response.ContentType)
+			mux.HandleFunc(route.Method+" "+prefix+route.Path, compress(route.Handler, compressible))
+		}
+	}
+	return mux
+}
@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"main/data"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SpatialCellDegrees is the size in degrees of the cells of the grid of the spatial index
+const SpatialCellDegrees = 0.1
+
+// metersPerDegree is the length in meters of a degree of latitude
+const metersPerDegree = EarthRadius * math.Pi / 180
+
+// DefaultNearestLimit is the number of devices returned by a nearest query without a limit
+const DefaultNearestLimit = 10
+
+// gridColumns is the number of columns of cells of the grid around the world, the cells of longitude -180 being in
+// column -gridColumns/2 and the cells of longitude 180 in column gridColumns/2
+var gridColumns = int(math.Round(360 / SpatialCellDegrees))
+
+// gridCell is a cell of the grid of the spatial index
+type gridCell struct {
+	x int
+	y int
+}
+
+// spatialIndex is a grid index of the locations of the latest points of the devices of a snapshot. Every cell of the
+// grid holds the ids of the devices located in it
+type spatialIndex struct {
+	cells map[gridCell][]string
+	// min and max are the corners of the cells holding devices
+	min gridCell
+	max gridCell
+}
+
+// cellOf returns the cell of the grid holding the location
+func cellOf(lat float64, lng float64) gridCell {
+	return gridCell{x: int(math.Floor(lng / SpatialCellDegrees)), y: int(math.Floor(lat / SpatialCellDegrees))}
+}
+
+// newSpatialIndex indexes the locations of the devices
+func newSpatialIndex(devices []Device) *spatialIndex {
+	index := &spatialIndex{cells: make(map[gridCell][]string)}
+	for _, device := range devices {
+		index.add(device.DeviceID, device.LatestDevicePoint.Lat, device.LatestDevicePoint.Lng)
+	}
+	return index
+}
+
+// add indexes the location of the id
+func (s *spatialIndex) add(id string, lat float64, lng float64) {
+	cell := cellOf(lat, lng)
+	if len(s.cells) == 0 {
+		s.min, s.max = cell, cell
+	}
+	s.cells[cell] = append(s.cells[cell], id)
+	s.min = gridCell{x: min(s.min.x, cell.x), y: min(s.min.y, cell.y)}
+	s.max = gridCell{x: max(s.max.x, cell.x), y: max(s.max.y, cell.y)}
+}
+
+// within returns the ids of the devices in the cells intersecting the [min lng, min lat, max lng, max lat] box. The
+// devices close to the edges of the box may be outside of it
+func (s *spatialIndex) within(bbox [4]float64) map[string]bool {
+	ids := make(map[string]bool)
+	from, to := cellOf(bbox[1], bbox[0]), cellOf(bbox[3], bbox[2])
+	from = gridCell{x: max(from.x, s.min.x), y: max(from.y, s.min.y)}
+	to = gridCell{x: min(to.x, s.max.x), y: min(to.y, s.max.y)}
+	for x := from.x; x <= to.x; x++ {
+		for y := from.y; y <= to.y; y++ {
+			for _, id := range s.cells[gridCell{x: x, y: y}] {
+				ids[id] = true
+			}
+		}
+	}
+	return ids
+}
+
+// radiusBoxes returns the [min lng, min lat, max lng, max lat] boxes holding the circle of radius meters around the
+// point. A circle crossing the antimeridian is held by a box on each side of it
+func radiusBoxes(lat float64, lng float64, radius float64) [][4]float64 {
+	dLat := radius / metersPerDegree
+	dLng := 180.0
+	if cos := math.Cos((math.Abs(lat) + dLat) * math.Pi / 180); math.Abs(lat)+dLat < 90 && cos > 0 {
+		dLng = min(180, dLat/cos)
+	}
+	minLat, maxLat := max(-90, lat-dLat), min(90, lat+dLat)
+	switch {
+	case dLng >= 180:
+		return [][4]float64{{-180, minLat, 180, maxLat}}
+	case lng-dLng < -180:
+		return [][4]float64{{-180, minLat, lng + dLng, maxLat}, {lng - dLng + 360, minLat, 180, maxLat}}
+	case lng+dLng > 180:
+		return [][4]float64{{lng - dLng, minLat, 180, maxLat}, {-180, minLat, lng + dLng - 360, maxLat}}
+	}
+	return [][4]float64{{lng - dLng, minLat, lng + dLng, maxLat}}
+}
+
+// nearest returns the ids of the devices accepted by accept in the rings of cells around the point which may hold the
+// limit devices nearest to it. The rings are searched outwards until the closest cell of the next ring is farther than
+// the limit-th nearest device found, so that every device nearer than it is returned. Once the rings span more cells
+// than the index holds, e.g. when the devices are spread over the world, every cell of the index is searched instead
+// since that is cheaper than searching the empty cells between the devices. The rings wrap around the antimeridian
+func (s *spatialIndex) nearest(lat float64, lng float64, limit int, accept func(id string) bool, distance func(id string) float64) map[string]bool {
+	ids := make(map[string]bool)
+	if len(s.cells) == 0 {
+		return ids
+	}
+	var distances []float64
+	add := func(cell gridCell) {
+		for _, id := range s.cells[cell] {
+			if !ids[id] && accept(id) {
+				ids[id] = true
+				distances = append(distances, distance(id))
+			}
+		}
+	}
+	// addColumn adds the cell of the column wrapped around the antimeridian. Longitudes -180 and 180 are the same
+	// meridian, so the cells of both are added
+	addColumn := func(x int, y int) {
+		x = ((x+gridColumns/2)%gridColumns+gridColumns)%gridColumns - gridColumns/2
+		add(gridCell{x: x, y: y})
+		if x == -gridColumns/2 {
+			add(gridCell{x: gridColumns / 2, y: y})
+		}
+	}
+	center := cellOf(lat, lng)
+	rings := max(center.x-s.min.x, s.max.x-center.x, center.y-s.min.y, s.max.y-center.y)
+	for ring := 0; ring <= rings; ring++ {
+		if len(distances) >= limit && ringDistance(lat, ring) > distances[limit-1] {
+			break
+		}
+		if side := 2*ring + 1; side*side > len(s.cells) {
+			for cell := range s.cells {
+				add(cell)
+			}
+			break
+		}
+		// Visiting the cells on the border of the ring, the rows are limited to the rows holding devices while the
+		// columns wrap around the antimeridian
+		for x := center.x - ring; x <= center.x+ring; x++ {
+			addColumn(x, center.y-ring)
+			if ring > 0 {
+				addColumn(x, center.y+ring)
+			}
+		}
+		for y := max(center.y-ring+1, s.min.y); y <= min(center.y+ring-1, s.max.y); y++ {
+			addColumn(center.x-ring, y)
+			addColumn(center.x+ring, y)
+		}
+		slices.Sort(distances)
+	}
+	return ids
+}
+
+// ringDistance returns a lower bound of the distance in meters from a point at the latitude to the cells of the ring.
+// A location in the ring differs from the point by more than ring-1 cells in latitude or in longitude, and a degree of
+// longitude shrinks towards the poles
+func ringDistance(lat float64, ring int) float64 {
+	if ring <= 1 {
+		return 0
+	}
+	degrees := float64(ring-1) * SpatialCellDegrees
+	farthest := math.Min(90, math.Abs(lat)+float64(ring+1)*SpatialCellDegrees)
+	return degrees * metersPerDegree * math.Cos(farthest*math.Pi/180)
+}
+
+// spatialQuery holds the spatial query params of the devices api. Box limits the devices to a bounding box, Radius to
+// the circle around Center and Limit to the devices nearest to Center
+type spatialQuery struct {
+	Box    *[4]float64
+	Center *[2]float64
+	Radius float64
+	Limit  int
+}
+
+// parseCoordinates parses the comma separated numbers of a query param
+func parseCoordinates(value string, count int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != count {
+		return nil, errors.New("invalid coordinates")
+	}
+	numbers := make([]float64, count)
+	for idx, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, errors.New("invalid coordinates")
+		}
+		numbers[idx] = number
+	}
+	return numbers, nil
+}
+
+// parsePoint parses a lat,lng query param
+func parsePoint(value string) (*[2]float64, error) {
+	numbers, err := parseCoordinates(value, 2)
+	if err != nil || math.Abs(numbers[0]) > 90 || math.Abs(numbers[1]) > 180 {
+		return nil, errors.New("invalid point")
+	}
+	return &[2]float64{numbers[0], numbers[1]}, nil
+}
+
+// parseSpatialQuery parses the bbox, near, radius_m, nearest and limit query params. Returns nil when the request has
+// no spatial query params
+func parseSpatialQuery(query url.Values) (*spatialQuery, error) {
+	if !query.Has("bbox") && !query.Has("near") && !query.Has("nearest") {
+		return nil, nil
+	}
+	var spatial spatialQuery
+	if query.Has("bbox") {
+		numbers, err := parseCoordinates(query.Get("bbox"), 4)
+		if err != nil || numbers[0] > numbers[2] || numbers[1] > numbers[3] || math.Abs(numbers[1]) > 90 || math.Abs(numbers[3]) > 90 {
+			return nil, errors.New("bbox must be min lng,min lat,max lng,max lat")
+		}
+		spatial.Box = &[4]float64{numbers[0], numbers[1], numbers[2], numbers[3]}
+	}
+	if query.Has("near") && query.Has("nearest") {
+		return nil, errors.New("near and nearest cannot be combined")
+	}
+	if query.Has("near") {
+		center, err := parsePoint(query.Get("near"))
+		if err != nil {
+			return nil, errors.New("near must be lat,lng")
+		}
+		spatial.Center = center
+		spatial.Radius, err = strconv.ParseFloat(query.Get("radius_m"), 64)
+		if err != nil || spatial.Radius <= 0 || math.IsInf(spatial.Radius, 0) {
+			return nil, errors.New("radius_m must be a positive number of meters")
+		}
+	}
+	if query.Has("nearest") {
+		center, err := parsePoint(query.Get("nearest"))
+		if err != nil {
+			return nil, errors.New("nearest must be lat,lng")
+		}
+		spatial.Center = center
+		spatial.Limit = DefaultNearestLimit
+		if query.Has("limit") {
+			spatial.Limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || spatial.Limit < 1 || spatial.Limit > data.MaxNumberOfRows {
+				return nil, fmt.Errorf("limit must be between 1 and %d", data.MaxNumberOfRows)
+			}
+		}
+	}
+	return &spatial, nil
+}
+
+// insideBox returns true when the device is located inside the [min lng, min lat, max lng, max lat] box
+func insideBox(device Device, box [4]float64) bool {
+	point := device.LatestDevicePoint
+	return point.Lng >= box[0] && point.Lat >= box[1] && point.Lng <= box[2] && point.Lat <= box[3]
+}
+
+// apply returns the devices matching the spatial query, using the index of the snapshot to skip the devices which are
+// far from the queried area. The devices hold their distance to the center of the query, and the devices nearest to
+// the center are sorted by distance first and limited to the limit of the query. Returns the keys the devices are
+// sorted by
+func (q *spatialQuery) apply(index *spatialIndex, devices []Device, keys []data.SortKey) ([]Device, []data.SortKey) {
+	candidates := make(map[string]bool)
+	switch {
+	case q.Center != nil && q.Radius > 0:
+		for _, box := range radiusBoxes(q.Center[0], q.Center[1], q.Radius) {
+			for id := range index.within(box) {
+				candidates[id] = true
+			}
+		}
+	case q.Center != nil:
+		// Searching the nearest devices among the selected devices only, so that hidden and filtered devices do not
+		// take the place of selected ones
+		selected := make(map[string]Device, len(devices))
+		for _, device := range devices {
+			if q.Box == nil || insideBox(device, *q.Box) {
+				selected[device.DeviceID] = device
+			}
+		}
+		accept := func(id string) bool {
+			_, ok := selected[id]
+			return ok
+		}
+		distance := func(id string) float64 {
+			point := selected[id].LatestDevicePoint
+			return haversine(q.Center[0], q.Center[1], point.Lat, point.Lng)
+		}
+		candidates = index.nearest(q.Center[0], q.Center[1], q.Limit, accept, distance)
+	case q.Box != nil:
+		candidates = index.within(*q.Box)
+	}
+	matched := make([]Device, 0)
+	for _, device := range devices {
+		if !candidates[device.DeviceID] || (q.Box != nil && !insideBox(device, *q.Box)) {
+			continue
+		}
+		if q.Center != nil {
+			distance := haversine(q.Center[0], q.Center[1], device.LatestDevicePoint.Lat, device.LatestDevicePoint.Lng)
+			if q.Radius > 0 && distance > q.Radius {
+				continue
+			}
+			device.Distance = &distance
+		}
+		matched = append(matched, device)
+	}
+	if q.Center == nil {
+		return matched, keys
+	}
+	// Sorting the devices again since they were sorted before their distance was known
+	if q.Limit > 0 {
+		keys = orderKeys(append([]data.SortKey{{Column: "distance", Ascending: true}}, keys...))
+	}
+	matched = sortDevicesBy(matched, keys)
+	if q.Limit > 0 {
+		matched = matched[:min(len(matched), q.Limit)]
+	}
+	return matched, keys
+}
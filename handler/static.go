@@ -1,19 +1,88 @@
 package handler
 
-import "net/http"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ImmutableMaxAge is the number of seconds for which clients cache the content addressed images
+const ImmutableMaxAge = 365 * 24 * 60 * 60
+
+// contentAddressedImage matches the names of the uploaded images which end with the hash of their content, so that the
+// content of such a name never changes
+var contentAddressedImage = regexp.MustCompile(`-([0-9a-f]{16})\.\w+$`)
+
+// isFileName returns true when the name can be part of the name of a file of the images directory, i.e. it can not
+// refer to another directory
+func isFileName(name string) bool {
+	return name != "" && !strings.Contains(name, "..") && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// contentAddressedName returns the name of an uploaded image holding the hash of the image content
+func contentAddressedName(name string, extension string, content io.Reader) (string, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, content)
+	if err != nil {
+		return "", err
+	}
+	return name + "-" + hex.EncodeToString(hash.Sum(nil))[:16] + extension, nil
+}
+
+// serveImage serves the image file with cache headers. Content addressed images are cached by clients without
+// revalidation when immutable is true, other images are revalidated with their ETag or modification time
+func serveImage(w http.ResponseWriter, r *http.Request, filePath string, immutable bool) {
+	if match := contentAddressedImage.FindStringSubmatch(filePath); match != nil && immutable {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", ImmutableMaxAge))
+		w.Header().Set("ETag", `"`+match[1]+`"`)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+		if info, err := os.Stat(filePath); err == nil {
+			w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+		}
+	}
+	// http.ServeFile answers If-None-Match with the ETag and If-Modified-Since with the modification time of the file
+	http.ServeFile(w, r, filePath)
+}
 
 // ImageHandler is the method used to handle get request for images
 func ImageHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		// Get the image file name from the URL
-		imgName := r.URL.Path[len("/images/"):]
-		// Construct the file path to the image
-		filePath := "images/" + imgName
-
-		// Serve the image file using http.ServeFile()
-		http.ServeFile(w, r, filePath)
-	} else {
-		// Handling error for other http methods
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	// Get the image file name from the URL
+	imgName := r.PathValue("name")
+	// Construct the file path to the image
+	filePath := "images/" + imgName
+
+	serveImage(w, r, filePath, true)
+}
+
+// DeviceIconHandler is the method used to handle get request for the icon of a device. Uploaded icons are served
+// from the images directory, other icons are redirected to their url. The icons of the devices of accounts the user
+// cannot see are not found
+func (h *Handler) DeviceIconHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	deviceId := r.PathValue("id")
+	visible, err := h.canSeeDevice(r, deviceId)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if !visible {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
+	}
+	image := DefaultImagePath
+	if devicePreferences := h.devicePreferences(Device{DeviceID: deviceId}); devicePreferences.Image != "" {
+		image = devicePreferences.Image
+	}
+	if strings.HasPrefix(image, "/images/") {
+		// The icon of the device changes when a new icon is uploaded, so the icon is revalidated
+		serveImage(w, r, strings.TrimPrefix(image, "/"), false)
+		return
 	}
+	http.Redirect(w, r, image, http.StatusFound)
 }
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/json"
+	"main/data"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// StationaryRadius is the distance in meters within which a device is considered stationary, so that the drift of
+// its gps does not end a stop
+const StationaryRadius = 50
+
+// Kinds of a Stop
+const (
+	StopKindIdle = "idle"
+	StopKindStop = "stop"
+)
+
+// Stop is a period during which a device stayed at the same location for longer than the threshold of its groups.
+// The kind is idle when the drive status of the device was on, the engine running, and stop when it was parked. An
+// ongoing stop ends at the time of the request
+type Stop struct {
+	DeviceID    string    `json:"device_id"`
+	DisplayName string    `json:"display_name"`
+	Kind        string    `json:"kind"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Lat         float64   `json:"lat"`
+	Lng         float64   `json:"lng"`
+	Duration    int64     `json:"duration_s"`
+	Ongoing     bool      `json:"ongoing"`
+	Address     *Address  `json:"address,omitempty"`
+}
+
+// GetStopsResponse structure representing the data for the get api of the stops
+type GetStopsResponse struct {
+	Stops []Stop `json:"stops"`
+}
+
+// stationaryPeriods splits the recorded positions of a device into the periods during which the device stayed within
+// StationaryRadius of the first position of the period with the same engine state. The last period is ongoing and
+// ends at now
+func stationaryPeriods(positions []Position, now time.Time) []Stop {
+	var periods []Stop
+	for start := 0; start < len(positions); {
+		anchor := positions[start]
+		end := start + 1
+		for end < len(positions) && driving(positions[end]) == driving(anchor) &&
+			haversine(anchor.Lat, anchor.Lng, positions[end].Lat, positions[end].Lng) <= StationaryRadius {
+			end++
+		}
+		period := Stop{Kind: StopKindStop, Start: anchor.Time, End: now, Lat: anchor.Lat, Lng: anchor.Lng, Ongoing: end == len(positions)}
+		if driving(anchor) {
+			period.Kind = StopKindIdle
+		}
+		if !period.Ongoing {
+			period.End = positions[end].Time
+		}
+		period.Duration = int64(max(period.End.Sub(period.Start), 0).Seconds())
+		periods = append(periods, period)
+		start = end
+	}
+	return periods
+}
+
+// exceeds returns true when the stop lasted longer than the threshold of its kind
+func (s Stop) exceeds(thresholds data.Thresholds) bool {
+	duration := time.Duration(s.Duration) * time.Second
+	if s.Kind == StopKindIdle {
+		return duration >= thresholds.Idle()
+	}
+	return duration >= thresholds.Stop()
+}
+
+// deviceStops returns the stationary periods of the device which exceed its thresholds, oldest first
+func (h *Handler) deviceStops(deviceId string, thresholds data.Thresholds, now time.Time) []Stop {
+	var stops []Stop
+	for _, period := range stationaryPeriods(h.positions.get(deviceId), now) {
+		if period.exceeds(thresholds) {
+			period.DeviceID = deviceId
+			stops = append(stops, period)
+		}
+	}
+	return stops
+}
+
+// idleDuration returns the number of seconds the device has been idling at its current location, or nil when the
+// device is not idling or the idle threshold of its groups is not exceeded yet
+func (h *Handler) idleDuration(deviceId string, thresholds data.Thresholds, now time.Time) *int64 {
+	periods := stationaryPeriods(h.positions.get(deviceId), now)
+	if len(periods) == 0 {
+		return nil
+	}
+	current := periods[len(periods)-1]
+	if current.Kind != StopKindIdle || !current.exceeds(thresholds) {
+		return nil
+	}
+	return &current.Duration
+}
+
+// annotateIdle sets the idle duration of the devices according to the thresholds of their groups
+func (h *Handler) annotateIdle(devices []Device, preferences data.Preferences, groups map[string][]string, now time.Time) {
+	for idx := range devices {
+		thresholds := data.DeviceThresholds(preferences, groups[devices[idx].DeviceID])
+		devices[idx].IdleDuration = h.idleDuration(devices[idx].DeviceID, thresholds, now)
+	}
+}
+
+// StopsHandler is the handler function for the get request of the stops report. Lists the idle and parked periods of
+// the devices which are not hidden exceeding the thresholds of their groups, sorted by their start. The stops are
+// limited to the from and to query params, and to a kind by the kind query param
+func (h *Handler) StopsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	from, to, ok := parseTimeRange(r)
+	if !ok {
+		http.Error(w, "From and to must be RFC 3339 times, with from before to", http.StatusBadRequest)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && kind != StopKindIdle && kind != StopKindStop {
+		http.Error(w, "Kind must be one of idle, stop", http.StatusBadRequest)
+		return
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	now := time.Now()
+	stops := make([]Stop, 0)
+	h.Preferences.Read(func(preferences data.Preferences) {
+		groups := deviceGroups(preferences)
+		for _, device := range uniqueDevices(visibleDevices(h.accountDevices(r, devices), preferences)) {
+			thresholds := data.DeviceThresholds(preferences, groups[device.DeviceID])
+			for _, stop := range h.deviceStops(device.DeviceID, thresholds, now) {
+				if (kind != "" && stop.Kind != kind) || (!from.IsZero() && stop.End.Before(from)) || (!to.IsZero() && stop.Start.After(to)) {
+					continue
+				}
+				stop.DisplayName = device.DisplayName
+				stop.Address = h.geocoder.resolve(stop.Lat, stop.Lng)
+				stops = append(stops, stop)
+			}
+		}
+	})
+	slices.SortStableFunc(stops, func(a Stop, b Stop) int {
+		return a.Start.Compare(b.Start)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetStopsResponse{Stops: stops})
+}
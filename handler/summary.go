@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"main/data"
+	"math"
+	"net/http"
+	"slices"
+)
+
+// SummaryPoint is the location of the centroid of the devices
+type SummaryPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// DevicesSummary structure representing the data for the get api of the summary of the devices. The devices are
+// counted by active state, drive status, group and tag. BoundingBox is the [min lng, min lat, max lng, max lat] box
+// holding the devices, in the order of GeoJSON, and Centroid the mean of their locations. A box crossing the
+// antimeridian has a min lng greater than its max lng, as in GeoJSON. Devices without a location are left out of both,
+// which are omitted when no device has a location
+type DevicesSummary struct {
+	Total       int            `json:"total"`
+	Online      int            `json:"online"`
+	Offline     int            `json:"offline"`
+	ActiveState map[string]int `json:"active_state"`
+	DriveStatus map[string]int `json:"drive_status"`
+	Groups      map[string]int `json:"groups"`
+	Tags        map[string]int `json:"tags"`
+	BoundingBox []float64      `json:"bbox,omitempty"`
+	Centroid    *SummaryPoint  `json:"centroid,omitempty"`
+}
+
+// deviceTags returns the tags of every device which has tags
+func deviceTags(preferences data.Preferences) map[string][]string {
+	tags := make(map[string][]string)
+	for _, devicePreference := range preferences.GetDevicePreferences() {
+		if len(devicePreference.Tags) > 0 {
+			tags[devicePreference.DeviceID] = devicePreference.Tags
+		}
+	}
+	return tags
+}
+
+// located returns true when the latest point of the device has a location. One step reports 0,0 for the devices
+// which have not reported a location yet
+func located(device Device) bool {
+	return device.LatestDevicePoint.Lat != 0 || device.LatestDevicePoint.Lng != 0
+}
+
+// longitudeSpan returns the west and east bounds of the smallest range of longitudes holding the sorted longitudes,
+// which crosses the antimeridian when west is greater than east
+func longitudeSpan(lngs []float64) (float64, float64) {
+	west, east := lngs[0], lngs[len(lngs)-1]
+	gap := west + 360 - east
+	for idx := 1; idx < len(lngs); idx++ {
+		if lngs[idx]-lngs[idx-1] > gap {
+			gap = lngs[idx] - lngs[idx-1]
+			west, east = lngs[idx], lngs[idx-1]
+		}
+	}
+	return west, east
+}
+
+// summarizeDevices counts the devices and computes their bounding box and centroid. A device listed more than once is
+// counted once. The longitude of the centroid is the mean of the directions of the longitudes, so that devices on
+// both sides of the antimeridian are centered on it instead of on the prime meridian
+func summarizeDevices(devices []Device, groups map[string][]string, tags map[string][]string) DevicesSummary {
+	summary := DevicesSummary{
+		ActiveState: make(map[string]int),
+		DriveStatus: make(map[string]int),
+		Groups:      make(map[string]int),
+		Tags:        make(map[string]int),
+	}
+	var lat, sin, cos float64
+	var lngs []float64
+	for _, device := range uniqueDevices(devices) {
+		summary.Total++
+		if device.Online {
+			summary.Online++
+		} else {
+			summary.Offline++
+		}
+		summary.ActiveState[device.ActiveState]++
+		summary.DriveStatus[device.LatestDevicePoint.DeviceStatus.DriveStatus]++
+		for _, group := range groups[device.DeviceID] {
+			summary.Groups[group]++
+		}
+		for _, tag := range tags[device.DeviceID] {
+			summary.Tags[tag]++
+		}
+		if !located(device) {
+			continue
+		}
+		point := device.LatestDevicePoint
+		if summary.BoundingBox == nil {
+			summary.BoundingBox = []float64{point.Lng, point.Lat, point.Lng, point.Lat}
+		}
+		summary.BoundingBox[1] = min(summary.BoundingBox[1], point.Lat)
+		summary.BoundingBox[3] = max(summary.BoundingBox[3], point.Lat)
+		lngs = append(lngs, point.Lng)
+		lat += point.Lat
+		sin += math.Sin(point.Lng * math.Pi / 180)
+		cos += math.Cos(point.Lng * math.Pi / 180)
+	}
+	if len(lngs) > 0 {
+		slices.Sort(lngs)
+		summary.BoundingBox[0], summary.BoundingBox[2] = longitudeSpan(lngs)
+		summary.Centroid = &SummaryPoint{Lat: lat / float64(len(lngs)), Lng: math.Atan2(sin, cos) * 180 / math.Pi}
+	}
+	return summary
+}
+
+// DevicesSummaryHandler is the handler function for the get request of the summary of the devices. The devices are
+// selected like in the devices api, by the device preferences and the view of the view query param or the default view
+// of the user, so that the summary holds all the devices of the list regardless of its pages
+func (h *Handler) DevicesSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	snapshot, err := h.cachedSnapshot(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	h.writeFailedAccounts(w, r, snapshot)
+	selection, err := h.selectDevices(r, snapshot.devices)
+	if err != nil {
+		http.Error(w, "View does not exist", http.StatusNotFound)
+		return
+	}
+	var tags map[string][]string
+	h.Preferences.Read(func(preferences data.Preferences) {
+		tags = deviceTags(preferences)
+	})
+	serveJSON(w, r, summarizeDevices(selection.devices, selection.groups, tags), latest(snapshot.fetchedAt, selection.modified))
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"encoding/json"
+	"main/data"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MaxTrips is the number of completed trips kept for a device, older trips are dropped
+const MaxTrips = 1000
+
+// EarthRadius is the mean radius of the earth in meters
+const EarthRadius = 6371008.8
+
+// TripPoint is the time and location of the start or the end of a trip
+type TripPoint struct {
+	Time    time.Time `json:"time"`
+	Lat     float64   `json:"lat"`
+	Lng     float64   `json:"lng"`
+	Address *Address  `json:"address,omitempty"`
+}
+
+// Trip is a drive of a device, from the position where its drive status changed from off to the position where it
+// changed back to off. Distance is the distance in meters travelled between the recorded positions of the trip and
+// MaxSpeed the highest speed in km/h reported by the device, or computed between the positions when the device does not
+// report its speed. An ongoing trip ends at the last recorded position
+type Trip struct {
+	DeviceID    string    `json:"device_id"`
+	DisplayName string    `json:"display_name"`
+	Start       TripPoint `json:"start"`
+	End         TripPoint `json:"end"`
+	Distance    float64   `json:"distance_m"`
+	Duration    int64     `json:"duration_s"`
+	MaxSpeed    *float64  `json:"max_speed,omitempty"`
+	Ongoing     bool      `json:"ongoing"`
+}
+
+// GetTripsResponse structure representing the data for the get apis of the trips
+type GetTripsResponse struct {
+	Trips []Trip `json:"trips"`
+}
+
+// openTrip is the ongoing trip of a device along with the speeds computed between its positions
+type openTrip struct {
+	trip          Trip
+	last          Position
+	computedSpeed float64
+}
+
+// tripRecorder segments the recorded positions of the devices into trips
+type tripRecorder struct {
+	mutex sync.RWMutex
+	open  map[string]*openTrip
+	trips map[string][]Trip
+}
+
+// newTripRecorder creates a trip recorder without trips
+func newTripRecorder() *tripRecorder {
+	return &tripRecorder{open: make(map[string]*openTrip), trips: make(map[string][]Trip)}
+}
+
+// driving returns true when the drive status of the position shows that the device is on a trip. Statuses such as idle
+// are part of the trip, since the engine of the device is running
+func driving(position Position) bool {
+	return position.DriveStatus != "" && position.DriveStatus != "off"
+}
+
+// haversine returns the great circle distance in meters between the two points
+func haversine(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	toRadians := math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLng := (lng2 - lng1) * toRadians
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// record adds the positions recorded for the devices to their trips. A trip starts at the first position where the
+// device is driving and ends at the first following position where it is not
+func (t *tripRecorder) record(positions map[string]Position) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for deviceId, position := range positions {
+		open := t.open[deviceId]
+		if open == nil {
+			if driving(position) {
+				point := TripPoint{Time: position.Time, Lat: position.Lat, Lng: position.Lng}
+				t.open[deviceId] = &openTrip{trip: Trip{DeviceID: deviceId, Start: point, End: point, Ongoing: true}, last: position}
+				if position.Speed != nil {
+					speed := *position.Speed
+					t.open[deviceId].trip.MaxSpeed = &speed
+				}
+			}
+			continue
+		}
+		distance := haversine(open.last.Lat, open.last.Lng, position.Lat, position.Lng)
+		open.trip.Distance += distance
+		if seconds := position.Time.Sub(open.last.Time).Seconds(); seconds > 0 {
+			open.computedSpeed = max(open.computedSpeed, distance/seconds*3.6)
+		}
+		if position.Speed != nil && (open.trip.MaxSpeed == nil || *position.Speed > *open.trip.MaxSpeed) {
+			speed := *position.Speed
+			open.trip.MaxSpeed = &speed
+		}
+		open.trip.End = TripPoint{Time: position.Time, Lat: position.Lat, Lng: position.Lng}
+		open.last = position
+		if driving(position) {
+			continue
+		}
+		trips := t.trips[deviceId]
+		if len(trips) >= MaxTrips {
+			trips = trips[len(trips)-MaxTrips+1:]
+		}
+		t.trips[deviceId] = append(trips, open.finish(false))
+		delete(t.open, deviceId)
+	}
+}
+
+// finish returns the trip with its duration and the computed max speed when the device did not report its speed
+func (o *openTrip) finish(ongoing bool) Trip {
+	trip := o.trip
+	trip.Ongoing = ongoing
+	trip.Duration = int64(trip.End.Time.Sub(trip.Start.Time).Seconds())
+	if trip.MaxSpeed == nil && trip.Duration > 0 {
+		speed := o.computedSpeed
+		trip.MaxSpeed = &speed
+	}
+	return trip
+}
+
+// get returns the trips of the device which overlap the from and to times, oldest first. A zero time does not limit
+// the trips. The ongoing trip of the device is returned last
+func (t *tripRecorder) get(deviceId string, from time.Time, to time.Time) []Trip {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	trips := append([]Trip(nil), t.trips[deviceId]...)
+	if open := t.open[deviceId]; open != nil {
+		trips = append(trips, open.finish(true))
+	}
+	return slices.DeleteFunc(trips, func(trip Trip) bool {
+		return (!from.IsZero() && trip.End.Time.Before(from)) || (!to.IsZero() && trip.Start.Time.After(to))
+	})
+}
+
+// parseTimeRange parses the from and to query params, which are RFC 3339 times. A missing param is a zero time
+func parseTimeRange(r *http.Request) (time.Time, time.Time, bool) {
+	var times [2]time.Time
+	for idx, name := range []string{"from", "to"} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		times[idx] = parsed
+	}
+	if !times[0].IsZero() && !times[1].IsZero() && times[1].Before(times[0]) {
+		return time.Time{}, time.Time{}, false
+	}
+	return times[0], times[1], true
+}
+
+// DeviceTripsHandler is the handler function for the get request of the trips of a device. The device id is read from
+// the path and the trips are limited to the from and to query params
+func (h *Handler) DeviceTripsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	from, to, ok := parseTimeRange(r)
+	if !ok {
+		http.Error(w, "From and to must be RFC 3339 times, with from before to", http.StatusBadRequest)
+		return
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	deviceId := r.PathValue("id")
+	for _, device := range h.accountDevices(r, devices) {
+		if device.DeviceID != deviceId {
+			continue
+		}
+		trips := h.trips.get(deviceId, from, to)
+		for idx := range trips {
+			trips[idx].DisplayName = device.DisplayName
+			h.geocoder.annotateTrip(&trips[idx])
+		}
+		serveTrips(w, trips)
+		return
+	}
+	http.Error(w, "Device does not exist", http.StatusNotFound)
+}
+
+// TripsHandler is the handler function for the get request of the trips of the fleet. The trips of the devices which
+// are not hidden are limited to the from and to query params and sorted by their start
+func (h *Handler) TripsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	from, to, ok := parseTimeRange(r)
+	if !ok {
+		http.Error(w, "From and to must be RFC 3339 times, with from before to", http.StatusBadRequest)
+		return
+	}
+	devices, _, err := h.cachedDevices(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	h.Preferences.Read(func(preferences data.Preferences) {
+		devices = visibleDevices(h.accountDevices(r, devices), preferences)
+	})
+	trips := make([]Trip, 0)
+	for _, device := range uniqueDevices(devices) {
+		for _, trip := range h.trips.get(device.DeviceID, from, to) {
+			trip.DisplayName = device.DisplayName
+			h.geocoder.annotateTrip(&trip)
+			trips = append(trips, trip)
+		}
+	}
+	slices.SortStableFunc(trips, func(a Trip, b Trip) int {
+		return a.Start.Time.Compare(b.Start.Time)
+	})
+	serveTrips(w, trips)
+}
+
+// serveTrips writes the trips as json
+func serveTrips(w http.ResponseWriter, trips []Trip) {
+	if trips == nil {
+		trips = make([]Trip, 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetTripsResponse{Trips: trips})
+}
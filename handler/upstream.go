@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default settings of the UpstreamClient
+const (
+	// DefaultUpstreamAttempts is the number of times a request to the one step api is sent before giving up
+	DefaultUpstreamAttempts = 3
+	// DefaultUpstreamTimeout is the time after which a single request to the one step api is cancelled
+	DefaultUpstreamTimeout = 10 * time.Second
+	// DefaultUpstreamBackoff is the wait before the first retry, which doubles for every following retry up to
+	// DefaultUpstreamMaxBackoff
+	DefaultUpstreamBackoff    = 200 * time.Millisecond
+	DefaultUpstreamMaxBackoff = 5 * time.Second
+	// DefaultBreakerThreshold is the number of consecutive failed fetches which open the circuit breaker
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is the time for which the circuit breaker stays open before a fetch is tried again
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrUpstreamUnavailable is returned without calling the one step api while the circuit breaker is open
+var ErrUpstreamUnavailable = errors.New("one step api is unavailable")
+
+// UpstreamError is the error of a failed fetch from the one step api. StatusCode is the status of the last response,
+// 0 when no response was received. RetryAfter is the time after which the one step api can be called again, 0 when
+// it is unknown
+type UpstreamError struct {
+	Account    string
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	api := "one step api"
+	if e.Account != "" {
+		api += " of account " + e.Account
+	}
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s responded with status %d", api, e.StatusCode)
+	}
+	return api + " request failed: " + e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// retryable returns true when the request may succeed when sent again. Responses other than 429 and 5xx are caused by
+// the request itself, e.g. a wrong api key, so they are not retried
+func (e *UpstreamError) retryable() bool {
+	return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// UpstreamClient fetches the devices from the one step api. Failed requests are retried with an exponential backoff
+// and a random jitter, so that the clients of a recovering api do not retry at the same time. A circuit breaker fails
+// fast once BreakerThreshold fetches failed in a row, and lets a single fetch through after the cooldown to
+// find out whether the api recovered
+type UpstreamClient struct {
+	// Account is the name of the one step account of the api key
+	Account string
+	// URL is the url of the devices api of one step including the api key
+	URL              string
+	Attempts         int
+	Timeout          time.Duration
+	Backoff          time.Duration
+	MaxBackoff       time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	httpClient *http.Client
+	mutex      sync.Mutex
+	// failures is the number of consecutive failed fetches, openUntil the time until which the breaker is open and
+	// probing is true while the single fetch after the cooldown is running
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewUpstreamClient creates a client fetching the devices of the account of the API_KEY environment variable with the
+// default settings
+func NewUpstreamClient(client *http.Client) *UpstreamClient {
+	return &UpstreamClient{
+		URL:              fmt.Sprintf(OneStepDeviceApiUrl, os.Getenv("API_KEY")),
+		Attempts:         DefaultUpstreamAttempts,
+		Timeout:          DefaultUpstreamTimeout,
+		Backoff:          DefaultUpstreamBackoff,
+		MaxBackoff:       DefaultUpstreamMaxBackoff,
+		BreakerThreshold: DefaultBreakerThreshold,
+		BreakerCooldown:  DefaultBreakerCooldown,
+		httpClient:       client,
+	}
+}
+
+// FetchDevices fetches the devices from the one step api, retrying the failed requests. Returns ErrUpstreamUnavailable
+// wrapped in an *UpstreamError while the circuit breaker is open, otherwise the *UpstreamError of the last request
+func (u *UpstreamClient) FetchDevices(ctx context.Context) ([]Device, error) {
+	devices, err := u.fetchDevices(ctx)
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		upstreamErr.Account = u.Account
+	}
+	return devices, err
+}
+
+// fetchDevices fetches the devices like FetchDevices
+func (u *UpstreamClient) fetchDevices(ctx context.Context) ([]Device, error) {
+	req, err := http.NewRequest(http.MethodGet, u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = u.allow()
+	if err != nil {
+		return nil, err
+	}
+	var upstreamErr *UpstreamError
+	for attempt := 1; attempt <= max(u.Attempts, 1); attempt++ {
+		if attempt > 1 {
+			wait := u.backoff(attempt - 1)
+			if upstreamErr.RetryAfter > u.MaxBackoff {
+				// The api asked for a longer wait than a request should be held for
+				break
+			}
+			wait = max(wait, upstreamErr.RetryAfter)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				u.release()
+				return nil, &UpstreamError{Err: ctx.Err()}
+			case <-timer.C:
+			}
+		}
+		var devices []Device
+		devices, upstreamErr = u.fetch(ctx, req)
+		if upstreamErr == nil {
+			u.done(true)
+			return devices, nil
+		}
+		if ctx.Err() != nil {
+			// The request of the client was cancelled, which does not tell whether the api is down
+			u.release()
+			return nil, upstreamErr
+		}
+		if !upstreamErr.retryable() {
+			break
+		}
+	}
+	// A response to a bad request still shows that the api is up
+	u.done(!upstreamErr.retryable())
+	return nil, upstreamErr
+}
+
+// fetch sends a single request to the one step api
+func (u *UpstreamClient) fetch(ctx context.Context, req *http.Request) ([]Device, *UpstreamError) {
+	ctx, cancel := context.WithTimeout(ctx, u.Timeout)
+	defer cancel()
+	res, err := u.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &UpstreamError{Err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// The body is drained so that the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+		return nil, &UpstreamError{StatusCode: res.StatusCode, RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+	var resultList ApiResponse
+	// Decoding the response and deserializing into the resultList object. A truncated body is retried
+	err = json.NewDecoder(res.Body).Decode(&resultList)
+	if err != nil {
+		return nil, &UpstreamError{Err: err}
+	}
+	return resultList.Devices, nil
+}
+
+// backoff returns the wait before the retry, which doubles with every retry up to MaxBackoff. The wait is a random
+// duration between half and all of it
+func (u *UpstreamClient) backoff(retry int) time.Duration {
+	wait := u.MaxBackoff
+	if retry < 32 {
+		wait = min(u.Backoff<<(retry-1), u.MaxBackoff)
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// allow returns an error while the circuit breaker is open. Once the cooldown passed a single fetch is allowed until
+// it completes
+func (u *UpstreamClient) allow() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.failures < max(u.BreakerThreshold, 1) {
+		return nil
+	}
+	if wait := time.Until(u.openUntil); wait > 0 || u.probing {
+		return &UpstreamError{RetryAfter: max(wait, 0), Err: ErrUpstreamUnavailable}
+	}
+	u.probing = true
+	return nil
+}
+
+// done records the result of a fetch. The breaker opens for BreakerCooldown when the fetch failed BreakerThreshold
+// times in a row, and closes when a fetch succeeds
+func (u *UpstreamClient) done(success bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.probing = false
+	if success {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if u.failures >= max(u.BreakerThreshold, 1) {
+		u.openUntil = time.Now().Add(u.BreakerCooldown)
+	}
+}
+
+// release ends a fetch without recording its result
+func (u *UpstreamClient) release() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.probing = false
+}
+
+// parseRetryAfter parses the Retry-After header holding either a number of seconds or a date. Returns 0 when the
+// header is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// writeUpstreamError writes the error of a failed fetch from the one step api. The error itself is logged instead of
+// being sent to the client. A one step api which is down or rate limited is answered with 503 and a Retry-After header
+// when the wait is known, a timed out request with 504 and other failures with 502
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Error occurred while fetching the devices: " + err.Error())
+	switch {
+	case errors.Is(err, ErrUpstreamUnavailable) || upstreamErr.StatusCode == http.StatusTooManyRequests ||
+		upstreamErr.StatusCode == http.StatusServiceUnavailable:
+		if upstreamErr.RetryAfter > 0 {
+			// Rounded up so that the client does not retry before the wait is over
+			w.Header().Set("Retry-After", strconv.Itoa(int((upstreamErr.RetryAfter+time.Second-1)/time.Second)))
+		}
+		http.Error(w, "One step api is unavailable, try again later", http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "One step api did not respond in time", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "One step api request failed", http.StatusBadGateway)
+	}
+}
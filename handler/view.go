@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/data"
+	"net/http"
+	"strings"
+)
+
+// errViewNotFound is returned when a user has no view with the requested name
+var errViewNotFound = errors.New("view does not exist")
+
+// GetViewsResponse structure representing the data for the get api of the views of a user
+type GetViewsResponse struct {
+	Views []data.View `json:"views"`
+}
+
+// filterDevices returns the devices matching all the filters. groups holds the groups of every device
+func filterDevices(devices []Device, filters []data.Filter, groups map[string][]string) []Device {
+	if len(filters) == 0 {
+		return devices
+	}
+	filtered := make([]Device, 0)
+	for _, device := range devices {
+		matched := true
+		for _, filter := range filters {
+			if !matchFilter(device, filter, groups[device.DeviceID]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			filtered = append(filtered, device)
+		}
+	}
+	return filtered
+}
+
+// matchFilter returns true if the device matches the filter
+func matchFilter(device Device, filter data.Filter, groups []string) bool {
+	if filter.Column == "group" {
+		inGroup := false
+		for _, group := range groups {
+			if filter.Operator == "contains" {
+				inGroup = inGroup || strings.Contains(strings.ToLower(group), strings.ToLower(filter.Value))
+			} else {
+				inGroup = inGroup || strings.EqualFold(group, filter.Value)
+			}
+		}
+		if filter.Operator == "ne" {
+			return !inGroup
+		}
+		return inGroup
+	}
+	if filter.Operator == "contains" {
+		return strings.Contains(strings.ToLower(deviceColumn(device, filter.Column)), strings.ToLower(filter.Value))
+	}
+	// Building a device holding the value of the filter in the column, so that it can be compared with compareDevices
+	var value Device
+	if setDeviceColumn(&value, filter.Column, filter.Value) != nil {
+		return false
+	}
+	return compareFilterValue(compareDevices(filter.Column, device, value), filter.Operator)
+}
+
+// compareFilterValue returns true if the result of comparing a column with the value of a filter satisfies the
+// operator of the filter
+func compareFilterValue(comparison int, operator string) bool {
+	switch operator {
+	case "eq":
+		return comparison == 0
+	case "ne":
+		return comparison != 0
+	case "lt":
+		return comparison < 0
+	case "lte":
+		return comparison <= 0
+	case "gt":
+		return comparison > 0
+	case "gte":
+		return comparison >= 0
+	}
+	return false
+}
+
+// deviceGroups returns the groups of every device which has groups
+func deviceGroups(preferences data.Preferences) map[string][]string {
+	groups := make(map[string][]string)
+	for _, devicePreference := range preferences.GetDevicePreferences() {
+		if len(devicePreference.Groups) > 0 {
+			groups[devicePreference.DeviceID] = devicePreference.Groups
+		}
+	}
+	return groups
+}
+
+// GetViewsHandler is the handler function for the get request of the views of the user making the request
+func (h *Handler) GetViewsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	response := GetViewsResponse{Views: []data.View{}}
+	h.Preferences.Read(func(preferences data.Preferences) {
+		response.Views = append(response.Views, preferences.GetViews()[requestUser(r)]...)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", preferencesETag(h.Preferences.Version()))
+	json.NewEncoder(w).Encode(response)
+}
+
+// PutViewHandler is the handler function for the put request which creates or replaces the view of the user making
+// the request. The name of the view is read from the path. When the view is the default view, the other views of the
+// user are no longer the default view. Only the view is validated. Honors the If-Match header like the post request of
+// the preferences
+func (h *Handler) PutViewHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	var view data.View
+	err := json.NewDecoder(r.Body).Decode(&view)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.Name = r.PathValue("name")
+	if view.NumberOfRows == 0 {
+		view.NumberOfRows = -1
+	}
+	user := requestUser(r)
+	err = h.Preferences.Update(user, ifMatchVersion(r), func(preferences data.Preferences) error {
+		views := make([]data.View, 0)
+		position := -1
+		for idx, existing := range preferences.GetViews()[user] {
+			if existing.Name == view.Name {
+				existing = view
+				position = idx
+			} else if view.Default {
+				existing.Default = false
+			}
+			views = append(views, existing)
+		}
+		if position == -1 {
+			position = len(views)
+			views = append(views, view)
+		}
+		// Only the view is validated, so that an invalid view stored before the views were validated does not prevent
+		// editing the others
+		if fieldErrors := data.ValidateView(view, fmt.Sprintf("views.%s[%d]", user, position)); len(fieldErrors) > 0 {
+			return &data.ValidationError{Errors: fieldErrors}
+		}
+		preferences.SetViews(user, views)
+		return nil
+	})
+	if err != nil {
+		writePreferencesError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", preferencesETag(h.Preferences.Version()))
+	json.NewEncoder(w).Encode(view)
+}
+
+// DeleteViewHandler is the handler function for the delete request of a view of the user making the request.
+// Honors the If-Match header like the post request of the preferences
+func (h *Handler) DeleteViewHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	name := r.PathValue("name")
+	user := requestUser(r)
+	err := h.Preferences.Update(user, ifMatchVersion(r), func(preferences data.Preferences) error {
+		if data.FindView(preferences, user, name) == nil {
+			return errViewNotFound
+		}
+		views := make([]data.View, 0)
+		for _, existing := range preferences.GetViews()[user] {
+			if existing.Name != name {
+				views = append(views, existing)
+			}
+		}
+		preferences.SetViews(user, views)
+		return nil
+	})
+	if errors.Is(err, errViewNotFound) {
+		http.Error(w, "View does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writePreferencesError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", preferencesETag(h.Preferences.Version()))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
 	"log"
 	"main/data"
 	"main/handler"
 	"net/http"
 	"os"
+	"time"
 )
 
 func main() {
 	apiKey := os.Getenv("API_KEY")
+	accountsFile := os.Getenv("ACCOUNTS_FILE")
+	alertsFile := os.Getenv("ALERTS_FILE")
+	geocoderFile := os.Getenv("GEOCODER_FILE")
 	port := os.Getenv("PORT")
-	if apiKey == "" {
-		log.Fatal("API_KEY environment is not set")
+	pollInterval := handler.DefaultPollInterval
+	if value := os.Getenv("POLL_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			log.Fatal("The POLL_INTERVAL environment must be a duration such as 30s")
+		}
+		pollInterval = interval
+	}
+	if apiKey == "" && accountsFile == "" {
+		log.Fatal("Neither the API_KEY nor the ACCOUNTS_FILE environment is set")
 	}
 
 	if port == "" {
@@ -30,10 +43,40 @@ func main() {
 	} else {
 		log.Fatal("Error occurred while checking for preferences" + err.Error())
 	}
-	http.HandleFunc("/images/", handler.ImageHandler)
-	apiHandler := handler.NewHandler(preferences, &http.Client{}, &handler.FileSystem{})
-	http.HandleFunc("/devices", apiHandler.DevicesHandler)
-	http.HandleFunc("/preferences", apiHandler.PreferencesHandler)
-	http.HandleFunc("/upload", apiHandler.Upload)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	history, err := data.LoadFileHistory(data.HistoryFile)
+	if err != nil {
+		log.Fatal("Error occurred while loading preferences history" + err.Error())
+	}
+	client := &http.Client{}
+	apiHandler := handler.NewHandler(preferences, client, &handler.FileSystem{})
+	if accountsFile != "" {
+		accounts, err := handler.LoadAccounts(accountsFile)
+		if err != nil {
+			log.Fatal("Error occurred while loading the accounts " + err.Error())
+		}
+		log.Printf("Fetching the devices of %d accounts", len(accounts.Accounts))
+		apiHandler.SetAccounts(accounts, client)
+	}
+	if alertsFile != "" {
+		alerts, err := handler.LoadAlerts(alertsFile)
+		if err != nil {
+			log.Fatal("Error occurred while loading the alert rules " + err.Error())
+		}
+		log.Printf("Evaluating %d alert rules", len(alerts.Rules))
+		apiHandler.SetAlerts(alerts)
+	}
+	places, err := handler.BundledPlaces()
+	if geocoderFile != "" {
+		places, err = handler.LoadPlaces(geocoderFile)
+	}
+	if err != nil {
+		log.Fatal("Error occurred while loading the places of the geocoder " + err.Error())
+	}
+	log.Printf("Resolving the addresses of the devices from %d places", len(places))
+	apiHandler.SetPlaces(places)
+	apiHandler.Preferences = data.NewPreferencesStore(preferences, history)
+	if pollInterval > 0 {
+		go apiHandler.Poll(context.Background(), pollInterval)
+	}
+	log.Fatal(http.ListenAndServe(":"+port, handler.NewRouter(apiHandler)))
 }
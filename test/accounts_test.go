@@ -0,0 +1,269 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// secondAccountResponse is the response of the one step api for the second account, sharing device 7 with the first
+const secondAccountResponse = `{"result_list": [
+	{"device_id": "7", "display_name": "Shared truck", "active_state": "active", "online": true},
+	{"device_id": "b1", "display_name": "Second account", "active_state": "active", "online": false}
+]}`
+
+// accountsRouter returns the router of a handler with the preferences, fetching the devices of two accounts from a fake
+// one step api. The first account returns the devices of api_response.json
+func accountsRouter(t *testing.T, preferences *MockPreferences, users map[string][]string, secondStatus int) *http.ServeMux {
+	t.Helper()
+	server, _ := upstreamServer(t, func(w http.ResponseWriter, r *http.Request, request int) bool {
+		if r.URL.Query().Get("api-key") == "first-key" {
+			return false
+		}
+		w.WriteHeader(secondStatus)
+		w.Write([]byte(secondAccountResponse))
+		return true
+	})
+	apiHandler := handler.NewHandler(preferences, server.Client(), nil)
+	apiHandler.SetAccounts(&handler.AccountsConfig{
+		Accounts: []handler.Account{{Name: "first", APIKey: "first-key"}, {Name: "second", APIKey: "second-key"}},
+		Users:    users,
+	}, server.Client())
+	for _, upstream := range apiHandler.Upstreams {
+		upstream.URL = server.URL + "?api-key=" + upstream.Account + "-key"
+		upstream.Attempts = 1
+	}
+	return handler.NewRouter(apiHandler)
+}
+
+// Test that the devices of every account are fetched, tagged with their account and deduplicated
+func TestAccounts_Merge(t *testing.T) {
+	router := accountsRouter(t, GetNewPreferences(), nil, http.StatusOK)
+	devices := getJSON[handler.GetDevicesResponse](t, router, "alice", "/devices").Devices
+	// The 10 devices of the first account and the device of the second account which is not shared
+	assert.Equal(t, 11, len(devices))
+	accounts := make(map[string]string)
+	for _, device := range devices {
+		accounts[device.DeviceID] = device.Account
+	}
+	assert.Equal(t, "first", accounts["7"])
+	assert.Equal(t, "second", accounts["b1"])
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?fields=device_id,account&format=geojson", nil))
+	assert.Contains(t, rr.Body.String(), `"account":"second"`)
+}
+
+// Test that users only see the devices of their accounts
+func TestAccounts_Users(t *testing.T) {
+	router := accountsRouter(t, GetNewPreferences(), map[string][]string{"alice": {"first"}, "bob": {"second"}, handler.AllUsers: {}}, http.StatusOK)
+	assert.Equal(t, 10, len(getJSON[handler.GetDevicesResponse](t, router, "alice", "/devices").Devices))
+	bob := getJSON[handler.GetDevicesResponse](t, router, "bob", "/devices").Devices
+	assert.Equal(t, 2, len(bob))
+	// The devices are sorted by display name. The shared device holds the data of the account of bob, not of the first
+	// account
+	assert.Equal(t, "b1", bob[0].DeviceID)
+	assert.Equal(t, "7", bob[1].DeviceID)
+	assert.Equal(t, "second", bob[1].Account)
+	assert.Equal(t, "Shared truck", bob[1].DisplayName)
+	for _, device := range getJSON[handler.GetDevicesResponse](t, router, "alice", "/devices").Devices {
+		assert.Equal(t, "first", device.Account)
+	}
+	assert.Equal(t, 0, len(getJSON[handler.GetDevicesResponse](t, router, "mallory", "/devices").Devices))
+
+	rr := serveRequest(router, "alice", "GET", "/devices/b1", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// Test that the devices of the accounts which responded are served when an account fails
+func TestAccounts_Error(t *testing.T) {
+	router := accountsRouter(t, GetNewPreferences(), map[string][]string{"alice": {"first"}, "bob": {"first", "second"}}, http.StatusUnauthorized)
+	rr := serveRequest(router, "bob", "GET", "/devices?page_size=-1", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "second", rr.Header().Get(handler.FailedAccountsHeader))
+	var response handler.GetDevicesResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 10, len(response.Devices))
+
+	// The failure of an account is only reported to the users who can see it
+	rr = serveRequest(router, "alice", "GET", "/devices/9", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "", rr.Header().Get(handler.FailedAccountsHeader))
+}
+
+// Test that the preferences of the devices which were not fetched are kept while their account fails
+func TestAccounts_PreferencesFailedAccount(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "b1", DisplayName: "Second account", Hidden: true, Groups: []string{"Vans"}}}
+	router := accountsRouter(t, preferences, nil, http.StatusServiceUnavailable)
+
+	rr := serveRequest(router, "alice", "GET", "/preferences", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "second", rr.Header().Get(handler.FailedAccountsHeader))
+	var response data.PreferencesImpl
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 10, len(response.DevicePreferences))
+	assert.Contains(t, response.DevicePreferences, data.DevicePreferences{DeviceID: "b1", DisplayName: "Second account", Hidden: true, Groups: []string{"Vans"}})
+}
+
+// Test that the preferences, icons and history of the devices are only served to the users of their accounts
+func TestAccounts_Preferences(t *testing.T) {
+	router := accountsRouter(t, GetNewPreferences(), map[string][]string{"alice": {"first"}, "bob": {"second"}}, http.StatusOK)
+	// The preferences of the new devices are created by the get request
+	assert.Equal(t, http.StatusOK, serveRequest(router, "bob", "GET", "/preferences", "").Code)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "bob", "PATCH", "/preferences/devices/b1", `{"display_name": "Secret"}`).Code)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "bob", "PUT", "/views/Hidden%20vans", `{"number_of_rows":-1}`).Code)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "alice", "PUT", "/views/Trucks", `{"number_of_rows":-1}`).Code)
+
+	for _, rr := range []*httptest.ResponseRecorder{
+		serveRequest(router, "alice", "PATCH", "/preferences/devices/b1", `{"hidden": true}`),
+		serveRequest(router, "alice", "GET", "/devices/b1/icon", ""),
+		serveRequest(router, "bob", "GET", "/devices/9/icon", ""),
+	} {
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	}
+	formBuf := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(formBuf)
+	file, err := multipartWriter.CreateFormFile("file", "icon.png")
+	assert.NoError(t, err)
+	file.Write([]byte("icon"))
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", "/devices/b1/icon", formBuf)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	req.Header.Set(handler.UserHeader, "alice")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = serveRequest(router, "alice", "GET", "/preferences", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var preferences data.PreferencesImpl
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &preferences))
+	// The first account lists device 1 twice
+	assert.Equal(t, 9, len(preferences.DevicePreferences))
+	assert.NotContains(t, rr.Body.String(), "Secret")
+	// The views of the other users are left out
+	assert.Equal(t, 1, len(preferences.Views))
+	assert.Contains(t, preferences.Views, "alice")
+	rr = serveRequest(router, "bob", "GET", "/preferences", "")
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &preferences))
+	assert.Equal(t, 2, len(preferences.DevicePreferences))
+
+	rr = serveRequest(router, "alice", "GET", "/preferences/history?snapshots=true", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "Secret")
+	assert.NotContains(t, rr.Body.String(), `"b1"`)
+	assert.NotContains(t, rr.Body.String(), "Hidden vans")
+	assert.Contains(t, rr.Body.String(), "Trucks")
+	assert.Contains(t, serveRequest(router, "bob", "GET", "/preferences/history", "").Body.String(), "Secret")
+
+	rr = serveRequest(router, "alice", "GET", "/preferences/export", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	assert.NoError(t, err)
+	reader, err := archive.File[0].Open()
+	assert.NoError(t, err)
+	defer reader.Close()
+	preferences = data.PreferencesImpl{}
+	assert.NoError(t, json.NewDecoder(reader).Decode(&preferences))
+	assert.Equal(t, 9, len(preferences.DevicePreferences))
+	assert.Equal(t, 1, len(preferences.Views))
+	assert.Contains(t, preferences.Views, "alice")
+}
+
+// Test that the writes of a user only change the preferences of the devices and the views the user can see
+func TestAccounts_PreferencesWrites(t *testing.T) {
+	router := accountsRouter(t, GetNewPreferences(), map[string][]string{"alice": {"first"}, "bob": {"second"}}, http.StatusOK)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "bob", "GET", "/preferences", "").Code)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "bob", "PATCH", "/preferences/devices/b1", `{"hidden": true, "groups": ["Vans"]}`).Code)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "bob", "PUT", "/views/Hidden%20vans", `{"number_of_rows":-1}`).Code)
+	// assertBob checks that the preferences of bob are left as they are
+	assertBob := func() {
+		t.Helper()
+		preferences := getJSON[data.PreferencesImpl](t, router, "bob", "/preferences")
+		assert.Contains(t, preferences.DevicePreferences, data.DevicePreferences{DeviceID: "b1", DisplayName: "Second account", Hidden: true, Image: handler.DefaultImagePath, Groups: []string{"Vans"}})
+		assert.Equal(t, 1, len(preferences.Views["bob"]))
+	}
+
+	// savePreferences posts the preferences of alice as a json body
+	savePreferences := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/preferences", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(handler.UserHeader, "alice")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The preferences read by alice are saved back
+	rr := serveRequest(router, "alice", "GET", "/preferences", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = savePreferences(rr.Body.String())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assertBob()
+	rr = serveRequest(router, "alice", "PATCH", "/preferences", `{"number_of_rows": 10, "views": null}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assertBob()
+
+	for _, rr := range []*httptest.ResponseRecorder{
+		savePreferences(`{"device_preferences": [{"device_id": "b1", "display_name": "Taken", "image": ""}]}`),
+		serveRequest(router, "alice", "PATCH", "/preferences", `{"views": {"bob": []}}`),
+	} {
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		var response handler.ValidationErrorResponse
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.Equal(t, 1, len(response.Errors))
+	}
+	assertBob()
+
+	// The first version of the preferences holds no devices and views
+	rr = serveRequest(router, "alice", "POST", "/preferences/revert/0", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assertBob()
+
+	// The bundle exported by bob holds the shared device, which alice can see, and the device of the second account
+	rr = serveRequest(router, "bob", "GET", "/preferences/export", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serveRequest(router, "alice", "POST", "/preferences/import", rr.Body.String())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var report handler.ImportReport
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, []string{"b1"}, report.UnknownDevices)
+	assertBob()
+}
+
+// Test the validation of the accounts configuration
+func TestLoadAccounts(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"accounts": [{"name": "first", "api_key": "key"}], "users": {"alice": ["first"]}}`, ""},
+		{`{"accounts": []}`, "no accounts are configured"},
+		{`{"accounts": [{"name": "first"}]}`, "accounts[0] must have a name and an api_key"},
+		{`{"accounts": [{"name": "first", "api_key": "a"}, {"name": "first", "api_key": "b"}]}`, "account first is configured more than once"},
+		{`{"accounts": [{"name": "first", "api_key": "key"}], "users": {"alice": ["other"]}}`, "account other of user alice is not configured"},
+	}
+	for idx, test := range tests {
+		path := filepath.Join(dir, "accounts.json")
+		assert.NoError(t, os.WriteFile(path, []byte(test.config), 0644))
+		config, err := handler.LoadAccounts(path)
+		if test.err == "" {
+			assert.NoError(t, err, idx)
+			assert.Equal(t, "first", config.Accounts[0].Name)
+		} else {
+			assert.EqualError(t, err, test.err, idx)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// activityRouter returns the router of a handler whose one step api returns the latest points of device 42, reported
+// online with a point of the current entry of points, and device 43 which reports a point every time it is fetched
+func activityRouter(t *testing.T, preferences *MockPreferences, points *string) *http.ServeMux {
+	t.Helper()
+	client := upstreamClient(func(int) string {
+		now := time.Now().UTC().Format(time.RFC3339)
+		return fmt.Sprintf(`{"result_list":[{"device_id":"42","display_name":"Truck","online":true,"latest_accurate_device_point":{%s}},`+
+			`{"device_id":"43","display_name":"Van","online":true,"latest_accurate_device_point":{"dt_tracker":"%s"}}]}`, *points, now)
+	})
+	return handler.NewRouter(handler.NewHandler(preferences, client, nil))
+}
+
+// activityDevices returns the devices of the response of the request keyed by device id
+func activityDevices(t *testing.T, router *http.ServeMux, target string) map[string]handler.Device {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response handler.GetDevicesResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	devices := make(map[string]handler.Device)
+	for _, device := range response.Devices {
+		devices[device.DeviceID] = device
+	}
+	return devices
+}
+
+// Test that the devices whose latest point is older than the stale threshold are stale although reported online
+func TestDevicesHandlerStale(t *testing.T) {
+	hoursAgo := time.Now().Add(-3 * time.Hour).UTC()
+	points := fmt.Sprintf(`"lat":34.5,"lng":-118.25,"dt_tracker":"%s"`, hoursAgo.Format(time.RFC3339))
+	router := activityRouter(t, GetNewPreferences(), &points)
+	devices := activityDevices(t, router, "/devices")
+	assert.True(t, devices["42"].Stale)
+	assert.InDelta(t, 3*3600, *devices["42"].LastSeenAgo, 60)
+	assert.Nil(t, devices["42"].LastMovedAgo)
+	assert.False(t, devices["43"].Stale)
+
+	// The device moved an hour later
+	points = fmt.Sprintf(`"lat":34.6,"lng":-118.25,"dt_tracker":"%s"`, hoursAgo.Add(time.Hour).Format(time.RFC3339))
+	devices = activityDevices(t, router, "/devices?stale=true")
+	assert.Equal(t, 1, len(devices))
+	assert.InDelta(t, 2*3600, *devices["42"].LastMovedAgo, 60)
+	devices = activityDevices(t, router, "/api/v1/devices?stale=false")
+	assert.Equal(t, 1, len(devices))
+	assert.False(t, devices["43"].Stale)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?stale=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// Test the stale threshold of the groups
+func TestDevicesHandlerStaleThreshold(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "42", Groups: []string{"trailers"}}}
+	preferences.GroupThresholds = map[string]data.Thresholds{"trailers": {StaleSeconds: 24 * 3600}}
+	points := fmt.Sprintf(`"dt_tracker":"%s"`, time.Now().Add(-3*time.Hour).UTC().Format(time.RFC3339))
+	router := activityRouter(t, preferences, &points)
+	devices := activityDevices(t, router, "/devices?fields=device_id,stale,last_seen_ago")
+	assert.False(t, devices["42"].Stale)
+	assert.NotNil(t, devices["42"].LastSeenAgo)
+}
+
+// Test that the poller fetches the devices until it is stopped
+func TestPoll(t *testing.T) {
+	var requests atomic.Int32
+	client := upstreamClient(func(int) string {
+		requests.Add(1)
+		return `{"result_list":[]}`
+	})
+	apiHandler := handler.NewHandler(GetNewPreferences(), client, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		apiHandler.Poll(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return requests.Load() >= 3 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	receive(t, done)
+}
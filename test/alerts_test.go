@@ -0,0 +1,290 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"main/handler"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alertsRouter returns the router of a handler with the alert rules, whose one step api returns device 42 with the
+// latest point of the current entry of points
+func alertsRouter(t *testing.T, config *handler.AlertsConfig, points *string) *http.ServeMux {
+	t.Helper()
+	client := upstreamClient(func(int) string {
+		return fmt.Sprintf(`{"result_list":[{"device_id":"42","display_name":"Truck",%s}]}`, *points)
+	})
+	apiHandler := handler.NewHandler(GetNewPreferences(), client, nil)
+	apiHandler.SetAlerts(config)
+	return handler.NewRouter(apiHandler)
+}
+
+// fetchPoint makes the one step api return the point and fetches the devices, evaluating the alert rules
+func fetchPoint(router *http.ServeMux, points *string, point string) {
+	*points = point
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/devices", nil))
+}
+
+// getAlerts returns the alerts of the response of the request
+func getAlerts(t *testing.T, router *http.ServeMux, target string) []handler.Alert {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response handler.GetAlertsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response.Alerts
+}
+
+// receive returns the next value sent on the channel, failing the test when nothing is sent within a few seconds
+func receive[T any](t *testing.T, values chan T) T {
+	t.Helper()
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing was received")
+	}
+	var zero T
+	return zero
+}
+
+// Test the states of an alert and its notifications to a webhook
+func TestAlerts_Webhook(t *testing.T) {
+	notifications := make(chan handler.Alert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert handler.Alert
+		json.NewDecoder(r.Body).Decode(&alert)
+		notifications <- alert
+	}))
+	defer webhook.Close()
+	points := ""
+	router := alertsRouter(t, &handler.AlertsConfig{
+		Rules:    []handler.AlertRule{{Name: "high", Kind: handler.AlertRuleAltitude, Altitude: 500, Channels: []string{"ops"}}},
+		Channels: []handler.AlertChannel{{Name: "ops", Type: handler.AlertChannelWebhook, URL: webhook.URL}},
+	}, &points)
+
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"altitude":100}`)
+	assert.Equal(t, 0, len(getAlerts(t, router, "/alerts")))
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"altitude":900}`)
+	alerts := getAlerts(t, router, "/alerts")
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, handler.AlertFiring, alerts[0].State)
+	assert.Equal(t, "high", alerts[0].Rule)
+	assert.Equal(t, "Truck is at an altitude of 900, above 500", alerts[0].Message)
+	notification := receive(t, notifications)
+	assert.Equal(t, alerts[0].ID, notification.ID)
+	assert.Equal(t, handler.AlertFiring, notification.State)
+
+	// The alert keeps firing while the condition holds
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"altitude":950}`)
+	assert.Equal(t, 1, len(getAlerts(t, router, "/alerts")))
+
+	req := httptest.NewRequest("POST", "/api/v1/alerts/"+alerts[0].ID+"/ack", nil)
+	req.Header.Set(handler.UserHeader, "alice")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var acknowledged handler.Alert
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &acknowledged))
+	assert.Equal(t, handler.AlertAcknowledged, acknowledged.State)
+	assert.Equal(t, "alice", acknowledged.AcknowledgedBy)
+	assert.Equal(t, 1, len(getAlerts(t, router, "/alerts?state=acknowledged")))
+	assert.Equal(t, 0, len(getAlerts(t, router, "/alerts?state=firing")))
+
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"altitude":100}`)
+	alerts = getAlerts(t, router, "/alerts?state=resolved")
+	assert.Equal(t, 1, len(alerts))
+	assert.NotNil(t, alerts[0].ResolvedAt)
+	assert.Equal(t, handler.AlertResolved, receive(t, notifications).State)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/alerts/"+alerts[0].ID+"/ack", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/alerts/99/ack", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/alerts?state=open", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// smtpStandIn accepts the connections of smtp clients on a local port and sends the data of every mail on the channel
+func smtpStandIn(t *testing.T, mails chan string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 localhost\r\n")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.TrimSpace(line)); {
+					case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+						fmt.Fprint(conn, "250 localhost\r\n")
+					case command == "DATA":
+						fmt.Fprint(conn, "354 end with .\r\n")
+						var data strings.Builder
+						for {
+							line, err := reader.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							data.WriteString(line)
+						}
+						mails <- data.String()
+						fmt.Fprint(conn, "250 queued\r\n")
+					case command == "QUIT":
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Test the geofence rules and their notifications by email
+func TestAlerts_GeofenceMail(t *testing.T) {
+	mails := make(chan string, 10)
+	address := smtpStandIn(t, mails)
+	depot := &handler.Geofence{Name: "Depot", Polygon: [][2]float64{{-118.3, 34.4}, {-118.2, 34.4}, {-118.2, 34.6}, {-118.3, 34.6}}}
+	points := ""
+	router := alertsRouter(t, &handler.AlertsConfig{
+		Rules: []handler.AlertRule{
+			{Name: "depot", Kind: handler.AlertRuleGeofence, Geofence: depot, Channels: []string{"mail"}},
+			// The business hours span the whole week, so the rule never fires
+			{Name: "depot at night", Kind: handler.AlertRuleGeofence, Geofence: depot, Channels: []string{"mail"},
+				OutsideBusinessHours: &handler.BusinessHours{Days: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}, Start: "00:00", End: "24:00"}},
+		},
+		Channels: []handler.AlertChannel{{Name: "mail", Type: handler.AlertChannelSMTP, Address: address, From: "alerts@fleet.test", To: []string{"ops@fleet.test"}}},
+	}, &points)
+
+	// A device which is inside the geofence in the first snapshot did not enter it
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"lat":34.5,"lng":-118.25}`)
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"lat":35,"lng":-118.25}`)
+	assert.Equal(t, 0, len(getAlerts(t, router, "/alerts")))
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"lat":34.5,"lng":-118.25}`)
+	alerts := getAlerts(t, router, "/alerts")
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, "depot", alerts[0].Rule)
+	assert.Equal(t, "Truck entered Depot", alerts[0].Message)
+	mail := receive(t, mails)
+	assert.Contains(t, mail, "Subject: [firing] depot: Truck")
+	assert.Contains(t, mail, "To: ops@fleet.test")
+
+	fetchPoint(router, &points, `"latest_accurate_device_point":{"lat":35,"lng":-118.25}`)
+	assert.Equal(t, handler.AlertResolved, getAlerts(t, router, "/alerts")[0].State)
+	assert.Contains(t, receive(t, mails), "Subject: [resolved] depot: Truck")
+
+	// The line breaks of a display name do not add headers to the email
+	fetchPoint(router, &points, `"display_name":"Truck\r\nBcc: evil@fleet.test","latest_accurate_device_point":{"lat":34.5,"lng":-118.25}`)
+	mail = receive(t, mails)
+	headers, _, _ := strings.Cut(mail, "\r\n\r\n")
+	assert.Contains(t, headers, "Subject: =?utf-8?q?")
+	assert.NotContains(t, headers, "\r\nBcc:")
+}
+
+// Test that the delivery of a mail is abandoned once the timeout of the channel elapsed when the smtp server never
+// answers
+func TestAlerts_MailTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	closed := make(chan bool, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The greeting is never sent, the read returns once the client closed the connection
+		io.Copy(io.Discard, conn)
+		closed <- true
+	}()
+	points := `"online":true`
+	router := alertsRouter(t, &handler.AlertsConfig{
+		Rules:    []handler.AlertRule{{Name: "offline", Kind: handler.AlertRuleOffline, Channels: []string{"stuck"}}},
+		Channels: []handler.AlertChannel{{Name: "stuck", Type: handler.AlertChannelSMTP, Address: listener.Addr().String(), From: "alerts@fleet.test", To: []string{"ops@fleet.test"}, TimeoutSeconds: 1}},
+	}, &points)
+	fetchPoint(router, &points, `"online":true`)
+	fetchPoint(router, &points, `"online":false`)
+	assert.True(t, receive(t, closed))
+}
+
+// Test the offline rules
+func TestAlerts_Offline(t *testing.T) {
+	points := `"online":true`
+	router := alertsRouter(t, &handler.AlertsConfig{
+		Rules: []handler.AlertRule{
+			{Name: "offline", Kind: handler.AlertRuleOffline},
+			{Name: "offline for an hour", Kind: handler.AlertRuleOffline, OfflineSeconds: 3600},
+		},
+	}, &points)
+	fetchPoint(router, &points, `"online":true`)
+	fetchPoint(router, &points, `"online":false`)
+	alerts := getAlerts(t, router, "/alerts")
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, "offline", alerts[0].Rule)
+	fetchPoint(router, &points, `"online":true`)
+	assert.Equal(t, 1, len(getAlerts(t, router, "/alerts?state=resolved")))
+
+	// A device is offline since its latest point, although it is fetched offline for the first time
+	lastPoint := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	fetchPoint(router, &points, `"online":false,"latest_accurate_device_point":{"dt_tracker":"`+lastPoint+`"}`)
+	alerts = getAlerts(t, router, "/alerts?state=firing")
+	assert.Equal(t, 2, len(alerts))
+	assert.Equal(t, "offline for an hour", alerts[0].Rule)
+}
+
+// Test the validation of the alerts configuration
+func TestLoadAlerts(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"rules": [{"name": "high", "kind": "altitude_above", "altitude": 500, "channels": ["ops"]}], "channels": [{"name": "ops", "type": "webhook", "url": "http://localhost"}]}`, ""},
+		{`{"rules": [{"name": "high", "kind": "speed"}]}`, "rules[0] kind must be one of offline, altitude_above, geofence_entered"},
+		{`{"rules": [{"name": "depot", "kind": "geofence_entered", "geofence": {"name": "Depot"}}]}`, "rules[0] geofence must have a radius_m or a polygon of at least 3 points"},
+		{`{"rules": [{"name": "high", "kind": "altitude_above", "channels": ["ops"]}]}`, "channel ops of rule high is not configured"},
+		{`{"rules": [{"name": "high", "kind": "altitude_above", "outside_business_hours": {"start": "18:00", "end": "09:00"}}]}`, "rules[0] outside_business_hours must have a start before the end, as HH:MM times"},
+		{`{"channels": [{"name": "mail", "type": "smtp", "address": "localhost:25"}]}`, "channels[0] must have an address, a from and a to"},
+		{`{"channels": [{"name": "ops", "type": "webhook", "url": "http://localhost", "timeout_seconds": -1}]}`, "channels[0] timeout_seconds must not be negative"},
+	}
+	for idx, test := range tests {
+		path := filepath.Join(dir, "alerts.json")
+		assert.NoError(t, os.WriteFile(path, []byte(test.config), 0644))
+		config, err := handler.LoadAlerts(path)
+		if test.err == "" {
+			assert.NoError(t, err, idx)
+			assert.Equal(t, "high", config.Rules[0].Name)
+		} else {
+			assert.EqualError(t, err, test.err, idx)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Test that the exported bundle holds the preferences and the referenced icons
+func TestExportPreferences(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.SortColumn = "lat"
+	preferences.DevicePreferences = []data.DevicePreferences{
+		{DeviceID: "1", Image: "/images/default.png"},
+		{DeviceID: "2", Image: handler.DefaultImagePath},
+		{DeviceID: "6", Image: "/images/missing.png"},
+	}
+	router := handler.NewRouter(handler.NewHandler(preferences, nil, &FileSystemMock{}))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/preferences/export", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(archive.File))
+	assert.Equal(t, handler.BundlePreferencesFile, archive.File[0].Name)
+	assert.Equal(t, "images/default.png", archive.File[1].Name)
+
+	reader, _ := archive.File[0].Open()
+	var exported MockPreferences
+	assert.NoError(t, json.NewDecoder(reader).Decode(&exported))
+	assert.Equal(t, "lat", exported.SortColumn)
+	assert.Equal(t, preferences.DevicePreferences, exported.DevicePreferences)
+
+	reader, _ = archive.File[1].Open()
+	image, _ := io.ReadAll(reader)
+	expectedImage, _ := os.ReadFile("images/default.png")
+	assert.Equal(t, expectedImage, image)
+}
+
+// createBundle returns a preferences bundle holding the preferences document and the images
+func createBundle(t *testing.T, document string, images map[string]string) *bytes.Buffer {
+	t.Helper()
+	buffer := new(bytes.Buffer)
+	archive := zip.NewWriter(buffer)
+	writer, _ := archive.Create(handler.BundlePreferencesFile)
+	writer.Write([]byte(document))
+	for name, content := range images {
+		writer, _ = archive.Create(name)
+		writer.Write([]byte(content))
+	}
+	assert.NoError(t, archive.Close())
+	return buffer
+}
+
+// Test importing a bundle with and without the dry run mode
+func TestImportPreferences(t *testing.T) {
+	preferences := GetNewPreferences()
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), &FileSystemMock{}))
+	document := `{"sort_column":"altitude","number_of_rows":20,"device_preferences":[
+		{"device_id":"1","image":"/images/1.png","hidden":true},
+		{"device_id":"2","image":"/images/2.png"},
+		{"device_id":"404","image":"/images/404.png"}]}`
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/preferences/import?dry_run=true", createBundle(t, document, map[string]string{"images/1.png": "icon"})))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var report handler.ImportReport
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+	assert.Equal(t, handler.ImportReport{DryRun: true, UnknownDevices: []string{"404"}, Images: []string{"images/1.png"}, MissingImages: []string{"images/2.png"}}, report)
+	assert.Equal(t, "display_name", preferences.GetSortColumn())
+
+	serverFileName = ""
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/preferences/import", createBundle(t, document, map[string]string{"images/1.png": "icon"})))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/images/1.png", serverFileName)
+	assert.Equal(t, "icon", uploadedFileContent)
+	assert.Equal(t, "altitude", preferences.GetSortColumn())
+	assert.Equal(t, 20, preferences.GetNumberOfRows())
+	assert.Equal(t, []data.DevicePreferences{
+		{DeviceID: "1", Image: "/images/1.png", Hidden: true},
+		{DeviceID: "2", Image: handler.DefaultImagePath},
+	}, preferences.GetDevicePreferences())
+
+	// The images of an import which failed are not moved to the images directory
+	serverFileName = ""
+	req := httptest.NewRequest("POST", "/preferences/import", createBundle(t, document, map[string]string{"images/1.png": "new icon"}))
+	req.Header.Set("If-Match", `"0"`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+	assert.Equal(t, "/images/.import-mock/1.png", serverFileName)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/preferences/import", bytes.NewReader([]byte("not a zip"))))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,199 @@
+package test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the conditional get requests of the devices api
+func TestDevicesHandler_NotModified(t *testing.T) {
+	preferences := GetNewPreferences()
+	apiHandler := handler.NewHandler(preferences, mockDevicesClient(t), nil)
+	router := handler.NewRouter(apiHandler)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, rr.Header().Get("Last-Modified"))
+
+	req := httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Empty(t, rr.Body.String())
+
+	// Another page is another representation
+	req = httptest.NewRequest("GET", "/devices?page_size=2", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Saving the preferences changes the devices
+	preferences.SortColumn = "lat"
+	preferences.SetVersion(preferences.GetVersion() + 1)
+	req = httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+}
+
+// Test that a device is modified when its preferences change, although it is served from the cache
+func TestDeviceHandler_NotModified(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+	// The preferences of the devices are created by the get request of the preferences
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/preferences", nil))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/9", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	lastModified := rr.Header().Get("Last-Modified")
+
+	// Last-Modified has a resolution of a second
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/preferences/devices/9", strings.NewReader(`{"display_name": "Renamed"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req := httptest.NewRequest("GET", "/devices/9", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Renamed")
+}
+
+// Test the conditional get requests of the preferences api
+func TestPreferencesHandler_NotModified(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/preferences", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	req := httptest.NewRequest("GET", "/preferences", nil)
+	req.Header.Set("If-None-Match", "W/\"other\", "+etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	req = httptest.NewRequest("GET", "/preferences", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// Test the cache headers of the images
+func TestImageHandler_CacheControl(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+	image, err := os.ReadFile("images/default.png")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile("images/test-0123456789abcdef.png", image, 0644))
+	t.Cleanup(func() { os.Remove("images/test-0123456789abcdef.png") })
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/images/test-0123456789abcdef.png", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "public, max-age=31536000, immutable", rr.Header().Get("Cache-Control"))
+	assert.Equal(t, `"0123456789abcdef"`, rr.Header().Get("ETag"))
+
+	req := httptest.NewRequest("GET", "/images/test-0123456789abcdef.png", nil)
+	req.Header.Set("If-None-Match", `"0123456789abcdef"`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	// Images which are not content addressed are revalidated
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/images/default.png", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "no-cache", rr.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, rr.Header().Get("ETag"))
+}
+
+// Test the compression of the json responses
+func TestRouter_Gzip(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Contains(t, rr.Header().Values("Vary"), "Accept-Encoding")
+	reader, err := gzip.NewReader(rr.Body)
+	assert.NoError(t, err)
+	var response handler.GetDevicesResponse
+	assert.NoError(t, json.NewDecoder(reader).Decode(&response))
+	assert.Equal(t, 10, len(response.Devices))
+
+	// gzip is refused with a zero quality
+	req = httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set("Accept-Encoding", "*, gzip;q=0")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+
+	// Images are not compressed
+	req = httptest.NewRequest("GET", "/images/default.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+}
+
+// Test that the compressed and the uncompressed responses have different ETags, which both revalidate the response
+func TestRouter_GzipETag(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	for _, target := range []string{"/devices/summary", "/preferences"} {
+		identity := serveRequest(router, "", "GET", target, "")
+		assert.Equal(t, http.StatusOK, identity.Code)
+		etag := identity.Header().Get("ETag")
+		assert.False(t, strings.HasPrefix(etag, "W/"), target)
+
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		compressed := httptest.NewRecorder()
+		router.ServeHTTP(compressed, req)
+		assert.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"))
+		assert.Equal(t, "W/"+etag, compressed.Header().Get("ETag"), target)
+
+		// The 304 holds the ETag of the compressed response and varies by the encoding like the response it stands for
+		req = httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("If-None-Match", compressed.Header().Get("ETag"))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotModified, rr.Code, target)
+		assert.Equal(t, "W/"+etag, rr.Header().Get("ETag"), target)
+		assert.Contains(t, rr.Header().Values("Vary"), "Accept-Encoding", target)
+	}
+
+	// The weak ETag of the preferences is accepted by the If-Match header of an update
+	req := httptest.NewRequest("GET", "/preferences", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	req = httptest.NewRequest("PATCH", "/preferences", strings.NewReader(`{"ascending":false}`))
+	req.Header.Set("If-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getClusters returns the clusters of the response of the request
+func getClusters(t *testing.T, router *http.ServeMux, target string) handler.GetClustersResponse {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var response handler.GetClustersResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response
+}
+
+// clusterIds returns the ids of the devices of the response which are not clustered
+func clusterIds(response handler.GetClustersResponse) []string {
+	ids := make([]string, 0)
+	for _, device := range response.Devices {
+		ids = append(ids, device.DeviceID)
+	}
+	return ids
+}
+
+// Test the clusters of the devices which are not hidden at different zoom levels
+func TestClustersHandler(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.NumberOfRows = 2
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "6", Hidden: true}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	// Device 1 is listed twice by the one step api and device 6, in Seattle, is hidden. At zoom 0 the devices of the
+	// west and of the east of north america are clustered, while London is alone
+	response := getClusters(t, router, "/devices/clusters?zoom=0")
+	assert.Equal(t, 0, response.Zoom)
+	assert.Equal(t, 2, len(response.Clusters))
+	assert.Equal(t, 4, response.Clusters[0].Count)
+	assert.Equal(t, 3, response.Clusters[1].Count)
+	assert.Equal(t, 2, response.Clusters[1].Online)
+	assert.Equal(t, 1, response.Clusters[1].Offline)
+	assert.Equal(t, map[string]int{"off": 2, "on": 1}, response.Clusters[1].DriveStatus)
+	assert.Equal(t, []float64{-117.7946942, 33.6839473, -115.1398296, 37.1611778}, response.Clusters[1].BoundingBox)
+	assert.Equal(t, []string{"5"}, clusterIds(response))
+
+	// Las Vegas and device 2 are still clustered at zoom 5, Irvine is alone
+	response = getClusters(t, router, "/api/v1/devices/clusters?zoom=5&bbox=-125,30,-110,50")
+	assert.Equal(t, 1, len(response.Clusters))
+	assert.Equal(t, 2, response.Clusters[0].Count)
+	assert.InDelta(t, 36.67, response.Clusters[0].Lat, 0.01)
+	assert.Equal(t, []string{"7"}, clusterIds(response))
+
+	// The devices are not clustered once zoomed in
+	response = getClusters(t, router, "/devices/clusters?zoom=17")
+	assert.Equal(t, 0, len(response.Clusters))
+	assert.Equal(t, 8, len(response.Devices))
+	assert.Equal(t, 0, len(getClusters(t, router, "/devices/clusters?zoom=3&stale=true").Devices))
+
+	for _, target := range []string{"/devices/clusters", "/devices/clusters?zoom=23", "/devices/clusters?zoom=3&bbox=1,2", "/devices/clusters?zoom=3&stale=maybe"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, target)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/clusters?zoom=3&view=missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
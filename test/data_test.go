@@ -1,9 +1,12 @@
 package test
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"main/data"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -16,6 +19,10 @@ func TestDevicePreferences(t *testing.T) {
 	_, err := os.Stat(data.PreferencesFile)
 	assert.True(t, os.IsNotExist(err))
 	preferences.SetDevicePreferences(devicePreferences)
+	// The setters only change the preferences, they are saved by the store once an update succeeded
+	_, err = os.Stat(data.PreferencesFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, preferences.Save())
 
 	_, err = os.Stat(data.PreferencesFile)
 
@@ -32,3 +39,144 @@ func TestDevicePreferences(t *testing.T) {
 
 	os.Remove(data.PreferencesFile)
 }
+
+// TestValidate function to test the validation of the preferences
+func TestValidate(t *testing.T) {
+	preferences := data.GetNewPreferences()
+	assert.NoError(t, data.Validate(preferences, nil))
+
+	preferences.NumberOfRows = data.MaxNumberOfRows + 1
+	preferences.SortColumn = "unknown"
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1"}, {DeviceID: ""}, {DeviceID: "2"}}
+	err := data.Validate(preferences, []string{"1"})
+	var validationError *data.ValidationError
+	assert.ErrorAs(t, err, &validationError)
+	assert.Equal(t, []data.FieldError{
+		{Field: "sort_column", Message: "must be one of device_id, display_name, active_state, online, lat, lng, altitude, drive_status"},
+		{Field: "number_of_rows", Message: "must be -1 or between 1 and 1000"},
+		{Field: "device_preferences[1].device_id", Message: "is required"},
+		{Field: "device_preferences[2].device_id", Message: "device 2 does not exist"},
+	}, validationError.Errors)
+
+	// Unknown devices are not checked when the existing devices are not known
+	preferences.NumberOfRows = 25
+	preferences.SortColumn = "lat"
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1"}, {DeviceID: "2"}}
+	assert.NoError(t, data.Validate(preferences, nil))
+}
+
+// TestPreferencesStore function to test that concurrent updates of the preferences store are not lost and that
+// updates based on a stale version are rejected
+func TestPreferencesStore(t *testing.T) {
+	store := data.NewPreferencesStore(GetNewPreferences(), data.NewMemoryHistory())
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			store.Update("test", data.AnyVersion, func(preferences data.Preferences) error {
+				preferences.SetDevicePreferences(append(preferences.GetDevicePreferences(), data.DevicePreferences{DeviceID: "1"}))
+				return nil
+			})
+		}()
+	}
+	wait.Wait()
+	assert.Equal(t, 50, store.Version())
+	store.Read(func(preferences data.Preferences) {
+		assert.Equal(t, 50, len(preferences.GetDevicePreferences()))
+	})
+
+	err := store.Update("test", 49, func(preferences data.Preferences) error {
+		preferences.SetDevicePreferences(nil)
+		return nil
+	})
+	assert.ErrorIs(t, err, data.ErrVersionMismatch)
+
+	// Failed updates are rolled back and do not change the version
+	err = store.Update("test", 50, func(preferences data.Preferences) error {
+		preferences.SetDevicePreferences(nil)
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 50, store.Version())
+	store.Read(func(preferences data.Preferences) {
+		assert.Equal(t, 50, len(preferences.GetDevicePreferences()))
+	})
+}
+
+// TestPreferencesStore_Rollback function to test that the storage holds the preferences of the last successful update
+// after an update failed
+func TestPreferencesStore_Rollback(t *testing.T) {
+	defer os.Remove(data.PreferencesFile)
+	store := data.NewPreferencesStore(data.GetNewPreferences(), data.NewMemoryHistory())
+	err := store.Update("test", data.AnyVersion, func(preferences data.Preferences) error {
+		preferences.SetDevicePreferences([]data.DevicePreferences{{DeviceID: "1"}})
+		return nil
+	})
+	assert.NoError(t, err)
+	err = store.Update("test", data.AnyVersion, func(preferences data.Preferences) error {
+		preferences.SetDevicePreferences([]data.DevicePreferences{{DeviceID: "1"}, {DeviceID: "2"}})
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+
+	preferences := data.GetNewPreferences()
+	assert.NoError(t, preferences.Load())
+	assert.Equal(t, 1, preferences.GetVersion())
+	assert.Equal(t, []data.DevicePreferences{{DeviceID: "1"}}, preferences.GetDevicePreferences())
+}
+
+// failingHistory is a history whose appends fail once fail is set
+type failingHistory struct {
+	*data.MemoryHistory
+	fail bool
+}
+
+func (history *failingHistory) Append(change data.Change) error {
+	if history.fail {
+		return errors.New("disk full")
+	}
+	return history.MemoryHistory.Append(change)
+}
+
+// TestPreferencesStore_HistoryError function to test that an update succeeds when its change cannot be recorded in the
+// history, since the preferences were saved
+func TestPreferencesStore_HistoryError(t *testing.T) {
+	history := &failingHistory{MemoryHistory: data.NewMemoryHistory()}
+	store := data.NewPreferencesStore(GetNewPreferences(), history)
+	history.fail = true
+	err := store.Update("test", data.AnyVersion, func(preferences data.Preferences) error {
+		preferences.SetDevicePreferences([]data.DevicePreferences{{DeviceID: "1"}})
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.Version())
+	assert.Equal(t, "1", testPreferences.DevicePreferences[0].DeviceID)
+}
+
+// TestFileHistory function to test that the changes appended to the file history are loaded again
+func TestFileHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), data.HistoryFile)
+	history, err := data.LoadFileHistory(path)
+	assert.NoError(t, err)
+	store := data.NewPreferencesStore(GetNewPreferences(), history)
+	err = store.Update("bob", data.AnyVersion, func(preferences data.Preferences) error {
+		return data.Decode(preferences, []byte(`{"sort_column":"lat","number_of_rows":10}`))
+	})
+	assert.NoError(t, err)
+
+	history, err = data.LoadFileHistory(path)
+	assert.NoError(t, err)
+	changes, err := history.List()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, "bob", changes[1].User)
+	assert.Equal(t, []data.FieldChange{
+		{Path: "number_of_rows", Old: float64(-1), New: float64(10)},
+		{Path: "sort_column", Old: "display_name", New: "lat"},
+	}, changes[1].Diff)
+
+	change, err := history.Get(0)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"sort_column":"display_name","ascending":true,"number_of_rows":-1,"device_preferences":[]}`, string(change.Snapshot))
+}
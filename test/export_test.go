@@ -0,0 +1,124 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test the csv export of the devices
+func TestExportDevicesHandler_CSV(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "6", Hidden: true}, {DeviceID: "7", Groups: []string{"West", "Trucks"}}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/devices/export?format=csv&columns=display_name,lat,online,group", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="devices.csv"`, rr.Header().Get("Content-Disposition"))
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	assert.NoError(t, err)
+	// The devices are sorted like the devices api, hidden devices are left out and all the devices are exported
+	assert.Equal(t, 10, len(records))
+	assert.Equal(t, []string{"Name", "Latitude", "Online", "Groups"}, records[0])
+	assert.Equal(t, []string{"def 3", "33.6839473", "false", "West; Trucks"}, records[1])
+	assert.Equal(t, []string{"hij 8", "43.653226", "true", ""}, records[2])
+
+	// All the fields are exported by default
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/export", nil))
+	records, err = csv.NewReader(rr.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, len(data.DeviceFields), len(records[0]))
+}
+
+// Test that the text cells of the csv export are not evaluated as formulas
+func TestExportDevicesHandler_Formula(t *testing.T) {
+	client := upstreamClient(func(int) string {
+		return `{"result_list":[{"device_id":"42","display_name":"=1+2","latest_accurate_device_point":{"lat":33.6,"lng":-117.8}}]}`
+	})
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), client, nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/export?columns=display_name,lng", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	assert.NoError(t, err)
+	// Negative numbers are not escaped
+	assert.Equal(t, []string{"'=1+2", "-117.8"}, records[1])
+}
+
+// Test that the headers of the export are localized
+func TestExportDevicesHandler_Language(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("GET", "/devices/export?columns=device_id,lat", nil)
+	req.Header.Set("Accept-Language", "pt-BR, es-MX;q=0.8, en;q=0.5")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	header, _, _ := strings.Cut(rr.Body.String(), "\n")
+	assert.Equal(t, "ID del dispositivo,Latitud", header)
+
+	req = httptest.NewRequest("GET", "/devices/export?columns=device_id,lat&lang=de", nil)
+	req.Header.Set("Accept-Language", "es")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	header, _, _ = strings.Cut(rr.Body.String(), "\n")
+	assert.Equal(t, "Geräte-ID,Breitengrad", header)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/export?columns=device_id&lang=xx", nil))
+	header, _, _ = strings.Cut(rr.Body.String(), "\n")
+	assert.Equal(t, "Device ID", header)
+}
+
+// Test the excel export of the devices
+func TestExportDevicesHandler_XLSX(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/export?format=xlsx&columns=display_name,speed,lat", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", rr.Header().Get("Content-Type"))
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	assert.NoError(t, err)
+	names := make([]string, 0)
+	var sheet string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+		if file.Name == "xl/worksheets/sheet1.xml" {
+			reader, err := file.Open()
+			assert.NoError(t, err)
+			content, _ := io.ReadAll(reader)
+			sheet = string(content)
+		}
+	}
+	assert.Equal(t, []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"}, names)
+	assert.Contains(t, sheet, `<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">Name</t></is></c>`)
+	// The missing speed is left empty and the latitude keeps its column
+	assert.Contains(t, sheet, `<row r="2"><c r="A2" t="inlineStr"><is><t xml:space="preserve">abc 1</t></is></c><c r="C2" t="n"><v>47.7525234</v></c></row>`)
+	assert.True(t, strings.HasSuffix(sheet, "</sheetData></worksheet>"))
+}
+
+// Test the export with invalid params
+func TestExportDevicesHandler_Invalid(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	for _, target := range []string{"/devices/export?format=pdf", "/devices/export?columns=device_id,color"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/export?view=unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
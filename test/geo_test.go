@@ -0,0 +1,135 @@
+package test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test the GeoJSON format of the devices api
+func TestDevicesHandler_GeoJSON(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.NumberOfRows = 2
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "6", Hidden: true}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?format=geojson&fields=display_name,lat,drive_status", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, handler.GeoJSONContentType, rr.Header().Get("Content-Type"))
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			ID       string `json:"id"`
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&collection))
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	// The geographic formats are not paginated
+	assert.Equal(t, 9, len(collection.Features))
+	assert.Equal(t, "7", collection.Features[0].ID)
+	assert.Equal(t, "Point", collection.Features[0].Geometry.Type)
+	assert.Equal(t, []float64{-117.7946942, 33.6839473, 30.45}, collection.Features[0].Geometry.Coordinates)
+	assert.Equal(t, map[string]any{"display_name": "def 3", "drive_status": "on"}, collection.Features[0].Properties)
+
+	// The format is negotiated from the Accept header
+	req := httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set("Accept", "text/html, application/geo+json;q=0.9")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, handler.GeoJSONContentType, rr.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", rr.Header().Get("Vary"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?format=shp", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// Test the KML format of the devices api
+func TestDevicesHandler_KML(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "7", Image: "/images/7.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("GET", "http://fleet.example.com/api/v1/devices?fields=device_id,online", nil)
+	req.Header.Set("Accept", handler.KMLContentType)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, handler.KMLContentType, rr.Header().Get("Content-Type"))
+	var document struct {
+		Placemarks []struct {
+			ID   string `xml:"id,attr"`
+			Name string `xml:"name"`
+			Icon string `xml:"Style>IconStyle>Icon>href"`
+			Data []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value"`
+			} `xml:"ExtendedData>Data"`
+			Coordinates string `xml:"Point>coordinates"`
+		} `xml:"Document>Placemark"`
+	}
+	assert.NoError(t, xml.NewDecoder(rr.Body).Decode(&document))
+	assert.Equal(t, 10, len(document.Placemarks))
+	placemark := document.Placemarks[1]
+	assert.Equal(t, "def 3", placemark.Name)
+	// Icons stored on the server are linked with absolute urls
+	assert.Equal(t, "http://fleet.example.com/images/7.png", placemark.Icon)
+	assert.Equal(t, "-117.7946942,33.6839473,30.45", placemark.Coordinates)
+	assert.Equal(t, 2, len(placemark.Data))
+	assert.Equal(t, "false", placemark.Data[1].Value)
+	assert.Equal(t, handler.DefaultImagePath, document.Placemarks[0].Icon)
+}
+
+// Test that the GPX format holds the positions recorded every time the devices were fetched
+func TestDevicesHandler_GPX(t *testing.T) {
+	positions := []string{
+		`"lat":34.5,"lng":-118.25,"altitude":12,"dt_tracker":"2024-03-01T10:00:00Z","device_state":{"drive_status":"driving"}`,
+		`"lat":34.5,"lng":-118.25,"altitude":12,"dt_tracker":"2024-03-01T10:01:00Z","device_state":{"drive_status":"driving"}`,
+		`"lat":34.6,"lng":-118.2,"altitude":15,"dt_tracker":"2024-03-01T10:02:00Z","device_state":{"drive_status":"driving"}`,
+	}
+	client := upstreamClient(func(request int) string {
+		return fmt.Sprintf(`{"result_list":[{"device_id":"42","display_name":"Truck","latest_accurate_device_point":{%s}}]}`, positions[request-1])
+	})
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), client, nil))
+
+	var rr *httptest.ResponseRecorder
+	for range positions {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?format=gpx", nil))
+	}
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, handler.GPXContentType, rr.Header().Get("Content-Type"))
+	var document struct {
+		XMLName xml.Name
+		Version string `xml:"version,attr"`
+		Tracks  []struct {
+			Name   string `xml:"name"`
+			Points []struct {
+				Lat  float64 `xml:"lat,attr"`
+				Lon  float64 `xml:"lon,attr"`
+				Time string  `xml:"time"`
+			} `xml:"trkseg>trkpt"`
+		} `xml:"trk"`
+	}
+	assert.NoError(t, xml.NewDecoder(rr.Body).Decode(&document))
+	assert.Equal(t, "http://www.topografix.com/GPX/1/1", document.XMLName.Space)
+	assert.Equal(t, "1.1", document.Version)
+	assert.Equal(t, 1, len(document.Tracks))
+	assert.Equal(t, "Truck", document.Tracks[0].Name)
+	// The position which did not change is recorded once
+	assert.Equal(t, 2, len(document.Tracks[0].Points))
+	assert.Equal(t, 34.6, document.Tracks[0].Points[1].Lat)
+	assert.Equal(t, "2024-03-01T10:02:00Z", document.Tracks[0].Points[1].Time)
+}
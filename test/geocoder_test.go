@@ -0,0 +1,117 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test the datasets of places
+func TestLoadPlaces(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		dataset string
+		places  []handler.Place
+		err     string
+	}{
+		{"country,Latitude,longitude,name\nUS,34.5,-118.25,Depot\nUS,34.53,-118.25,Yard\n", []handler.Place{
+			{Name: "Depot", Country: "US", Lat: 34.5, Lng: -118.25},
+			{Name: "Yard", Country: "US", Lat: 34.53, Lng: -118.25},
+		}, ""},
+		// A line of the cities500.txt file of GeoNames
+		{"5368361\tLos Angeles\tLos Angeles\tLA,\"L.A.\"\t34.05223\t-118.24368\tP\tPPLA2\tUS\t\tCA\t037\t\t\t3971883\t89\t115\tAmerica/Los_Angeles\t2019-09-05\n", []handler.Place{
+			{Name: "Los Angeles", Admin: "CA", Country: "US", Lat: 34.05223, Lng: -118.24368},
+		}, ""},
+		{"name,lat,lng\nDepot,134.5,-118.25\n", nil, "line 2: lat must be a number between -90 and 90"},
+		{"name,lat,lng\n,34.5,-118.25\n", nil, "line 2: the place has no name"},
+		{"name,lat,lng\n", nil, "the dataset holds no places"},
+	}
+	for idx, test := range tests {
+		path := filepath.Join(dir, "places.csv")
+		assert.NoError(t, os.WriteFile(path, []byte(test.dataset), 0644))
+		places, err := handler.LoadPlaces(path)
+		if test.err == "" {
+			assert.NoError(t, err, idx)
+			assert.Equal(t, test.places, places, idx)
+		} else {
+			assert.EqualError(t, err, test.err, idx)
+		}
+	}
+	places, err := handler.BundledPlaces()
+	assert.NoError(t, err)
+	assert.Less(t, 100, len(places))
+}
+
+// Test the addresses of the devices resolved from the bundled places
+func TestDevicesHandlerAddress(t *testing.T) {
+	places, err := handler.BundledPlaces()
+	assert.NoError(t, err)
+	apiHandler := handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil)
+	apiHandler.SetPlaces(places)
+	router := handler.NewRouter(apiHandler)
+
+	response := getJSON[handler.GetDevicesResponse](t, router, "", "/devices?page_size=-1")
+	addresses := make(map[string]*handler.Address)
+	for _, device := range response.Devices {
+		addresses[device.DeviceID] = device.Address
+	}
+	// Device 9 is in Central Park
+	assert.Equal(t, "New York", addresses["9"].Place)
+	assert.Equal(t, "New York", addresses["9"].Admin)
+	assert.Equal(t, "US", addresses["9"].Country)
+	assert.InDelta(t, 8500, addresses["9"].Distance, 500)
+	assert.Equal(t, "London", addresses["5"].Place)
+	assert.Equal(t, "Irvine", addresses["7"].Place)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/10", nil))
+	var device handler.GetDeviceResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &device))
+	assert.Equal(t, "Toronto", device.Device.Address.Place)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/export?columns=device_id,address", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "\n9,\"New York, New York, US\"")
+}
+
+// Test that a location far from every place has no address
+func TestDevicesHandlerAddressTooFar(t *testing.T) {
+	apiHandler := handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil)
+	apiHandler.SetPlaces([]handler.Place{{Name: "Honolulu", Lat: 21.3, Lng: -157.85}, {Name: "New York", Lat: 40.71, Lng: -74.01}})
+	router := handler.NewRouter(apiHandler)
+
+	for _, device := range getJSON[handler.GetDevicesResponse](t, router, "", "/devices?page_size=-1").Devices {
+		if device.DeviceID == "9" {
+			assert.Equal(t, "New York", device.Address.Place)
+		} else {
+			assert.Nil(t, device.Address, device.DeviceID)
+		}
+	}
+}
+
+// Test the addresses of the trips and the recorded positions of a device
+func TestTripsAddress(t *testing.T) {
+	router := tripsRouter(t, func(apiHandler *handler.Handler) {
+		apiHandler.SetPlaces([]handler.Place{{Name: "Depot", Lat: 34.5, Lng: -118.25}, {Name: "Yard", Lat: 34.53, Lng: -118.25}})
+	})
+	trips := getTrips(t, router, "/devices/42/trips")
+	assert.Equal(t, 2, len(trips))
+	assert.Equal(t, &handler.Address{Place: "Depot"}, trips[0].Start.Address)
+	assert.Equal(t, "Yard", trips[0].End.Address.Place)
+	assert.InDelta(t, 1100, trips[0].End.Address.Distance, 50)
+	assert.Equal(t, "Yard", trips[1].End.Address.Place)
+	assert.Equal(t, "Yard", getTrips(t, router, "/trips")[1].End.Address.Place)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?format=gpx", nil))
+	truck, _, _ := strings.Cut(rr.Body.String(), "<name>Van</name>")
+	assert.Equal(t, 3, strings.Count(truck, "<desc>Depot</desc>"))
+	assert.Equal(t, 3, strings.Count(truck, "<desc>Yard</desc>"))
+}
@@ -18,10 +18,13 @@ import (
 
 // MockPreferences for testing purpose
 type MockPreferences struct {
-	SortColumn        string                   `json:"sort_column"`
-	Ascending         bool                     `json:"ascending"`
-	NumberOfRows      int                      `json:"number_of_rows"`
-	DevicePreferences []data.DevicePreferences `json:"device_preferences"`
+	Version           int                        `json:"-"`
+	SortColumn        string                     `json:"sort_column"`
+	Ascending         bool                       `json:"ascending"`
+	NumberOfRows      int                        `json:"number_of_rows"`
+	DevicePreferences []data.DevicePreferences   `json:"device_preferences"`
+	Views             map[string][]data.View     `json:"views,omitempty"`
+	GroupThresholds   map[string]data.Thresholds `json:"group_thresholds,omitempty"`
 }
 
 var testPreferences *MockPreferences
@@ -51,9 +54,31 @@ func (preferences *MockPreferences) GetNumberOfRows() int {
 	return preferences.NumberOfRows
 }
 
-func (preferences *MockPreferences) SetDevicePreferences(devicePreferences []data.DevicePreferences) error {
+func (preferences *MockPreferences) GetVersion() int {
+	return preferences.Version
+}
+
+func (preferences *MockPreferences) SetVersion(version int) {
+	preferences.Version = version
+}
+
+func (preferences *MockPreferences) GetViews() map[string][]data.View {
+	return preferences.Views
+}
+
+func (preferences *MockPreferences) SetViews(user string, views []data.View) {
+	if preferences.Views == nil {
+		preferences.Views = make(map[string][]data.View)
+	}
+	preferences.Views[user] = views
+}
+
+func (preferences *MockPreferences) GetThresholds() map[string]data.Thresholds {
+	return preferences.GroupThresholds
+}
+
+func (preferences *MockPreferences) SetDevicePreferences(devicePreferences []data.DevicePreferences) {
 	preferences.DevicePreferences = devicePreferences
-	return nil
 }
 
 // GetNewPreferences function to return a new mock preferences object with default data
@@ -64,8 +89,8 @@ func GetNewPreferences() *MockPreferences {
 // TestPreferencesHandler_POST function to test the POST request of preferences api
 func TestPreferencesHandler_POST(t *testing.T) {
 	var preferences = GetNewPreferences()
-	apiHandler := handler.NewHandler(preferences, &http.Client{}, nil)
-	var jsonStr = []byte(`{"sort_column":"lat","ascending":false,"number_of_rows":10,"device_preferences":[{"device_id":"abc123","display_name":"Device 1","hidden":false,"image":""}]}`)
+	apiHandler := handler.NewHandler(preferences, mockDevicesClient(t), nil)
+	var jsonStr = []byte(`{"sort_column":"lat","ascending":false,"number_of_rows":10,"device_preferences":[{"device_id":"1","display_name":"Device 1","hidden":false,"image":""}]}`)
 
 	formBuf := new(bytes.Buffer)
 	multipartWriter := multipart.NewWriter(formBuf)
@@ -82,7 +107,7 @@ func TestPreferencesHandler_POST(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handlerFunc := http.HandlerFunc(apiHandler.PreferencesHandler)
+	handlerFunc := http.HandlerFunc(apiHandler.SavePreferencesHandler)
 
 	handlerFunc.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
@@ -120,7 +145,7 @@ func TestPreferencesHandlerError_POST(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handlerFunc := http.HandlerFunc(apiHandler.PreferencesHandler)
+	handlerFunc := http.HandlerFunc(apiHandler.SavePreferencesHandler)
 
 	handlerFunc.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
@@ -133,17 +158,14 @@ func TestPreferencesHandlerError_InvalidMethods(t *testing.T) {
 	apiHandler := handler.NewHandler(preferences, &http.Client{}, nil)
 	req, _ := http.NewRequest("PUT", "/preferences", formBuf)
 	rr := httptest.NewRecorder()
-	handlerFunc := http.HandlerFunc(apiHandler.PreferencesHandler)
-	handlerFunc.ServeHTTP(rr, req)
-
-	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	router := handler.NewRouter(apiHandler)
+	router.ServeHTTP(rr, req)
 
-	req, _ = http.NewRequest("PATCH", "/preferences", formBuf)
-	handlerFunc.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD, PATCH, POST", rr.Header().Get("Allow"))
 
-	req, _ = http.NewRequest("DELETE", "/preferences", formBuf)
-	handlerFunc.ServeHTTP(rr, req)
+	req, _ = http.NewRequest("DELETE", "/api/v1/preferences", formBuf)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 }
 
@@ -165,7 +187,7 @@ func TestPreferencesHandler_GET(t *testing.T) {
 	formBuf := new(bytes.Buffer)
 	req, _ := http.NewRequest("GET", "/preferences", formBuf)
 	rr := httptest.NewRecorder()
-	handlerFunc := http.HandlerFunc(apiHandler.PreferencesHandler)
+	handlerFunc := http.HandlerFunc(apiHandler.GetPreferencesHandler)
 	handlerFunc.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
 
@@ -189,6 +211,23 @@ func (r *FileSystemMock) Create(name string) (*os.File, error) {
 var serverFileName string
 var uploadedFileContent string
 
+func (r *FileSystemMock) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (r *FileSystemMock) MkdirTemp(dir string, pattern string) (string, error) {
+	return dir + "/" + pattern + "mock", nil
+}
+
+func (r *FileSystemMock) Rename(oldPath string, newPath string) error {
+	serverFileName = "/" + newPath
+	return nil
+}
+
+func (r *FileSystemMock) RemoveAll(path string) error {
+	return nil
+}
+
 func (r *FileSystemMock) Copy(dst *os.File, src multipart.File) (written int64, err error) {
 	Buf, err := io.ReadAll(src)
 	uploadedFileContent = string(Buf)
@@ -237,8 +276,8 @@ func TestUpload_POST(t *testing.T) {
 		t.Fatalf("failed to decode response body: %v", err)
 	}
 
-	// Check the response message
-	expectedMessage := "/images/1.png"
+	// Check the response message. The name of the image holds the hash of its content
+	expectedMessage := "/images/1-a7121fec2e126645.png"
 	assert.Equal(t, expectedMessage, resp.Message)
 
 	expectedFileContent, err := os.ReadFile("images/default.png")
@@ -247,13 +286,31 @@ func TestUpload_POST(t *testing.T) {
 	assert.Equal(t, expectedMessage, serverFileName)
 }
 
+// Test that the upload api rejects the device ids which could write the image outside of the images directory
+func TestUpload_InvalidDeviceId(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), nil, &FileSystemMock{}))
+	for _, target := range []string{"/upload?device_id=../evil", "/upload?device_id=a/b", `/upload?device_id=a\b`, "/upload", "/devices/..%2Fevil/icon"} {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "icon.png")
+		assert.NoError(t, err)
+		part.Write([]byte("icon"))
+		writer.Close()
+		req := httptest.NewRequest("POST", target, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, target)
+	}
+}
+
 // Test for get image api
 func TestImage_GET(t *testing.T) {
 	formBuf := new(bytes.Buffer)
 	req, _ := http.NewRequest("GET", "/images/default.png", formBuf)
 	rr := httptest.NewRecorder()
-	handlerFunc := http.HandlerFunc(handler.ImageHandler)
-	handlerFunc.ServeHTTP(rr, req)
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), nil, nil))
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
 
@@ -271,23 +328,24 @@ func TestImage_OtherMethods(t *testing.T) {
 	formBuf := new(bytes.Buffer)
 	req, _ := http.NewRequest("POST", "/images/default.png", formBuf)
 	rr := httptest.NewRecorder()
-	handlerFunc := http.HandlerFunc(handler.ImageHandler)
-	handlerFunc.ServeHTTP(rr, req)
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), nil, nil))
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD", rr.Header().Get("Allow"))
 
 	req, _ = http.NewRequest("PUT", "/images/default.png", formBuf)
 	rr = httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 
 	req, _ = http.NewRequest("PATCH", "/images/default.png", formBuf)
 	rr = httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 
 	req, _ = http.NewRequest("DELETE", "/images/default.png", formBuf)
 	rr = httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 }
 
@@ -429,25 +487,26 @@ func TestDevicesHandler_OtherMethods(t *testing.T) {
 	preferences := &MockPreferences{NumberOfRows: 5, Ascending: true, SortColumn: "display_name", DevicePreferences: append(devicePreferences, data.DevicePreferences{Image: "images/default.png", DeviceID: "1", Hidden: false, DisplayName: "Test 1"})}
 	apiHandler := handler.NewHandler(preferences, nil, nil)
 	formBuf := new(bytes.Buffer)
-	handlerFunc := http.HandlerFunc(apiHandler.DevicesHandler)
+	router := handler.NewRouter(apiHandler)
 	req, _ := http.NewRequest("POST", "/devices?page=2", formBuf)
 	rr := httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD", rr.Header().Get("Allow"))
 
 	req, _ = http.NewRequest("PUT", "/devices?page=2", formBuf)
 	rr = httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 
 	req, _ = http.NewRequest("PATCH", "/devices?page=2", formBuf)
 	rr = httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 
-	req, _ = http.NewRequest("DELETE", "/devices?page=2", formBuf)
+	req, _ = http.NewRequest("DELETE", "/api/v1/devices?page=2", formBuf)
 	rr = httptest.NewRecorder()
-	handlerFunc.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
 }
 
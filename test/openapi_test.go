@@ -0,0 +1,130 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var updateOpenApi = flag.Bool("update", false, "update the openapi.json golden file")
+
+// serveOpenApi returns the specification served by the openapi api
+func serveOpenApi(t *testing.T) []byte {
+	t.Helper()
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), nil, nil))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	return rr.Body.Bytes()
+}
+
+// Test that the served specification matches the reviewed openapi.json. Run the tests with -update after changing
+// an api or one of its structures to regenerate the file
+func TestOpenApi_Golden(t *testing.T) {
+	actual := serveOpenApi(t)
+	if *updateOpenApi {
+		assert.NoError(t, os.WriteFile("openapi.json", actual, 0644))
+	}
+	expected, err := os.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(t, string(expected), string(actual))
+}
+
+// Test that every api served by the router is described in the specification
+func TestOpenApi_CoversRoutes(t *testing.T) {
+	var spec map[string]any
+	assert.NoError(t, json.Unmarshal(serveOpenApi(t), &spec))
+	paths := spec["paths"].(map[string]any)
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), nil, nil))
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			concrete := strings.NewReplacer("{id}", "1", "{name}", "default.png").Replace(path)
+			req := httptest.NewRequest(strings.ToUpper(method), spec["servers"].([]any)[0].(map[string]any)["url"].(string)+concrete, nil)
+			_, pattern := router.Handler(req)
+			assert.NotEmpty(t, pattern, "%s %s is not served", method, path)
+		}
+	}
+}
+
+// Test that the recorded responses of the apis only contain the fields described in the specification
+func TestOpenApi_ResponsesMatchSchemas(t *testing.T) {
+	var spec map[string]any
+	assert.NoError(t, json.Unmarshal(serveOpenApi(t), &spec))
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+
+	for _, file := range []string{"device_response_1.json", "device_response_3.json"} {
+		var payload any
+		content, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(bytes.NewReader(content)).Decode(&payload))
+		assert.NoError(t, validateSchema(schemas, schemas["GetDevicesResponse"].(map[string]any), payload, file))
+	}
+
+	var payload any
+	assert.NoError(t, json.Unmarshal([]byte(`{"version":3,"sort_column":"display_name","ascending":true,"number_of_rows":5,"device_preferences":[{"device_id":"1","display_name":"Test 1","hidden":false,"image":""}]}`), &payload))
+	assert.NoError(t, validateSchema(schemas, schemas["PreferencesImpl"].(map[string]any), payload, "preferences"))
+}
+
+// validateSchema returns an error when the value does not match the schema
+func validateSchema(schemas map[string]any, schema map[string]any, value any, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		return validateSchema(schemas, schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any), value, path)
+	}
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object", path)
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for key, field := range object {
+			property, ok := properties[key]
+			if !ok {
+				return fmt.Errorf("%s.%s: field is not described", path, key)
+			}
+			if err := validateSchema(schemas, property.(map[string]any), field, path+"."+key); err != nil {
+				return err
+			}
+		}
+		required, _ := schema["required"].([]any)
+		for _, key := range required {
+			if _, ok := object[key.(string)]; !ok {
+				return fmt.Errorf("%s.%s: required field is missing", path, key)
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an array", path)
+		}
+		for idx, item := range array {
+			if err := validateSchema(schemas, schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected a string", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean", path)
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected a number", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// getDevices requests the devices api and decodes the response
+func getDevices(t *testing.T, router http.Handler, target string) (*httptest.ResponseRecorder, handler.GetDevicesResponse) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	var response handler.GetDevicesResponse
+	if rr.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	}
+	return rr, response
+}
+
+// Test walking through the devices with the cursors of the responses
+func TestDevicesHandler_Cursor(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.NumberOfRows = 4
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr, response := getDevices(t, router, "/api/v1/devices")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 10, response.TotalCount)
+	assert.Equal(t, 3, response.TotalPages)
+	assert.Empty(t, response.PreviousCursor)
+	seen := make([]string, 0)
+	for _, device := range response.Devices {
+		seen = append(seen, device.DisplayName)
+	}
+	next := "/api/v1/devices?cursor=" + url.QueryEscape(response.NextCursor)
+	assert.Equal(t, []string{
+		`</api/v1/devices>; rel="first"`,
+		"<" + next + `>; rel="next"`,
+	}, rr.Header().Values("Link"))
+
+	rr, response = getDevices(t, router, next)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 2, response.PageNumber)
+	assert.True(t, response.PreviousPage)
+	second := response
+	for _, device := range response.Devices {
+		seen = append(seen, device.DisplayName)
+	}
+
+	rr, response = getDevices(t, router, "/devices?cursor="+url.QueryEscape(response.NextCursor))
+	assert.False(t, response.NextPage)
+	assert.Empty(t, response.NextCursor)
+	for _, device := range response.Devices {
+		seen = append(seen, device.DisplayName)
+	}
+	assert.Equal(t, []string{"abc 1", "def 3", "hij 8", "lmn 2", "opq 4", "pqr 7", "rst 6", "Test 1", "uvw 5", "xyz 4"}, seen)
+
+	// The previous cursor returns the devices before the first device of the page
+	rr, response = getDevices(t, router, "/devices?cursor="+url.QueryEscape(second.PreviousCursor))
+	assert.Equal(t, 4, len(response.Devices))
+	assert.Equal(t, "abc 1", response.Devices[0].DisplayName)
+	assert.False(t, response.PreviousPage)
+
+	// Pages after the cursor do not shift when devices before it are hidden
+	preferences.DevicePreferences = append(preferences.DevicePreferences, data.DevicePreferences{DeviceID: "6", Hidden: true}, data.DevicePreferences{DeviceID: "7", Hidden: true})
+	rr, response = getDevices(t, router, "/devices?cursor="+url.QueryEscape(second.NextCursor))
+	assert.Equal(t, 8, response.TotalCount)
+	assert.Equal(t, "uvw 5", response.Devices[0].DisplayName)
+}
+
+// Test that the cursors walk through every entry of a device listed more than once by the one step api
+func TestDevicesHandler_CursorDuplicates(t *testing.T) {
+	preferences := GetNewPreferences()
+	// The device 1 is listed twice and both entries are equal in the sort keys
+	preferences.SortColumn = "device_id"
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr, response := getDevices(t, router, "/devices?page_size=1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	seen := []string{response.Devices[0].DisplayName}
+	for response.NextPage {
+		rr, response = getDevices(t, router, "/devices?page_size=1&cursor="+url.QueryEscape(response.NextCursor))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		seen = append(seen, response.Devices[0].DisplayName)
+	}
+	assert.Equal(t, 10, len(seen))
+	assert.ElementsMatch(t, []string{"Test 1", "rst 6"}, seen[:2])
+
+	for response.PreviousPage {
+		rr, response = getDevices(t, router, "/devices?page_size=1&cursor="+url.QueryEscape(response.PreviousCursor))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		seen = seen[:len(seen)-1]
+		assert.Equal(t, seen[len(seen)-1], response.Devices[0].DisplayName)
+	}
+	assert.Equal(t, 1, len(seen))
+}
+
+// Test the page size param and invalid cursors
+func TestDevicesHandler_PageSize(t *testing.T) {
+	preferences := GetNewPreferences()
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr, response := getDevices(t, router, "/devices?page=2&page_size=3")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 3, len(response.Devices))
+	assert.Equal(t, "lmn 2", response.Devices[0].DisplayName)
+	assert.Equal(t, 4, response.TotalPages)
+	assert.Equal(t, 3, len(rr.Header().Values("Link")))
+
+	rr, response = getDevices(t, router, "/devices")
+	assert.Equal(t, 10, len(response.Devices))
+	assert.Equal(t, 1, response.TotalPages)
+
+	rr, _ = getDevices(t, router, "/devices?page_size=0")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr, _ = getDevices(t, router, "/devices?cursor=invalid")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Cursors can not be used after the sort order changed
+	_, response = getDevices(t, router, "/devices?page_size=2")
+	preferences.SortColumn = "lat"
+	rr, _ = getDevices(t, router, "/devices?page_size=2&cursor="+url.QueryEscape(response.NextCursor))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// playbackRouter returns the router of a handler which fetched all the tripPositions of device 42, which is a truck,
+// while device 43 is hidden
+func playbackRouter(t *testing.T) *http.ServeMux {
+	t.Helper()
+	return tripsRouter(t, func(apiHandler *handler.Handler) {
+		preferences := GetNewPreferences()
+		preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "42", Groups: []string{"Trucks"}}, {DeviceID: "43", Hidden: true}}
+		apiHandler.Preferences = data.NewPreferencesStore(preferences, data.NewMemoryHistory())
+	})
+}
+
+// getPlayback returns the playback of the response of the request
+func getPlayback(t *testing.T, router *http.ServeMux, target string) handler.GetPlaybackResponse {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var response handler.GetPlaybackResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response
+}
+
+// Test the snapshots interpolated from the recorded positions
+func TestPlaybackHandler(t *testing.T) {
+	router := playbackRouter(t)
+	response := getPlayback(t, router, "/playback?from=2024-03-01T09:59:30Z&to=2024-03-01T10:03:00Z&step=30s&group=trucks")
+	assert.Equal(t, 30.0, response.Step)
+	assert.Equal(t, 8, len(response.Frames))
+	// The truck has no recorded position before 10:00
+	assert.Equal(t, 0, len(response.Frames[0].Devices))
+	assert.Equal(t, "2024-03-01T10:01:30Z", response.Frames[4].Time.Format("2006-01-02T15:04:05Z07:00"))
+	position := response.Frames[4].Devices[0]
+	assert.Equal(t, "42", position.DeviceID)
+	assert.Equal(t, "Truck", position.DisplayName)
+	assert.InDelta(t, 34.505, position.Lat, 1e-9)
+	assert.Equal(t, "on", position.DriveStatus)
+	assert.InDelta(t, 34.52, response.Frames[7].Devices[0].Lat, 1e-9)
+	assert.Equal(t, "off", response.Frames[7].Devices[0].DriveStatus)
+
+	// The truck stays at its last recorded position, and the hidden van is never played back
+	response = getPlayback(t, router, "/api/v1/playback?from=2024-03-01T12:00:00Z&to=2024-03-01T12:00:00Z")
+	assert.Equal(t, 1, len(response.Frames))
+	assert.Equal(t, 1, len(response.Frames[0].Devices))
+	assert.InDelta(t, 34.53, response.Frames[0].Devices[0].Lat, 1e-9)
+	response = getPlayback(t, router, "/playback?from=2024-03-01T10:00:00Z&to=2024-03-01T10:03:00Z&group=Vans")
+	assert.Equal(t, 4, len(response.Frames))
+	assert.Equal(t, 0, len(response.Frames[3].Devices))
+
+	for _, target := range []string{
+		"/playback?from=2024-03-01T10:00:00Z",
+		"/playback?from=2024-03-01T10:00:00Z&to=2024-03-01T11:00:00Z&step=0s",
+		"/playback?from=2024-03-01T10:00:00Z&to=2024-03-01T11:00:00Z&step=1s",
+		"/playback/stream?from=2024-03-01T10:00:00Z&to=2024-03-01T11:00:00Z&speed=0",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, target)
+	}
+}
+
+// Test the snapshots streamed as server sent events
+func TestPlaybackStreamHandler(t *testing.T) {
+	router := playbackRouter(t)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/playback/stream?from=2024-03-01T10:00:00Z&to=2024-03-01T10:02:00Z&speed=3600", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+	events := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+	assert.Equal(t, 4, len(events))
+	assert.Equal(t, "event: end\ndata: {}", events[3])
+	encoded, ok := strings.CutPrefix(events[2], "event: frame\ndata: ")
+	assert.True(t, ok)
+	var frame handler.PlaybackFrame
+	assert.NoError(t, json.Unmarshal([]byte(encoded), &frame))
+	assert.InDelta(t, 34.51, frame.Devices[0].Lat, 1e-9)
+}
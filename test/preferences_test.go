@@ -0,0 +1,243 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test the post request of preferences api with a json body
+func TestPreferencesHandler_POSTJSON(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1", DisplayName: "Test 1", Image: "/images/1.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("POST", "/api/v1/preferences", strings.NewReader(`{"sort_column":"lat","device_preferences":[{"device_id":"2","hidden":true}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.Equal(t, "lat", testPreferences.GetSortColumn())
+	assert.Equal(t, -1, testPreferences.GetNumberOfRows())
+	// The device preferences are replaced instead of being merged into the previous ones
+	assert.Equal(t, []data.DevicePreferences{{DeviceID: "2", Hidden: true}}, testPreferences.GetDevicePreferences())
+}
+
+// Test the patch request of preferences api keeps the fields which are not part of the patch
+func TestPreferencesHandler_PATCH(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.NumberOfRows = 10
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1", DisplayName: "Test 1", Image: "/images/1.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("PATCH", "/preferences", strings.NewReader(`{"ascending":false}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.False(t, testPreferences.IsAscending())
+	assert.Equal(t, "display_name", testPreferences.GetSortColumn())
+	assert.Equal(t, 10, testPreferences.GetNumberOfRows())
+	assert.Equal(t, "/images/1.png", testPreferences.GetDevicePreferences()[0].Image)
+
+	req = httptest.NewRequest("PATCH", "/preferences", strings.NewReader(`{"ascending":`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// Test that a null of the patch request of preferences api removes the field
+func TestPreferencesHandler_PATCHNull(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.SortColumn = "lat"
+	preferences.Views = map[string][]data.View{"alice": {{Name: "Trucks", NumberOfRows: -1}}}
+	preferences.GroupThresholds = map[string]data.Thresholds{"Vans": {IdleSeconds: 60}, "Trucks": {StopSeconds: 600}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := serveRequest(router, "", "PATCH", "/preferences", `{"views": null, "sort_column": null, "group_thresholds": {"Vans": null}}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Nil(t, preferences.Views)
+	assert.Equal(t, "display_name", preferences.SortColumn)
+	assert.Equal(t, map[string]data.Thresholds{"Trucks": {StopSeconds: 600}}, preferences.GroupThresholds)
+	assert.NotContains(t, rr.Body.String(), "views")
+}
+
+// Test the patch request of the preferences of a single device
+func TestDevicePreferencesHandler_PATCH(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{
+		{DeviceID: "1", DisplayName: "Test 1", Image: "/images/1.png"},
+		{DeviceID: "2", DisplayName: "xyz 4", Image: "/images/2.png"},
+	}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/v1/preferences/devices/2", strings.NewReader(`{"hidden":true,"device_id":"3"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response data.DevicePreferences
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, data.DevicePreferences{DeviceID: "2", DisplayName: "xyz 4", Image: "/images/2.png", Hidden: true}, response)
+	assert.Equal(t, response, testPreferences.GetDevicePreferences()[1])
+	assert.False(t, testPreferences.GetDevicePreferences()[0].Hidden)
+
+	// Devices without stored preferences start from the default preferences
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/preferences/devices/6", strings.NewReader(`{"groups":["west"]}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 3, len(testPreferences.GetDevicePreferences()))
+	assert.Equal(t, []string{"west"}, testPreferences.GetDevicePreferences()[2].Groups)
+	assert.Equal(t, handler.DefaultImagePath, testPreferences.GetDevicePreferences()[2].Image)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/preferences/devices/unknown", strings.NewReader(`{"hidden":true}`)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// Test that malformed json bodies are rejected with the parse error and the stored preferences are kept
+func TestPreferencesHandler_MalformedJSON(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "7", DisplayName: "Truck", Image: "/images/7.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		err    string
+	}{
+		{"POST", "/preferences", `{"sort_column":`, "unexpected end of JSON input"},
+		{"POST", "/preferences", `{"number_of_rows":"ten"}`, "cannot unmarshal string"},
+		{"PATCH", "/preferences", `{"ascending":false} {}`, "invalid character '{' after top-level value"},
+		{"PATCH", "/preferences", `[{"ascending":false}]`, "cannot unmarshal array"},
+		{"PATCH", "/preferences/devices/7", `{"hidden":`, "unexpected end of JSON input"},
+		{"PATCH", "/preferences/devices/7", `null`, "the patch must be a json object"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, test.body)
+		assert.Contains(t, rr.Body.String(), test.err, test.body)
+	}
+	assert.Equal(t, 0, preferences.GetVersion())
+	assert.Equal(t, []data.DevicePreferences{{DeviceID: "7", DisplayName: "Truck", Image: "/images/7.png"}}, preferences.GetDevicePreferences())
+}
+
+// Test that invalid preferences are rejected with the invalid fields and the stored preferences are kept
+func TestPreferencesHandler_Validation(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1", DisplayName: "Test 1", Image: "/images/1.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("POST", "/preferences", strings.NewReader(`{"sort_column":"speed","number_of_rows":0,"device_preferences":[{"device_id":"1"},{"device_id":"1"},{"device_id":"42"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var response handler.ValidationErrorResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	fields := make([]string, 0)
+	for _, fieldError := range response.Errors {
+		fields = append(fields, fieldError.Field)
+	}
+	assert.Equal(t, []string{"sort_column", "number_of_rows", "device_preferences[1].device_id", "device_preferences[2].device_id"}, fields)
+
+	assert.Equal(t, "display_name", preferences.GetSortColumn())
+	assert.Equal(t, -1, preferences.GetNumberOfRows())
+	assert.Equal(t, []data.DevicePreferences{{DeviceID: "1", DisplayName: "Test 1", Image: "/images/1.png"}}, preferences.GetDevicePreferences())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/preferences", strings.NewReader(`{"number_of_rows":-5}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, -1, preferences.GetNumberOfRows())
+}
+
+// Test that updates with a stale If-Match header are rejected
+func TestPreferencesHandler_IfMatch(t *testing.T) {
+	preferences := GetNewPreferences()
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/preferences", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	req := httptest.NewRequest("PATCH", "/preferences", strings.NewReader(`{"sort_column":"lat"}`))
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	// A colleague's update based on the first version is rejected
+	req = httptest.NewRequest("PATCH", "/preferences/devices/1", strings.NewReader(`{"hidden":true}`))
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+
+	req = httptest.NewRequest("POST", "/preferences", strings.NewReader(`{"sort_column":"lng"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+	assert.Equal(t, "lat", preferences.GetSortColumn())
+	assert.False(t, preferences.GetDevicePreferences()[0].Hidden)
+}
+
+// Test that changes are recorded in the history and can be reverted
+func TestPreferencesHandler_HistoryRevert(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1", DisplayName: "Test 1"}, {DeviceID: "2", DisplayName: "xyz 4"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("PATCH", "/preferences/devices/2", strings.NewReader(`{"hidden":true}`))
+	req.Header.Set(handler.UserHeader, "alice")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/preferences/history", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var history handler.GetHistoryResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&history))
+	assert.Equal(t, 2, len(history.Changes))
+	assert.Equal(t, 0, history.Changes[0].Version)
+	assert.Equal(t, data.SystemUser, history.Changes[0].User)
+	assert.Equal(t, 1, history.Changes[1].Version)
+	assert.Equal(t, "alice", history.Changes[1].User)
+	assert.Equal(t, []data.FieldChange{{Path: "device_preferences[1].hidden", Old: false, New: true}}, history.Changes[1].Diff)
+	assert.Nil(t, history.Changes[1].Snapshot)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/preferences/revert/0", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+	assert.False(t, preferences.GetDevicePreferences()[1].Hidden)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/preferences/history?snapshots=true", nil))
+	history = handler.GetHistoryResponse{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&history))
+	assert.Equal(t, 3, len(history.Changes))
+	revert := history.Changes[2]
+	assert.Equal(t, handler.AnonymousUser, revert.User)
+	assert.Equal(t, 0, *revert.RevertedTo)
+	assert.Equal(t, []data.FieldChange{{Path: "device_preferences[1].hidden", Old: true, New: false}}, revert.Diff)
+	assert.NotEmpty(t, revert.Snapshot)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/preferences/revert/42", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// upstreamPoint is a one step api response holding a device with all the fields of the latest point
+const upstreamPoint = `{"result_list":[{"device_id":"42","display_name":"Truck","active_state":"active","online":true,
+"latest_accurate_device_point":{"lat":34.5,"lng":-118.25,"altitude":12,"speed":0,"angle":270.5,"odometer":10234.7,
+"battery_voltage":12.6,"fuel_level":55,"dt_tracker":"2024-03-01T10:15:00Z","dt_server":"2024-03-01T10:15:02Z",
+"device_state":{"drive_status":"idle"}}}]}`
+
+// Test that the additional fields of the latest point are decoded from the one step api
+func TestDevicesHandler_PointFields(t *testing.T) {
+	client := upstreamClient(func(int) string {
+		return upstreamPoint
+	})
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), client, nil))
+
+	rr, response := getDevices(t, router, "/devices")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	point := response.Devices[0].LatestDevicePoint
+	// A speed of 0 is kept instead of being dropped as a missing value
+	assert.NotNil(t, point.Speed)
+	assert.Equal(t, 0.0, *point.Speed)
+	assert.Equal(t, 270.5, *point.Angle)
+	assert.Equal(t, 10234.7, *point.Odometer)
+	assert.Equal(t, 12.6, *point.BatteryVoltage)
+	assert.Equal(t, 55.0, *point.FuelLevel)
+	assert.Equal(t, time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC), *point.DtTracker)
+	assert.Equal(t, time.Date(2024, 3, 1, 10, 15, 2, 0, time.UTC), *point.DtServer)
+
+	rr, _ = getDevices(t, router, "/devices?fields=device_id,speed,dt_tracker")
+	assert.JSONEq(t, `{"device_id":"42","latest_accurate_device_point":{"speed":0,"dt_tracker":"2024-03-01T10:15:00Z"}}`, devicesJSON(t, rr)[0])
+}
+
+// Test that the devices only hold the requested fields
+func TestDevicesHandler_Fields(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	rr, _ := getDevices(t, router, "/devices?fields=device_id,lat,lng&page_size=2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	devices := devicesJSON(t, rr)
+	assert.Equal(t, 2, len(devices))
+	assert.JSONEq(t, `{"device_id":"6","latest_accurate_device_point":{"lat":47.7525234,"lng":-122.335277}}`, devices[0])
+
+	// Fields of devices without a value are left out
+	rr, _ = getDevices(t, router, "/devices?fields=display_name,speed,drive_status&page_size=1")
+	assert.JSONEq(t, `{"display_name":"abc 1","latest_accurate_device_point":{"device_state":{"drive_status":"on"}}}`, devicesJSON(t, rr)[0])
+
+	rr, _ = getDevices(t, router, "/devices?fields=device_id,color")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// devicesJSON returns the json encoding of every device in the response of the devices api
+func devicesJSON(t *testing.T, rr *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var response struct {
+		Devices []json.RawMessage `json:"devices"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	devices := make([]string, 0)
+	for _, device := range response.Devices {
+		devices = append(devices, string(device))
+	}
+	return devices
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// mockDevicesClient returns a http client which responds with the devices stored in api_response.json
+func mockDevicesClient(t *testing.T) *http.Client {
+	t.Helper()
+	expected, err := os.ReadFile("api_response.json")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return upstreamClient(func(int) string {
+		return string(expected)
+	})
+}
+
+// upstreamClient returns a http client whose one step api responds to the request with the given number, starting at
+// 1, with the body returned by respond
+func upstreamClient(respond func(request int) string) *http.Client {
+	var requests atomic.Int32
+	return &http.Client{
+		Transport: RoundTripFunc(func(req *http.Request) *http.Response {
+			body := respond(int(requests.Add(1)))
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}
+		}),
+	}
+}
+
+// upstreamServer starts a fake one step api. respond writes the response to the request with the given number,
+// starting at 1, and returns false to answer with the devices of api_response.json instead. Returns the server and the
+// number of requests it received
+func upstreamServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request, request int) bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	devices, err := os.ReadFile("api_response.json")
+	assert.NoError(t, err)
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if respond(w, r, int(requests.Add(1))) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(devices)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// serveRequest serves a request of the user, the anonymous user when empty, and returns the response
+func serveRequest(router http.Handler, user string, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != "" {
+		req.Header.Set(handler.UserHeader, user)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// getJSON serves a get request of the user for the target, asserts that it succeeded and returns the decoded response
+func getJSON[T any](t *testing.T, router http.Handler, user string, target string) T {
+	t.Helper()
+	rr := serveRequest(router, user, "GET", target, "")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var response T
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response
+}
+
+// Test that the versioned api and the legacy paths return the same devices
+func TestRouter_VersionedAlias(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	legacy := httptest.NewRecorder()
+	router.ServeHTTP(legacy, httptest.NewRequest("GET", "/devices", nil))
+	assert.Equal(t, http.StatusOK, legacy.Code)
+
+	versioned := httptest.NewRecorder()
+	router.ServeHTTP(versioned, httptest.NewRequest("GET", "/api/v1/devices", nil))
+	assert.Equal(t, http.StatusOK, versioned.Code)
+	assert.Equal(t, legacy.Body.String(), versioned.Body.String())
+}
+
+// Test the get api of a single device
+func TestRouter_DeviceByID(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "6", DisplayName: "abc 1", Image: "/images/6.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/devices/6", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response handler.GetDeviceResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, "abc 1", response.Device.DisplayName)
+	assert.Equal(t, "/images/6.png", response.Device.Image)
+	assert.Equal(t, "/images/6.png", response.Preferences.Image)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/devices/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/v1/devices/6", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD", rr.Header().Get("Allow"))
+}
+
+// Test that the get api of a single device answers conditional requests and is served from the cache
+func TestDeviceHandler_Conditional(t *testing.T) {
+	calls := 0
+	client := mockDevicesClient(t)
+	transport := client.Transport
+	client.Transport = RoundTripFunc(func(req *http.Request) *http.Response {
+		calls++
+		response, _ := transport.RoundTrip(req)
+		return response
+	})
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "6", Hidden: true, Groups: []string{"west"}}}
+	router := handler.NewRouter(handler.NewHandler(preferences, client, nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/6", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, rr.Header().Get("Last-Modified"))
+	var response handler.GetDeviceResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.True(t, response.Preferences.Hidden)
+	assert.Equal(t, []string{"west"}, response.Preferences.Groups)
+
+	req := httptest.NewRequest("GET", "/devices/6", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, 0, rr.Body.Len())
+	assert.Equal(t, 1, calls)
+}
+
+// Test the icon api of a device
+func TestRouter_DeviceIcon(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "1", Image: "/images/default.png"}}
+	router := handler.NewRouter(handler.NewHandler(preferences, nil, nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/devices/1/icon", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/devices/2/icon", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, handler.DefaultImagePath, rr.Header().Get("Location"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/v1/devices/2/icon", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD, POST", rr.Header().Get("Allow"))
+}
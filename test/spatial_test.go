@@ -0,0 +1,104 @@
+package test
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newYork is the location the spatial queries are made around, device 9 is located in New York
+const newYork = "40.7128,-74.0060"
+
+// spatialIds returns the ids of the devices of the response
+func spatialIds(response handler.GetDevicesResponse) []string {
+	ids := make([]string, 0)
+	for _, device := range response.Devices {
+		ids = append(ids, device.DeviceID)
+	}
+	return ids
+}
+
+// Test the devices inside a bounding box
+func TestDevicesHandlerBoundingBox(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+	// Device 1 is listed twice by the one step api, in Los Angeles and in Las Vegas
+	response := getJSON[handler.GetDevicesResponse](t, router, "", "/devices?bbox=-125,30,-110,50")
+	assert.ElementsMatch(t, []string{"1", "1", "2", "6", "7"}, spatialIds(response))
+	assert.Nil(t, response.Devices[0].Distance)
+	assert.Equal(t, 0, len(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?bbox=0,0,1,1").Devices))
+}
+
+// Test the devices within a radius and the devices nearest to a point
+func TestDevicesHandlerNear(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+	response := getJSON[handler.GetDevicesResponse](t, router, "", "/devices?near="+newYork+"&radius_m=20000")
+	assert.Equal(t, []string{"9"}, spatialIds(response))
+	assert.InDelta(t, 8500, *response.Devices[0].Distance, 500)
+
+	// Toronto is closer to New York than Chicago
+	response = getJSON[handler.GetDevicesResponse](t, router, "", "/api/v1/devices?nearest="+newYork+"&limit=3")
+	assert.Equal(t, []string{"9", "10", "11"}, spatialIds(response))
+	assert.Less(t, *response.Devices[1].Distance, *response.Devices[2].Distance)
+	assert.Equal(t, []string{"9", "10"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest="+newYork+"&limit=2&bbox=-80,35,-70,45")))
+	assert.Equal(t, 9, len(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest="+newYork+"&limit=9").Devices))
+
+	// The pages of the nearest devices are sorted by distance
+	response = getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest="+newYork+"&limit=3&page_size=2")
+	assert.Equal(t, []string{"9", "10"}, spatialIds(response))
+	response = getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest="+newYork+"&limit=3&page_size=2&cursor="+url.QueryEscape(response.NextCursor))
+	assert.Equal(t, []string{"11"}, spatialIds(response))
+
+	for _, query := range []string{"bbox=1,2,3", "bbox=10,0,0,10", "near=" + newYork, "near=95,0&radius_m=10", "near=" + newYork + "&radius_m=10&nearest=" + newYork, "nearest=" + newYork + "&limit=0"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+// Test that the nearest devices are searched among the visible devices sorted by the distance column of a view
+func TestDevicesHandlerNearestVisible(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "9", Hidden: true}}
+	preferences.Views = map[string][]data.View{handler.AnonymousUser: {{Name: "Farthest", NumberOfRows: -1, Sort: []data.SortKey{{Column: "distance", Ascending: false}}}}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+	assert.Equal(t, []string{"10"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest="+newYork+"&limit=1")))
+	assert.Equal(t, []string{"11", "10"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?view=Farthest&near="+newYork+"&radius_m=1200000")))
+}
+
+// Test the devices within a radius crossing the antimeridian, and the nearest devices when they are far apart
+func TestDevicesHandlerAntimeridian(t *testing.T) {
+	client := upstreamClient(func(int) string {
+		return `{"result_list":[{"device_id":"east","latest_accurate_device_point":{"lat":-16.5,"lng":179.99}},` +
+			`{"device_id":"west","latest_accurate_device_point":{"lat":-16.5,"lng":-179.99}},` +
+			`{"device_id":"pole","latest_accurate_device_point":{"lat":89,"lng":0}}]}`
+	})
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), client, nil))
+	assert.ElementsMatch(t, []string{"east", "west"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?near=-16.5,179.995&radius_m=5000")))
+	assert.ElementsMatch(t, []string{"east", "west"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?near=-16.5,-179.995&radius_m=5000")))
+	assert.Equal(t, []string{"pole", "east"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest=80,10&limit=2")))
+}
+
+// Test that the nearest devices are searched across the antimeridian when the devices span too many cells to search
+// every cell
+func TestDevicesHandlerNearestAntimeridian(t *testing.T) {
+	var devices strings.Builder
+	devices.WriteString(`{"result_list":[{"device_id":"east","latest_accurate_device_point":{"lat":0,"lng":179}},` +
+		`{"device_id":"west","latest_accurate_device_point":{"lat":0,"lng":-179.95}}`)
+	// Filling a cell of the grid for every device far from the antimeridian
+	for idx := range 1000 {
+		fmt.Fprintf(&devices, `,{"device_id":"%d","latest_accurate_device_point":{"lat":%f,"lng":0}}`, idx, -80+float64(idx)*handler.SpatialCellDegrees)
+	}
+	devices.WriteString("]}")
+	client := upstreamClient(func(int) string {
+		return devices.String()
+	})
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), client, nil))
+	assert.Equal(t, []string{"west"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest=0,179.95&limit=1")))
+	assert.Equal(t, []string{"east", "west"}, spatialIds(getJSON[handler.GetDevicesResponse](t, router, "", "/devices?nearest=0,179.5&limit=2")))
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stopPositions are the latest points of device 42 returned by the one step api for the successive fetches. The device
+// is parked for an hour, idles for 5 minutes, drives away and idles since, drifting by a few meters
+var stopPositions = []string{
+	`"lat":34.5,"lng":-118.25,"dt_tracker":"2024-03-01T10:00:00Z","device_state":{"drive_status":"off"}`,
+	`"lat":34.5,"lng":-118.25,"dt_tracker":"2024-03-01T11:00:00Z","device_state":{"drive_status":"on"}`,
+	`"lat":34.52,"lng":-118.25,"dt_tracker":"2024-03-01T11:05:00Z","device_state":{"drive_status":"on"}`,
+	`"lat":34.5201,"lng":-118.25,"dt_tracker":"2024-03-01T11:06:00Z","device_state":{"drive_status":"on"}`,
+}
+
+// stopsRouter returns the router of a handler which fetched all the stopPositions of device 42, with the thresholds of
+// the trucks group
+func stopsRouter(t *testing.T, thresholds data.Thresholds) *http.ServeMux {
+	t.Helper()
+	client := upstreamClient(func(request int) string {
+		return fmt.Sprintf(`{"result_list":[{"device_id":"42","display_name":"Truck","latest_accurate_device_point":{%s}},{"device_id":"43","display_name":"Van"}]}`,
+			stopPositions[min(request, len(stopPositions))-1])
+	})
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{{DeviceID: "42", Groups: []string{"trucks"}}}
+	preferences.GroupThresholds = map[string]data.Thresholds{"trucks": thresholds}
+	router := handler.NewRouter(handler.NewHandler(preferences, client, nil))
+	for range stopPositions {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/devices", nil))
+	}
+	return router
+}
+
+// getStops returns the stops of the response of the request
+func getStops(t *testing.T, router *http.ServeMux, target string) []handler.Stop {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response handler.GetStopsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response.Stops
+}
+
+// Test the stops detected with the thresholds of the group of a device
+func TestStopsHandler(t *testing.T) {
+	router := stopsRouter(t, data.Thresholds{IdleSeconds: 600, StopSeconds: 3600})
+	stops := getStops(t, router, "/stops")
+	// The idle period of 5 minutes is shorter than the threshold of the group
+	assert.Equal(t, 2, len(stops))
+
+	stop := stops[0]
+	assert.Equal(t, "42", stop.DeviceID)
+	assert.Equal(t, "Truck", stop.DisplayName)
+	assert.Equal(t, handler.StopKindStop, stop.Kind)
+	assert.Equal(t, "2024-03-01T10:00:00Z", stop.Start.Format(time.RFC3339))
+	assert.Equal(t, "2024-03-01T11:00:00Z", stop.End.Format(time.RFC3339))
+	assert.Equal(t, int64(3600), stop.Duration)
+	assert.False(t, stop.Ongoing)
+
+	// The drift of the gps does not end the ongoing stop
+	stop = stops[1]
+	assert.Equal(t, handler.StopKindIdle, stop.Kind)
+	assert.Equal(t, "2024-03-01T11:05:00Z", stop.Start.Format(time.RFC3339))
+	assert.Equal(t, 34.52, stop.Lat)
+	assert.True(t, stop.Ongoing)
+
+	stops = getStops(t, router, "/api/v1/stops?kind=idle")
+	assert.Equal(t, 1, len(stops))
+	assert.True(t, stops[0].Ongoing)
+	assert.Equal(t, 0, len(getStops(t, router, "/stops?from=2024-03-01T08:00:00Z&to=2024-03-01T09:00:00Z")))
+
+	// A stop shorter than the threshold is reported with a smaller threshold
+	router = stopsRouter(t, data.Thresholds{IdleSeconds: 60, StopSeconds: 3600})
+	assert.Equal(t, 3, len(getStops(t, router, "/stops")))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/stops?kind=driving", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/stops?to=tomorrow", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// Test the idle duration of the devices
+func TestDevicesHandlerIdle(t *testing.T) {
+	router := stopsRouter(t, data.Thresholds{IdleSeconds: 600})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response handler.GetDevicesResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	idle := make(map[string]*int64)
+	for _, device := range response.Devices {
+		idle[device.DeviceID] = device.IdleDuration
+	}
+	assert.NotNil(t, idle["42"])
+	assert.Greater(t, *idle["42"], int64(time.Since(time.Date(2024, 3, 1, 11, 5, 0, 0, time.UTC)).Seconds())-60)
+	assert.Nil(t, idle["43"])
+}
+
+// Test the validation of the thresholds of the groups
+func TestThresholdsValidation(t *testing.T) {
+	preferences := &data.PreferencesImpl{
+		SortColumn: "device_id", NumberOfRows: -1,
+		GroupThresholds: map[string]data.Thresholds{"trucks": {IdleSeconds: -1}},
+	}
+	var validationError *data.ValidationError
+	assert.ErrorAs(t, data.Validate(preferences, nil), &validationError)
+	assert.Equal(t, 1, len(validationError.Errors))
+	assert.Equal(t, "group_thresholds.trucks.idle_seconds", validationError.Errors[0].Field)
+
+	preferences.GroupThresholds = map[string]data.Thresholds{"trucks": {IdleSeconds: 60}, "*": {IdleSeconds: 120, StopSeconds: 1800}}
+	thresholds := data.DeviceThresholds(preferences, []string{"trucks"})
+	assert.Equal(t, 60, thresholds.IdleSeconds)
+	assert.Equal(t, 1800, thresholds.StopSeconds)
+	assert.Equal(t, int(data.DefaultStopThreshold.Seconds()), data.DeviceThresholds(&data.PreferencesImpl{}, []string{"vans"}).StopSeconds)
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test the summary of the devices which are not hidden, regardless of the number of rows of a page
+func TestDevicesSummaryHandler(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.NumberOfRows = 2
+	preferences.DevicePreferences = []data.DevicePreferences{
+		{DeviceID: "6", Hidden: true},
+		{DeviceID: "7", Groups: []string{"West", "Trucks"}, Tags: []string{"reefer"}},
+		{DeviceID: "9", Groups: []string{"Trucks"}},
+	}
+	preferences.Views = map[string][]data.View{"dispatcher": {{Name: "Driving", NumberOfRows: -1, Filters: []data.Filter{{Column: "drive_status", Operator: "eq", Value: "on"}}}}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	// Device 1 is listed twice by the one step api and device 6 is hidden
+	summary := getJSON[handler.DevicesSummary](t, router, "alice", "/devices/summary")
+	assert.Equal(t, 8, summary.Total)
+	assert.Equal(t, 5, summary.Online)
+	assert.Equal(t, 3, summary.Offline)
+	assert.Equal(t, map[string]int{"active": 5, "inactive": 3}, summary.ActiveState)
+	assert.Equal(t, map[string]int{"off": 5, "on": 3}, summary.DriveStatus)
+	assert.Equal(t, map[string]int{"West": 1, "Trucks": 2}, summary.Groups)
+	assert.Equal(t, map[string]int{"reefer": 1}, summary.Tags)
+	assert.Equal(t, []float64{-117.7946942, 28.5383364, -0.1277583, 51.5073509}, summary.BoundingBox)
+	assert.NotNil(t, summary.Centroid)
+
+	summary = getJSON[handler.DevicesSummary](t, router, "dispatcher", "/api/v1/devices/summary?view=Driving")
+	assert.Equal(t, 3, summary.Total)
+	assert.Equal(t, map[string]int{"on": 3}, summary.DriveStatus)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/summary?view=Parked", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// Test the summary without devices
+func TestDevicesSummaryHandlerEmpty(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.Views = map[string][]data.View{handler.AnonymousUser: {{Name: "None", NumberOfRows: -1, Default: true, Filters: []data.Filter{{Column: "device_id", Operator: "eq", Value: "0"}}}}}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+	summary := getJSON[handler.DevicesSummary](t, router, handler.AnonymousUser, "/devices/summary")
+	assert.Equal(t, 0, summary.Total)
+	assert.Nil(t, summary.BoundingBox)
+	assert.Nil(t, summary.Centroid)
+}
+
+// Test that the bounding box and the centroid leave out the devices without a location and wrap around the antimeridian
+func TestDevicesSummaryHandlerAntimeridian(t *testing.T) {
+	client := upstreamClient(func(int) string {
+		return `{"result_list":[{"device_id":"1","latest_accurate_device_point":{"lat":-17,"lng":179}},` +
+			`{"device_id":"2","latest_accurate_device_point":{"lat":-19,"lng":-179}},` +
+			`{"device_id":"3","latest_accurate_device_point":{"lat":0,"lng":0}}]}`
+	})
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), client, nil))
+	summary := getJSON[handler.DevicesSummary](t, router, handler.AnonymousUser, "/devices/summary")
+	assert.Equal(t, 3, summary.Total)
+	assert.Equal(t, []float64{179, -19, -179, -17}, summary.BoundingBox)
+	assert.InDelta(t, -18, summary.Centroid.Lat, 1e-9)
+	assert.InDelta(t, 180, math.Abs(summary.Centroid.Lng), 1e-9)
+}
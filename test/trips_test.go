@@ -0,0 +1,101 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tripPositions are the latest points of device 42 returned by the one step api for the successive fetches
+var tripPositions = []string{
+	`"lat":34.5,"lng":-118.25,"dt_tracker":"2024-03-01T10:00:00Z","device_state":{"drive_status":"off"}`,
+	`"lat":34.5,"lng":-118.25,"speed":30,"dt_tracker":"2024-03-01T10:01:00Z","device_state":{"drive_status":"on"}`,
+	`"lat":34.51,"lng":-118.25,"speed":55,"dt_tracker":"2024-03-01T10:02:00Z","device_state":{"drive_status":"on"}`,
+	`"lat":34.52,"lng":-118.25,"speed":0,"dt_tracker":"2024-03-01T10:03:00Z","device_state":{"drive_status":"off"}`,
+	`"lat":34.52,"lng":-118.25,"dt_tracker":"2024-03-01T11:00:00Z","device_state":{"drive_status":"on"}`,
+	`"lat":34.53,"lng":-118.25,"dt_tracker":"2024-03-01T11:01:00Z","device_state":{"drive_status":"on"}`,
+}
+
+// tripsRouter returns the router of a handler which fetched all the tripPositions of device 42. The setup functions are
+// applied to the handler before the positions are fetched
+func tripsRouter(t *testing.T, setup ...func(*handler.Handler)) *http.ServeMux {
+	t.Helper()
+	client := upstreamClient(func(request int) string {
+		return fmt.Sprintf(`{"result_list":[{"device_id":"42","display_name":"Truck","latest_accurate_device_point":{%s}},{"device_id":"43","display_name":"Van"}]}`,
+			tripPositions[min(request, len(tripPositions))-1])
+	})
+	apiHandler := handler.NewHandler(GetNewPreferences(), client, nil)
+	for _, apply := range setup {
+		apply(apiHandler)
+	}
+	router := handler.NewRouter(apiHandler)
+	for range tripPositions {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/devices", nil))
+	}
+	return router
+}
+
+// getTrips returns the trips of the response of the request
+func getTrips(t *testing.T, router *http.ServeMux, target string) []handler.Trip {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response handler.GetTripsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response.Trips
+}
+
+// Test the trips detected from the drive status of a device
+func TestDeviceTripsHandler(t *testing.T) {
+	router := tripsRouter(t)
+	trips := getTrips(t, router, "/devices/42/trips")
+	assert.Equal(t, 2, len(trips))
+
+	trip := trips[0]
+	assert.Equal(t, "Truck", trip.DisplayName)
+	assert.Equal(t, "2024-03-01T10:01:00Z", trip.Start.Time.Format(time.RFC3339))
+	assert.Equal(t, 34.5, trip.Start.Lat)
+	assert.Equal(t, "2024-03-01T10:03:00Z", trip.End.Time.Format(time.RFC3339))
+	assert.Equal(t, 34.52, trip.End.Lat)
+	// 0.02 degrees of latitude
+	assert.InDelta(t, 2223.9, trip.Distance, 1)
+	assert.Equal(t, int64(120), trip.Duration)
+	assert.Equal(t, 55.0, *trip.MaxSpeed)
+	assert.False(t, trip.Ongoing)
+
+	// The speed is computed when the device does not report it
+	trip = trips[1]
+	assert.True(t, trip.Ongoing)
+	assert.InDelta(t, 1112, trip.Distance, 1)
+	assert.InDelta(t, 66.7, *trip.MaxSpeed, 0.1)
+
+	trips = getTrips(t, router, "/devices/42/trips?from=2024-03-01T10:30:00Z")
+	assert.Equal(t, 1, len(trips))
+	assert.True(t, trips[0].Ongoing)
+	assert.Equal(t, 0, len(getTrips(t, router, "/devices/43/trips")))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/44/trips", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices/42/trips?from=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// Test the trips of the fleet
+func TestTripsHandler(t *testing.T) {
+	router := tripsRouter(t)
+	trips := getTrips(t, router, "/api/v1/trips?from=2024-03-01T09:00:00Z&to=2024-03-01T10:30:00Z")
+	assert.Equal(t, 1, len(trips))
+	assert.Equal(t, "42", trips[0].DeviceID)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/trips?from=2024-03-02T00:00:00Z&to=2024-03-01T00:00:00Z", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUpstream starts a fake one step api. respond writes the response to the request with the given number, starting
+// at 1, and returns false to answer with the devices of api_response.json instead. Returns the router of a handler
+// fetching from the fake api, its upstream client and the number of requests received
+func fakeUpstream(t *testing.T, respond func(w http.ResponseWriter, request int) bool) (*http.ServeMux, *handler.UpstreamClient, *atomic.Int32) {
+	t.Helper()
+	server, requests := upstreamServer(t, func(w http.ResponseWriter, r *http.Request, request int) bool {
+		return respond(w, request)
+	})
+	apiHandler := handler.NewHandler(GetNewPreferences(), server.Client(), nil)
+	apiHandler.Upstreams[0].URL = server.URL
+	apiHandler.Upstreams[0].Backoff = time.Millisecond
+	apiHandler.Upstreams[0].MaxBackoff = 10 * time.Millisecond
+	return handler.NewRouter(apiHandler), apiHandler.Upstreams[0], requests
+}
+
+// Test that server errors of the one step api are retried
+func TestUpstream_Retry(t *testing.T) {
+	router, _, requests := fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		if request < 3 {
+			http.Error(w, "unavailable", http.StatusBadGateway)
+			return true
+		}
+		return false
+	})
+	rr := serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// The requests are given up after the last attempt, and the error of the one step api is not sent to the client
+	router, _, requests = fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		http.Error(w, "internal details", http.StatusInternalServerError)
+		return true
+	})
+	rr = serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "internal details")
+	assert.Equal(t, int32(handler.DefaultUpstreamAttempts), requests.Load())
+}
+
+// Test that client errors of the one step api are not retried
+func TestUpstream_ClientError(t *testing.T) {
+	router, _, requests := fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return true
+	})
+	rr := serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// An invalid body is retried like a truncated one
+	router, _, requests = fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		if request == 1 {
+			w.Write([]byte(`{"result_list": [`))
+			return true
+		}
+		return false
+	})
+	rr = serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+// Test the Retry-After header of rate limited requests
+func TestUpstream_RetryAfter(t *testing.T) {
+	router, _, requests := fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		if request == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return true
+		}
+		return false
+	})
+	rr := serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// A wait longer than the maximum backoff is not waited for but passed to the client
+	router, _, requests = fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	})
+	rr = serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "120", rr.Header().Get("Retry-After"))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+// Test the timeout of the requests to the one step api
+func TestUpstream_Timeout(t *testing.T) {
+	router, upstream, requests := fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		time.Sleep(100 * time.Millisecond)
+		return false
+	})
+	upstream.Timeout = 10 * time.Millisecond
+	upstream.Attempts = 2
+	rr := serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+// Test that the circuit breaker fails fast while the one step api is down
+func TestUpstream_CircuitBreaker(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	router, upstream, requests := fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	upstream.Attempts = 1
+	upstream.BreakerThreshold = 2
+	upstream.BreakerCooldown = 50 * time.Millisecond
+
+	assert.Equal(t, http.StatusServiceUnavailable, serveRequest(router, "", "GET", "/devices", "").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serveRequest(router, "", "GET", "/devices", "").Code)
+	assert.Equal(t, int32(2), requests.Load())
+	// The breaker is open, so the one step api is not called
+	rr := serveRequest(router, "", "GET", "/devices", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// After the cooldown a failed fetch opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, serveRequest(router, "", "GET", "/devices", "").Code)
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Equal(t, http.StatusServiceUnavailable, serveRequest(router, "", "GET", "/devices", "").Code)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// A successful fetch closes the breaker
+	down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "", "GET", "/devices", "").Code)
+	assert.Equal(t, http.StatusOK, serveRequest(router, "", "GET", "/devices", "").Code)
+	assert.Equal(t, int32(5), requests.Load())
+}
+
+// Test that the preferences can be saved while the one step api is unavailable, without checking that their devices
+// exist
+func TestUpstream_SavePreferences(t *testing.T) {
+	router, _, _ := fakeUpstream(t, func(w http.ResponseWriter, request int) bool {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return true
+	})
+	req := httptest.NewRequest("POST", "/preferences", strings.NewReader(`{"sort_column":"lat","device_preferences":[{"device_id":"404"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/preferences", strings.NewReader(`{"sort_column":"lng"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"main/data"
+	"main/handler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// deviceIds returns the ids of the devices in the response of the devices api
+func deviceIds(t *testing.T, rr *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var response handler.GetDevicesResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	ids := make([]string, 0)
+	for _, device := range response.Devices {
+		ids = append(ids, device.DeviceID)
+	}
+	return ids
+}
+
+// Test creating, listing and deleting the views of a user
+func TestViewsHandler(t *testing.T) {
+	router := handler.NewRouter(handler.NewHandler(GetNewPreferences(), mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("PUT", "/api/v1/views/Driving%20now", strings.NewReader(`{"filters":[{"column":"drive_status","operator":"eq","value":"on"}],"default":true}`))
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"1"`, rr.Header().Get("ETag"))
+	var view data.View
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&view))
+	assert.Equal(t, "Driving now", view.Name)
+	assert.Equal(t, -1, view.NumberOfRows)
+
+	// Views are stored per user
+	req = httptest.NewRequest("GET", "/views", nil)
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var response handler.GetViewsResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, 1, len(response.Views))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/views", nil))
+	response = handler.GetViewsResponse{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, 0, len(response.Views))
+
+	// A new default view replaces the previous default view
+	req = httptest.NewRequest("PUT", "/views/West", strings.NewReader(`{"filters":[{"column":"lng","operator":"lt","value":"-100"}],"default":true}`))
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "West", testPreferences.GetViews()["dispatcher"][1].Name)
+	assert.False(t, testPreferences.GetViews()["dispatcher"][0].Default)
+
+	req = httptest.NewRequest("DELETE", "/views/West", nil)
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, 1, len(testPreferences.GetViews()["dispatcher"]))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/views/West", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// Test that invalid views are rejected with the invalid fields
+func TestViewsHandler_Validation(t *testing.T) {
+	preferences := GetNewPreferences()
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/views/Invalid", strings.NewReader(`{"filters":[{"column":"speed","operator":"eq","value":"1"},{"column":"lat","operator":"gt","value":"north"},{"column":"altitude","operator":"contains","value":"1"}],"sort":[{"column":"group"}],"number_of_rows":5000}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var response handler.ValidationErrorResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, 5, len(response.Errors))
+	// The numeric columns are not matched as text
+	assert.Contains(t, response.Errors, data.FieldError{Field: "views.anonymous[0].filters[2].operator", Message: "must be one of eq, ne, lt, lte, gt, gte"})
+	assert.Equal(t, 0, len(preferences.GetViews()["anonymous"]))
+
+	// An invalid view stored before the views were validated does not prevent saving the other views
+	preferences.Views = map[string][]data.View{"anonymous": {{Name: "Legacy", NumberOfRows: 5000}}, "other": {{Name: "Legacy", NumberOfRows: 0}}}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/views/Valid", strings.NewReader(`{"number_of_rows":10}`)))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, 2, len(preferences.GetViews()["anonymous"]))
+}
+
+// Test that the devices api filters, sorts and paginates the devices using the requested view or the default view
+func TestDevicesHandler_View(t *testing.T) {
+	preferences := GetNewPreferences()
+	preferences.DevicePreferences = []data.DevicePreferences{
+		{DeviceID: "6", Groups: []string{"West"}},
+		{DeviceID: "7", Groups: []string{"West"}},
+		{DeviceID: "3", Hidden: true},
+	}
+	preferences.Views = map[string][]data.View{
+		"dispatcher": {
+			{
+				Name:         "Driving now",
+				Filters:      []data.Filter{{Column: "drive_status", Operator: "eq", Value: "on"}},
+				Sort:         []data.SortKey{{Column: "lat", Ascending: false}},
+				NumberOfRows: 2,
+				Columns:      []string{"display_name", "lat"},
+				Default:      true,
+			},
+			{
+				Name:         "West coast",
+				Filters:      []data.Filter{{Column: "group", Operator: "eq", Value: "west"}, {Column: "display_name", Operator: "contains", Value: "DEF"}},
+				NumberOfRows: -1,
+			},
+			{
+				Name:         "Active",
+				Filters:      []data.Filter{{Column: "active_state", Operator: "eq", Value: "active"}, {Column: "lat", Operator: "gte", Value: "40"}},
+				Sort:         []data.SortKey{{Column: "online", Ascending: true}, {Column: "device_id", Ascending: false}},
+				NumberOfRows: -1,
+			},
+		},
+	}
+	router := handler.NewRouter(handler.NewHandler(preferences, mockDevicesClient(t), nil))
+
+	req := httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{"5", "6"}, deviceIds(t, rr))
+
+	req = httptest.NewRequest("GET", "/devices?page=2", nil)
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var response handler.GetDevicesResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, "Driving now", response.View)
+	assert.Equal(t, []string{"display_name", "lat"}, response.Columns)
+	assert.Equal(t, "7", response.Devices[0].DeviceID)
+	// The devices only hold the columns of the view
+	assert.NotEqual(t, 0.0, response.Devices[0].LatestDevicePoint.Lat)
+	assert.Equal(t, "", response.Devices[0].ActiveState)
+	assert.False(t, response.NextPage)
+
+	req = httptest.NewRequest("GET", "/devices?view=West%20coast", nil)
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, []string{"7"}, deviceIds(t, rr))
+
+	req = httptest.NewRequest("GET", "/devices?view=Active", nil)
+	req.Header.Set(handler.UserHeader, "dispatcher")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, []string{"9", "11", "10"}, deviceIds(t, rr))
+
+	// Views of other users are not visible
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/devices?view=Active", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}